@@ -1,12 +1,20 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 	"ntsc.ac.cn/ta-router/internal/router"
+	"ntsc.ac.cn/ta-router/pkg/tools"
 )
 
 var envs struct {
@@ -18,7 +26,25 @@ var envs struct {
 	wireguardToolsPath string
 	ipToolsPath        string
 	iptablesPath       string
+	ip6tablesPath      string
 	ipsetPath          string
+	nftPath            string
+	reconcileInterval  time.Duration
+	watchInterval      time.Duration
+	stateDir           string
+	teardown           bool
+	metricsAddr        string
+	heartbeatInterval  time.Duration
+	handshakeTimeout   time.Duration
+	handshakeCheck     time.Duration
+	resolveInterval    time.Duration
+	apiSocket          string
+	apiAddr            string
+	staleAction        string
+	dryRun             bool
+	auditCommands      bool
+	planFormat         string
+	procRoot           string
 }
 
 func init() {
@@ -29,6 +55,10 @@ func init() {
 			Fatalf("unsupport log level: %s", envs.loggerLevel)
 	}
 	logrus.SetOutput(os.Stdout)
+	if envs.dryRun {
+		// keep stdout for the plan
+		logrus.SetOutput(os.Stderr)
+	}
 	logrus.SetLevel(logLevel)
 	formatter := new(prefixed.TextFormatter)
 	logrus.SetFormatter(formatter)
@@ -44,6 +74,11 @@ func _flags() {
 	flag.StringVar(&envs.certPath, "cert-path",
 		"/etc/ntsc/ta/router/certs",
 		"system certificates path")
+	flag.StringVar(&envs.procRoot, "proc-root", "/proc",
+		"proc filesystem mount point, ip forward is enabled under it")
+	flag.StringVar(&envs.stateDir, "state-path",
+		"/var/lib/ntsc/ta/router",
+		"router state path, last known good config is cached here")
 	flag.StringVar(&envs.serverName, "server-name",
 		"s1.restry.ta.ntsc.ac.cn",
 		"registry service certificate server name")
@@ -55,27 +90,155 @@ func _flags() {
 		"ip tools executer path")
 	flag.StringVar(&envs.iptablesPath, "iptables-path", "",
 		"iptables executer path")
+	flag.StringVar(&envs.ip6tablesPath, "ip6tables-path", "",
+		"ip6tables executer path")
 	flag.StringVar(&envs.ipsetPath, "ipset-path", "",
 		"ipset executer path")
+	flag.StringVar(&envs.nftPath, "nft-path", "",
+		"nft executer path, used when iptables is absent")
+	flag.DurationVar(&envs.reconcileInterval, "reconcile-interval",
+		time.Second*30,
+		"interval of reconcile wireguard state with applied config")
+	flag.DurationVar(&envs.watchInterval, "watch-interval",
+		time.Second*10,
+		"interval of polling registry config revision")
+	flag.DurationVar(&envs.heartbeatInterval, "heartbeat-interval",
+		time.Second*30,
+		"interval of reporting router status to registry")
+	flag.DurationVar(&envs.handshakeTimeout, "handshake-timeout",
+		time.Minute*3,
+		"peers without handshake for longer are stale, 0 disables monitor")
+	flag.DurationVar(&envs.handshakeCheck, "handshake-check-interval",
+		router.HANDSHAKE_CHECK_INTERVAL,
+		"interval of checking peer handshake age")
+	flag.DurationVar(&envs.resolveInterval, "resolve-interval",
+		time.Second*30,
+		"interval of re-resolving peer endpoints, 0 disables re-resolution")
+	flag.StringVar(&envs.staleAction, "stale-action", "none",
+		"action on stale peer, none, reconfigure or reresolve")
+	flag.BoolVar(&envs.teardown, "teardown", false,
+		"remove managed interfaces, routes and iptables chains on exit")
+	flag.StringVar(&envs.metricsAddr, "metrics-addr", "",
+		"prometheus metrics listen address like :9586, disabled when empty")
+	flag.StringVar(&envs.apiSocket, "api-socket", "/run/ta-router/api.sock",
+		"management api unix socket, disabled when empty")
+	flag.StringVar(&envs.apiAddr, "api-addr", "",
+		"management api tcp listen address with mutual tls, disabled when empty")
+	flag.BoolVar(&envs.auditCommands, "audit-commands", false,
+		"log every external command run by router")
+	flag.BoolVar(&envs.dryRun, "dry-run", false,
+		"print the changes registry config would make and exit without applying")
+	flag.StringVar(&envs.planFormat, "plan-format", "text",
+		"dry run output format, text or json")
 	flag.Parse()
 }
 
 func Execute() {
 	r, err := router.NewWireguardRouter(&router.Config{
-		CertPath:           envs.certPath,
-		ServerName:         envs.serverName,
-		ManagerEndpoint:    envs.registryEndpoint,
-		WireguardPath:      envs.wireguardPath,
-		WireguardToolsPath: envs.wireguardToolsPath,
-		IPToolsPath:        envs.ipToolsPath,
-		IPTablesPath:       envs.iptablesPath,
-		IPSetPath:          envs.ipsetPath,
+		CertPath:               envs.certPath,
+		ServerName:             envs.serverName,
+		ManagerEndpoint:        envs.registryEndpoint,
+		WireguardPath:          envs.wireguardPath,
+		WireguardToolsPath:     envs.wireguardToolsPath,
+		IPToolsPath:            envs.ipToolsPath,
+		IPTablesPath:           envs.iptablesPath,
+		IP6TablesPath:          envs.ip6tablesPath,
+		IPSetPath:              envs.ipsetPath,
+		NFTPath:                envs.nftPath,
+		ReconcileInterval:      envs.reconcileInterval,
+		WatchInterval:          envs.watchInterval,
+		StateDir:               envs.stateDir,
+		Teardown:               envs.teardown && !envs.dryRun,
+		MetricsAddr:            envs.metricsAddr,
+		HeartbeatInterval:      envs.heartbeatInterval,
+		HandshakeTimeout:       envs.handshakeTimeout,
+		HandshakeCheckInterval: envs.handshakeCheck,
+		StaleAction:            envs.staleAction,
+		ResolveInterval:        envs.resolveInterval,
+		APISocket:              envs.apiSocket,
+		APIAddr:                envs.apiAddr,
+		AuditCommands:          envs.auditCommands,
+		ProcRoot:               envs.procRoot,
 	})
 	if err != nil {
 		logrus.WithField("prefix", "main").Fatalf(
 			"create wireguard router failed: %v", err)
 	}
-	logrus.WithField("prefix", "main").Fatalf(
-		"run wireguard router failed: %s", <-r.Start())
-	r.Start()
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if envs.dryRun {
+		dryRun(ctx, r)
+		return
+	}
+	checkInternet()
+	for err := range r.Start(ctx) {
+		logrus.WithField("prefix", "main").Errorf(
+			"run wireguard router failed: %v", err)
+	}
+	signaled := ctx.Err() != nil
+	// a second signal kills a hung shutdown
+	stop()
+	if !signaled {
+		logrus.WithField("prefix", "main").Fatalf(
+			"wireguard router stopped unexpectedly")
+	}
+	logrus.WithField("prefix", "main").Infof(
+		"received stop signal, shutdown wireguard router")
+	stopCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := r.Stop(stopCtx); err != nil {
+		logrus.WithField("prefix", "main").Fatalf(
+			"shutdown wireguard router failed: %v", err)
+	}
+}
+
+// checkInternet ping registry host, registry may be unreachable at boot
+// and cached config is used then, so failure is only warned
+func checkInternet() {
+	pingAddr, err := url.Parse(envs.registryEndpoint)
+	if err != nil {
+		logrus.WithField("prefix", "main").
+			Warnf("check internet failed: %v", err)
+		return
+	}
+	if rtt, err := tools.Ping(pingAddr.Hostname()); err != nil {
+		logrus.WithField("prefix", "main").
+			Warnf("check internet failed: %v", err)
+	} else {
+		logrus.WithField("prefix", "main").
+			Infof("check internet success,ping addr [%s] counter [%d] rtt avg [%s]",
+				pingAddr.Hostname(), tools.DEFAULT_PING_COUNT, rtt)
+	}
+}
+
+// dryRun print plan of registry config and release router
+func dryRun(ctx context.Context, r *router.WireguardRouter) {
+	if envs.planFormat != "text" && envs.planFormat != "json" {
+		logrus.WithField("prefix", "main").Fatalf(
+			"unknow plan format [%s]", envs.planFormat)
+	}
+	plan, err := r.Plan(ctx)
+	if err != nil {
+		logrus.WithField("prefix", "main").Fatalf(
+			"plan wireguard router failed: %v", err)
+	}
+	switch envs.planFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(plan)
+	default:
+		_, err = fmt.Fprint(os.Stdout, plan.String())
+	}
+	if err != nil {
+		logrus.WithField("prefix", "main").Fatalf(
+			"print plan failed: %v", err)
+	}
+	stopCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err = r.Stop(stopCtx); err != nil {
+		logrus.WithField("prefix", "main").Fatalf(
+			"release wireguard router failed: %v", err)
+	}
 }
@@ -0,0 +1,292 @@
+package reconcile
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/iptools"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+)
+
+// AddressDelta stale and missing addresses of dev, link local addresses
+// are never stale
+func AddressDelta(addrs, desired []string) ([]string, []string) {
+	stale, missing := make([]string, 0), make([]string, 0)
+	for _, addr := range addrs {
+		if containsCIDR(desired, addr, false) {
+			continue
+		}
+		if ip, _, err := net.ParseCIDR(addr); err == nil && ip.IsLinkLocalUnicast() {
+			continue
+		}
+		stale = append(stale, addr)
+	}
+	for _, addr := range desired {
+		if !containsCIDR(addrs, addr, false) {
+			missing = append(missing, addr)
+		}
+	}
+	return stale, missing
+}
+
+// RouteDelta stale unicast routes of dev and missing peer routes, kernel
+// routes are left alone
+func RouteDelta(routes []*iptools.Route, wgconf *registry.WireguardConfig) ([]*iptools.Route, []string) {
+	stale, missing := make([]*iptools.Route, 0), make([]string, 0)
+	desired := wgconf.Routes()
+	liveRoutes := make([]string, 0)
+	for _, route := range routes {
+		if route.Dev != wgconf.Name || route.Proto == "kernel" ||
+			route.Type != "unicast" {
+			continue
+		}
+		liveRoutes = append(liveRoutes, route.Network())
+		if !containsCIDR(desired, route.Network(), true) {
+			stale = append(stale, route)
+		}
+	}
+	for _, addr := range desired {
+		if containsCIDR(liveRoutes, addr, true) {
+			continue
+		}
+		liveRoutes = append(liveRoutes, addr)
+		missing = append(missing, addr)
+	}
+	return stale, missing
+}
+
+// TunnelRules policy routing rules of wireguard interface, rules are only
+// managed for a dedicated routing table
+func TunnelRules(wgconf *registry.WireguardConfig) []*iptools.Rule {
+	rules := make([]*iptools.Rule, 0)
+	if !DedicatedTable(wgconf.Table) {
+		return rules
+	}
+	for _, rule := range wgconf.Rules {
+		rules = append(rules, &iptools.Rule{
+			Priority: rule.Priority,
+			From:     rule.From,
+			To:       rule.To,
+			Fwmark:   rule.Fwmark,
+			Iif:      rule.Iif,
+			Table:    wgconf.Table,
+		})
+	}
+	return rules
+}
+
+// DedicatedTable assert table is a routing table owned by one tunnel
+func DedicatedTable(table string) bool {
+	switch table {
+	case "", "main", "local", "default", "0", "253", "254", "255":
+		return false
+	}
+	return true
+}
+
+// RuleDelta stale rules which lookup the dedicated table of dev and
+// missing tunnel rules
+func RuleDelta(rules []*iptools.Rule, wgconf *registry.WireguardConfig) ([]*iptools.Rule, []*iptools.Rule) {
+	stale, missing := make([]*iptools.Rule, 0), make([]*iptools.Rule, 0)
+	if !DedicatedTable(wgconf.Table) {
+		return stale, missing
+	}
+	desired := TunnelRules(wgconf)
+	for _, rule := range rules {
+		if iptools.SameTable(rule.Table, wgconf.Table) && !containsRule(desired, rule) {
+			stale = append(stale, rule)
+		}
+	}
+	for _, rule := range desired {
+		if !containsRule(rules, rule) {
+			missing = append(missing, rule)
+		}
+	}
+	return stale, missing
+}
+
+func containsRule(rules []*iptools.Rule, rule *iptools.Rule) bool {
+	for _, r := range rules {
+		if r.Equal(rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeptEndpoints public keys of peers whose live endpoint is kept since it
+// may have roamed, that is the desired endpoint is empty or unchanged
+// since the previous applied config prev, without prev only hostname
+// endpoints are kept, any other desired endpoint replaces the live one
+func KeptEndpoints(dev *wgtypes.Device, wgconf, prev *registry.WireguardConfig) map[wgtypes.Key]bool {
+	desired := make(map[string]string)
+	for _, p := range wgconf.Peers {
+		desired[p.PubKey] = p.Endpoint
+	}
+	applied := make(map[string]string)
+	if prev != nil {
+		for _, p := range prev.Peers {
+			applied[p.PubKey] = p.Endpoint
+		}
+	}
+	kept := make(map[wgtypes.Key]bool)
+	for _, p := range dev.Peers {
+		key := p.PublicKey.String()
+		endpoint, ok := desired[key]
+		if !ok || p.Endpoint == nil {
+			continue
+		}
+		if last, known := applied[key]; known {
+			kept[p.PublicKey] = endpoint == "" || endpoint == last
+			continue
+		}
+		host, _, err := wireguard.SplitEndpoint(endpoint)
+		kept[p.PublicKey] = endpoint == "" || (err == nil && net.ParseIP(host) == nil)
+	}
+	return kept
+}
+
+// DeviceDelta build the config needed to converge live device to desired
+// config, live endpoints of kept peers are left alone, nil is returned
+// when nothing changed
+func DeviceDelta(dev *wgtypes.Device, conf *wgtypes.Config, kept map[wgtypes.Key]bool) *wgtypes.Config {
+	delta := &wgtypes.Config{
+		ReplacePeers: false,
+		Peers:        make([]wgtypes.PeerConfig, 0),
+	}
+	changed := false
+	if conf.PrivateKey != nil && dev.PrivateKey != *conf.PrivateKey {
+		delta.PrivateKey = conf.PrivateKey
+		changed = true
+	}
+	if conf.ListenPort != nil && dev.ListenPort != *conf.ListenPort {
+		delta.ListenPort = conf.ListenPort
+		changed = true
+	}
+	livePeers := make(map[wgtypes.Key]wgtypes.Peer)
+	for _, p := range dev.Peers {
+		livePeers[p.PublicKey] = p
+	}
+	desiredPeers := make(map[wgtypes.Key]bool)
+	for _, pc := range conf.Peers {
+		desiredPeers[pc.PublicKey] = true
+		p, exist := livePeers[pc.PublicKey]
+		if exist && !PeerDrifted(&p, &pc, kept[pc.PublicKey]) {
+			continue
+		}
+		if exist {
+			// nil means keep current value for wgctrl, clear it explicitly
+			if pc.PresharedKey == nil {
+				pc.PresharedKey = &wgtypes.Key{}
+			}
+			if pc.PersistentKeepaliveInterval == nil {
+				kad := time.Duration(0)
+				pc.PersistentKeepaliveInterval = &kad
+			}
+			// keep live endpoint, the endpoint resolver replaces it once
+			// the handshake goes stale
+			if kept[pc.PublicKey] {
+				pc.Endpoint = nil
+			}
+		}
+		pc.UpdateOnly = exist
+		pc.ReplaceAllowedIPs = true
+		delta.Peers = append(delta.Peers, pc)
+	}
+	for _, p := range dev.Peers {
+		if !desiredPeers[p.PublicKey] {
+			delta.Peers = append(delta.Peers, wgtypes.PeerConfig{
+				PublicKey: p.PublicKey,
+				Remove:    true,
+			})
+		}
+	}
+	if !changed && len(delta.Peers) == 0 {
+		return nil
+	}
+	return delta
+}
+
+// PeerDrifted assert live peer differs from desired peer config, the
+// endpoint of a kept peer is not compared
+func PeerDrifted(p *wgtypes.Peer, pc *wgtypes.PeerConfig, kept bool) bool {
+	var psk wgtypes.Key
+	if pc.PresharedKey != nil {
+		psk = *pc.PresharedKey
+	}
+	if p.PresharedKey != psk {
+		return true
+	}
+	var kad time.Duration
+	if pc.PersistentKeepaliveInterval != nil {
+		kad = *pc.PersistentKeepaliveInterval
+	}
+	if p.PersistentKeepaliveInterval != kad {
+		return true
+	}
+	if !kept && pc.Endpoint != nil && wireguard.EndpointChanged(p, pc.Endpoint) {
+		return true
+	}
+	return ipNetsKey(p.AllowedIPs) != ipNetsKey(pc.AllowedIPs)
+}
+
+func ipNetsKey(ipnets []net.IPNet) string {
+	keys := make([]string, 0)
+	for _, ipnet := range ipnets {
+		keys = append(keys, ipnet.String())
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// containsCIDR assert cidr in list, compare network part only when network is true
+func containsCIDR(list []string, cidr string, network bool) bool {
+	want := normalizeCIDR(cidr, network)
+	if want == "" {
+		return false
+	}
+	for _, v := range list {
+		if normalizeCIDR(v, network) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeCIDR(cidr string, network bool) string {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() == nil {
+			cidr += "/128"
+		} else {
+			cidr += "/32"
+		}
+	}
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	if network {
+		return ipnet.String()
+	}
+	ones, _ := ipnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip.String(), ones)
+}
+
+// FindWireguard interface config of conf by name, nil when conf is nil or
+// has no such interface
+func FindWireguard(conf *registry.DesiredConfig, name string) *registry.WireguardConfig {
+	if conf == nil {
+		return nil
+	}
+	for _, wgconf := range conf.Wireguard {
+		if wgconf.Name == name {
+			return wgconf
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package reconcile
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+)
+
+const (
+	// TA_FORWARD_CHAIN filter chain of forward rules, hooked from FORWARD
+	TA_FORWARD_CHAIN = "TA-FORWARD"
+	// TA_PREROUTING_CHAIN nat chain of dnat rules, hooked from PREROUTING
+	TA_PREROUTING_CHAIN = "TA-PREROUTING"
+	// TA_POSTROUTING_CHAIN nat chain of snat and masquerade rules,
+	// hooked from POSTROUTING
+	TA_POSTROUTING_CHAIN = "TA-POSTROUTING"
+)
+
+// FirewallChains chains owned by router with the built-in chain hooking them
+func FirewallChains() []*iptables.FirewallChain {
+	return []*iptables.FirewallChain{
+		{Table: "filter", Name: TA_FORWARD_CHAIN, Hook: "FORWARD"},
+		{Table: "nat", Name: TA_PREROUTING_CHAIN, Hook: "PREROUTING"},
+		{Table: "nat", Name: TA_POSTROUTING_CHAIN, Hook: "POSTROUTING"},
+	}
+}
+
+// FirewallRules router chains of desired config by protocol
+func FirewallRules(conf *registry.DesiredConfig) (map[iptables.Protocol][]*iptables.FirewallChain, error) {
+	rules := map[iptables.Protocol][]*iptables.FirewallChain{
+		iptables.PROTOCOL_IPV4: FirewallChains(),
+		iptables.PROTOCOL_IPV6: FirewallChains(),
+	}
+	appendRule := func(protocol iptables.Protocol, name string, rule *iptables.FirewallRule) {
+		for _, chain := range rules[protocol] {
+			if chain.Name == name {
+				chain.Rules = append(chain.Rules, rule)
+			}
+		}
+	}
+	accept := false
+	for _, fr := range conf.Firewall {
+		if fr.Type == registry.FIREWALL_ACCEPT && !accept {
+			accept = true
+			for protocol := range rules {
+				appendRule(protocol, TA_FORWARD_CHAIN, &iptables.FirewallRule{
+					Established: true,
+					Target:      iptables.TARGET_ACCEPT,
+				})
+			}
+		}
+		chain, rule, err := firewallRule(fr)
+		if err != nil {
+			return nil, err
+		}
+		protocols, err := firewallProtocols(fr)
+		if err != nil {
+			return nil, err
+		}
+		for _, protocol := range protocols {
+			appendRule(protocol, chain, rule)
+		}
+	}
+	return rules, nil
+}
+
+// firewallRule router chain and backend rule of registry firewall rule
+func firewallRule(fr *registry.FirewallRule) (string, *iptables.FirewallRule, error) {
+	rule := &iptables.FirewallRule{
+		InIface:  fr.InIface,
+		OutIface: fr.OutIface,
+		Protocol: strings.ToLower(fr.Protocol),
+		Dport:    fr.Dport,
+		ToAddr:   fr.ToAddr,
+	}
+	var err error
+	if fr.Source != "" {
+		if rule.Source, err = firewallCIDR(fr.Source); err != nil {
+			return "", nil, err
+		}
+	}
+	if fr.Destination != "" {
+		if rule.Destination, err = firewallCIDR(fr.Destination); err != nil {
+			return "", nil, err
+		}
+	}
+	if rule.Dport != 0 && rule.Protocol != "tcp" && rule.Protocol != "udp" {
+		return "", nil, fmt.Errorf(
+			"firewall rule dport requires tcp or udp protocol, got [%s]", rule.Protocol)
+	}
+	switch fr.Type {
+	case registry.FIREWALL_ACCEPT:
+		rule.Target = iptables.TARGET_ACCEPT
+		return TA_FORWARD_CHAIN, rule, nil
+	case registry.FIREWALL_DROP:
+		rule.Target = iptables.TARGET_DROP
+		return TA_FORWARD_CHAIN, rule, nil
+	case registry.FIREWALL_MASQUERADE, registry.FIREWALL_SNAT:
+		if fr.InIface != "" {
+			return "", nil, fmt.Errorf("%s rule can not match in interface", fr.Type)
+		}
+		rule.Target = iptables.TARGET_MASQUERADE
+		if fr.Type == registry.FIREWALL_SNAT {
+			if fr.ToAddr == "" {
+				return "", nil, fmt.Errorf("snat rule requires to address")
+			}
+			rule.Target = iptables.TARGET_SNAT
+		}
+		return TA_POSTROUTING_CHAIN, rule, nil
+	case registry.FIREWALL_DNAT:
+		if fr.OutIface != "" {
+			return "", nil, fmt.Errorf("dnat rule can not match out interface")
+		}
+		if fr.ToAddr == "" {
+			return "", nil, fmt.Errorf("dnat rule requires to address")
+		}
+		rule.Target = iptables.TARGET_DNAT
+		return TA_PREROUTING_CHAIN, rule, nil
+	}
+	return "", nil, fmt.Errorf("unknow firewall rule type [%s]", fr.Type)
+}
+
+// firewallProtocols ip protocols of firewall rule by its addresses, rules
+// without address apply to both iptables and ip6tables
+func firewallProtocols(rule *registry.FirewallRule) ([]iptables.Protocol, error) {
+	var v4, v6 bool
+	for _, addr := range []string{rule.Source, rule.Destination, rule.ToAddr} {
+		if addr == "" {
+			continue
+		}
+		if strings.HasPrefix(addr, "[") || strings.Count(addr, ":") > 1 {
+			v6 = true
+		} else {
+			v4 = true
+		}
+	}
+	switch {
+	case v4 && v6:
+		return nil, fmt.Errorf("firewall rule mixes ipv4 and ipv6 addresses")
+	case v4:
+		return []iptables.Protocol{iptables.PROTOCOL_IPV4}, nil
+	case v6:
+		return []iptables.Protocol{iptables.PROTOCOL_IPV6}, nil
+	}
+	return []iptables.Protocol{iptables.PROTOCOL_IPV4, iptables.PROTOCOL_IPV6}, nil
+}
+
+// firewallCIDR normalize address to network cidr like iptables prints,
+// a single ip becomes a host cidr
+func firewallCIDR(addr string) (string, error) {
+	if !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return "", fmt.Errorf("parse firewall address [%s] failed", addr)
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, ipnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return "", fmt.Errorf("parse firewall address [%s] failed: %v", addr, err)
+	}
+	return ipnet.String(), nil
+}
@@ -0,0 +1,330 @@
+package reconcile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/iptools"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+)
+
+const (
+	// PLAN_ADD object is created
+	PLAN_ADD = "add"
+	// PLAN_UPDATE object is changed in place
+	PLAN_UPDATE = "update"
+	// PLAN_DELETE object is removed
+	PLAN_DELETE = "delete"
+)
+
+// PlanChange change applying config would make, Kind is one of wan, dns,
+// sysctl, interface, peer, address, route, rule and firewall
+type PlanChange struct {
+	Kind   string `json:"kind"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Plan changes applying config revision would make to the host
+type Plan struct {
+	Revision string        `json:"revision"`
+	Changes  []*PlanChange `json:"changes"`
+}
+
+func (p *Plan) add(kind, action, target, detail string) {
+	p.Changes = append(p.Changes, &PlanChange{
+		Kind:   kind,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	})
+}
+
+// Empty assert plan has no change
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// String render plan for humans, one change per line marked with + for
+// add, ~ for update and - for delete
+func (p *Plan) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("plan of config revision [%s]: %d changes\n",
+		p.Revision, len(p.Changes)))
+	for _, c := range p.Changes {
+		mark := "~"
+		switch c.Action {
+		case PLAN_ADD:
+			mark = "+"
+		case PLAN_DELETE:
+			mark = "-"
+		}
+		sb.WriteString(fmt.Sprintf("  %s %s %s\n", mark, c.Kind, c.Target))
+		if c.Detail == "" {
+			continue
+		}
+		for _, l := range strings.Split(c.Detail, "\n") {
+			sb.WriteString("      " + l + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// Planner host state a plan is computed against, only read-only queries
+// are run through it
+type Planner struct {
+	IPTools *iptools.IPTools
+	// Device query live wireguard device, os.ErrNotExist when absent
+	Device func(name string) (*wgtypes.Device, error)
+	// Firewalls firewall backend by protocol, absent backends are skipped
+	Firewalls map[iptables.Protocol]iptables.Firewall
+	// ResolvConf path of resolver config
+	ResolvConf string
+	// Previous previous applied config, nil when not applied yet
+	Previous *registry.DesiredConfig
+	// Forward ip forward sysctl, the host proc filesystem when nil
+	Forward *wireguard.IPForward
+	// Resolve resolve hostname endpoints of peers not kept, optional
+	Resolve func(wgconf *registry.WireguardConfig, devConf *wgtypes.Config,
+		kept map[wgtypes.Key]bool)
+}
+
+// Plan compute changes of applying conf to the host, mirrors the router
+// apply
+func (pl *Planner) Plan(conf *registry.DesiredConfig) (*Plan, error) {
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("check config failed: %v", err)
+	}
+	p := &Plan{Revision: conf.Revision(), Changes: make([]*PlanChange, 0)}
+	pl.planWan(p, conf.Wan)
+	if len(conf.DNSServer) > 0 {
+		if live := ResolvConfServers(pl.ResolvConf); !reflect.DeepEqual(live, conf.DNSServer) {
+			p.add("dns", PLAN_UPDATE, pl.ResolvConf, fmt.Sprintf(
+				"nameservers %v -> %v", live, conf.DNSServer))
+		}
+	}
+	if err := planForward(p, pl.Forward, conf); err != nil {
+		return nil, err
+	}
+	for _, wgconf := range conf.Wireguard {
+		if err := pl.planInterface(p, wgconf); err != nil {
+			return nil, err
+		}
+	}
+	if err := pl.planFirewall(p, conf); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// planWan wan changes, static addresses and default route are compared
+// with the live interface, dhclient is compared with the previous config
+func (pl *Planner) planWan(p *Plan, wan *registry.EthernetConfig) {
+	if wan == nil || len(wan.Addresses) == 0 {
+		return
+	}
+	if wan.DhcpClient != "" {
+		if pl.Previous == nil || !reflect.DeepEqual(pl.Previous.Wan, wan) {
+			p.add("wan", PLAN_UPDATE, wan.Name, "run dhclient")
+		}
+		return
+	}
+	live, _ := pl.IPTools.ListAddresses(wan.Name)
+	stale, missing := AddressDelta(live, wan.Addresses)
+	gateway := true
+	if wan.Gateway != "" {
+		routes, _ := pl.IPTools.ListRoutes("")
+		gateway = hasDefaultRoute(routes, wan.Gateway, wan.Name)
+	}
+	if len(stale) == 0 && len(missing) == 0 && gateway {
+		return
+	}
+	p.add("wan", PLAN_UPDATE, wan.Name, fmt.Sprintf(
+		"flush addresses %v, add addresses %v, default via [%s]",
+		live, wan.Addresses, wan.Gateway))
+}
+
+func hasDefaultRoute(routes []*iptools.Route, gw, dev string) bool {
+	for _, route := range routes {
+		if route.Dst == "default" && route.Dev == dev &&
+			net.ParseIP(route.Via).Equal(net.ParseIP(gw)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolvConfServers nameservers of resolver config at path
+func ResolvConfServers(path string) []string {
+	servers := make([]string, 0)
+	f, err := os.Open(path)
+	if err != nil {
+		return servers
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// planForward forward sysctl changes
+func planForward(p *Plan, forward *wireguard.IPForward, conf *registry.DesiredConfig) error {
+	if len(conf.Wireguard) == 0 {
+		return nil
+	}
+	if enabled, err := forward.IsIPv4Enable(); err != nil {
+		return err
+	} else if !enabled {
+		p.add("sysctl", PLAN_UPDATE, forward.IPv4Path(), "0 -> 1")
+	}
+	for _, wgconf := range conf.Wireguard {
+		if !wgconf.HasIPv6() {
+			continue
+		}
+		if enabled, err := forward.IsIPv6Enable(); err != nil {
+			return err
+		} else if !enabled {
+			p.add("sysctl", PLAN_UPDATE, forward.IPv6Path(), "0 -> 1")
+		}
+		break
+	}
+	return nil
+}
+
+// planInterface wireguard, address, route and rule changes of interface
+func (pl *Planner) planInterface(p *Plan, wgconf *registry.WireguardConfig) error {
+	dev, err := pl.Device(wgconf.Name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("query wireguard interface [%s] failed: %v", wgconf.Name, err)
+		}
+		p.add("interface", PLAN_ADD, wgconf.Name, "")
+		dev = &wgtypes.Device{Name: wgconf.Name}
+	}
+	devConf, err := wgconf.DeviceConfig()
+	if err != nil {
+		return err
+	}
+	kept := KeptEndpoints(dev, wgconf, FindWireguard(pl.Previous, wgconf.Name))
+	if pl.Resolve != nil {
+		pl.Resolve(wgconf, devConf, kept)
+	}
+	if delta := DeviceDelta(dev, devConf, kept); delta != nil {
+		if delta.PrivateKey != nil {
+			p.add("interface", PLAN_UPDATE, wgconf.Name, "private key")
+		}
+		if delta.ListenPort != nil {
+			p.add("interface", PLAN_UPDATE, wgconf.Name,
+				fmt.Sprintf("listen port [%d] -> [%d]", dev.ListenPort, *delta.ListenPort))
+		}
+		for _, pc := range delta.Peers {
+			target := wgconf.Name + " " + pc.PublicKey.String()
+			switch {
+			case pc.Remove:
+				p.add("peer", PLAN_DELETE, target, "")
+			case pc.UpdateOnly:
+				p.add("peer", PLAN_UPDATE, target, peerDetail(&pc))
+			default:
+				p.add("peer", PLAN_ADD, target, peerDetail(&pc))
+			}
+		}
+	}
+	addrs, _ := pl.IPTools.ListAddresses(wgconf.Name)
+	stale, missing := AddressDelta(addrs, wgconf.Addresses())
+	for _, addr := range stale {
+		p.add("address", PLAN_DELETE, addr+" dev "+wgconf.Name, "")
+	}
+	for _, addr := range missing {
+		p.add("address", PLAN_ADD, addr+" dev "+wgconf.Name, "")
+	}
+	if ifi, err := net.InterfaceByName(wgconf.Name); err != nil ||
+		ifi.Flags&net.FlagUp == 0 || ifi.MTU != 1420 {
+		p.add("interface", PLAN_UPDATE, wgconf.Name, "set up with mtu [1420]")
+	}
+	routes, err := pl.IPTools.ListRoutes(wgconf.Table)
+	if err != nil {
+		return err
+	}
+	staleRoutes, missingRoutes := RouteDelta(routes, wgconf)
+	for _, route := range staleRoutes {
+		p.add("route", PLAN_DELETE, routeTarget(route.Network(), wgconf), "")
+	}
+	for _, addr := range missingRoutes {
+		p.add("route", PLAN_ADD, routeTarget(addr, wgconf), "")
+	}
+	rules, err := pl.IPTools.ListRules()
+	if err != nil {
+		return err
+	}
+	staleRules, missingRules := RuleDelta(rules, wgconf)
+	for _, rule := range staleRules {
+		p.add("rule", PLAN_DELETE, rule.String(), "")
+	}
+	for _, rule := range missingRules {
+		p.add("rule", PLAN_ADD, rule.String(), "")
+	}
+	return nil
+}
+
+func routeTarget(network string, wgconf *registry.WireguardConfig) string {
+	target := network + " dev " + wgconf.Name
+	if wgconf.Table != "" {
+		target += " table " + wgconf.Table
+	}
+	return target
+}
+
+// peerDetail describe peer config without keys
+func peerDetail(pc *wgtypes.PeerConfig) string {
+	ips := make([]string, 0, len(pc.AllowedIPs))
+	for _, ipnet := range pc.AllowedIPs {
+		ips = append(ips, ipnet.String())
+	}
+	detail := "allowed ips " + strings.Join(ips, ",")
+	if pc.Endpoint != nil {
+		detail += ", endpoint " + pc.Endpoint.String()
+	}
+	if pc.PersistentKeepaliveInterval != nil && *pc.PersistentKeepaliveInterval > 0 {
+		detail += ", keepalive " + pc.PersistentKeepaliveInterval.String()
+	}
+	return detail
+}
+
+// planFirewall firewall backend writes of router chains
+func (pl *Planner) planFirewall(p *Plan, conf *registry.DesiredConfig) error {
+	rules, err := FirewallRules(conf)
+	if err != nil {
+		return err
+	}
+	for _, protocol := range []iptables.Protocol{
+		iptables.PROTOCOL_IPV4, iptables.PROTOCOL_IPV6} {
+		fw, ok := pl.Firewalls[protocol]
+		if !ok {
+			continue
+		}
+		lines, err := fw.PlanChains(rules[protocol])
+		if err != nil {
+			return fmt.Errorf("plan %s firewall chains with [%s] failed: %v",
+				protocol, fw.Name(), err)
+		}
+		if len(lines) > 0 {
+			p.add("firewall", PLAN_UPDATE, protocol.String()+" "+fw.Name(),
+				strings.Join(lines, "\n"))
+		}
+	}
+	return nil
+}
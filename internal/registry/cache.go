@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ConfigCache last known good config persisted on disk
+type ConfigCache struct {
+	Revision string         `json:"revision"`
+	SavedAt  time.Time      `json:"saved_at"`
+	Config   *DesiredConfig `json:"config"`
+}
+
+// CacheStore encrypted config cache at Path, keyed by the private key at
+// KeyPath and MachineID so the cache is only readable and verifiable on
+// this router
+type CacheStore struct {
+	Path      string
+	KeyPath   string
+	MachineID string
+}
+
+// cipher aes-gcm cipher of cache
+func (s *CacheStore) cipher() (cipher.AEAD, error) {
+	keyData, err := os.ReadFile(s.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read client private key failed: %v", err)
+	}
+	key := sha256.Sum256(append(keyData, []byte(s.MachineID)...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("create cache cipher failed: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Save encrypt and persist config, the cache file is replaced atomically
+func (s *CacheStore) Save(conf *DesiredConfig) error {
+	data, err := json.Marshal(&ConfigCache{
+		Revision: conf.Revision(),
+		SavedAt:  time.Now(),
+		Config:   conf,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal config cache failed: %v", err)
+	}
+	aead, err := s.cipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return fmt.Errorf("generate cache nonce failed: %v", err)
+	}
+	sealed := aead.Seal(nonce, nonce, data, []byte(s.MachineID))
+	dir := filepath.Dir(s.Path)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("create state dir [%s] failed: %v", dir, err)
+	}
+	tmpPath := s.Path + ".tmp"
+	if err = os.WriteFile(tmpPath, sealed, 0600); err != nil {
+		return fmt.Errorf("write config cache failed: %v", err)
+	}
+	if err = os.Rename(tmpPath, s.Path); err != nil {
+		return fmt.Errorf("replace config cache failed: %v", err)
+	}
+	return nil
+}
+
+// Load load and verify last known good config
+func (s *CacheStore) Load() (*ConfigCache, error) {
+	sealed, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("read config cache failed: %v", err)
+	}
+	aead, err := s.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("config cache [%s] is corrupted", s.Path)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, []byte(s.MachineID))
+	if err != nil {
+		return nil, fmt.Errorf("verify config cache failed: %v", err)
+	}
+	cache := &ConfigCache{}
+	if err = json.Unmarshal(data, cache); err != nil {
+		return nil, fmt.Errorf("unmarshal config cache failed: %v", err)
+	}
+	if cache.Config == nil || cache.Config.Revision() != cache.Revision {
+		return nil, fmt.Errorf("config cache revision mismatch")
+	}
+	return cache, nil
+}
@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"ntsc.ac.cn/ta-router/pkg/iptools"
+)
+
+// Check validate names and addresses of config before they reach
+// netlink, external commands, firewall scripts or config files
+func (c *DesiredConfig) Check() error {
+	if c.Wan != nil {
+		if err := c.Wan.Check(); err != nil {
+			return fmt.Errorf("check wan config failed: %v", err)
+		}
+	}
+	for _, dns := range c.DNSServer {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid dns server [%s]", dns)
+		}
+	}
+	for _, wgconf := range c.Wireguard {
+		if err := wgconf.Check(); err != nil {
+			return fmt.Errorf("check wireguard [%s] config failed: %v", wgconf.Name, err)
+		}
+	}
+	for i, fr := range c.Firewall {
+		if err := fr.Check(); err != nil {
+			return fmt.Errorf("check firewall rule [%d] failed: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Check validate wan interface name, addresses and gateway, addresses
+// are left to dhclient when it is enabled
+func (c *EthernetConfig) Check() error {
+	if c.Name == "" && len(c.Addresses) == 0 {
+		return nil
+	}
+	if err := iptools.CheckLinkName(c.Name); err != nil {
+		return err
+	}
+	if c.DhcpClient != "" {
+		return nil
+	}
+	// a bare ip is a host address like ip addr add takes it
+	for _, addr := range c.Addresses {
+		if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+			return fmt.Errorf("invalid address [%s]", addr)
+		}
+	}
+	if c.Gateway != "" && net.ParseIP(c.Gateway) == nil {
+		return fmt.Errorf("invalid gateway [%s]", c.Gateway)
+	}
+	return nil
+}
+
+// Check validate wireguard interface name, addresses, routing table and
+// rules, keys and peers are checked when device config is built
+func (c *WireguardConfig) Check() error {
+	if err := iptools.CheckLinkName(c.Name); err != nil {
+		return err
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid listen port [%d]", c.Port)
+	}
+	for _, addr := range c.Addresses() {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return fmt.Errorf("invalid address [%s]", addr)
+		}
+	}
+	if c.Table != "" && !isToken(c.Table) {
+		return fmt.Errorf("invalid routing table [%s]", c.Table)
+	}
+	for _, rule := range c.Rules {
+		for _, cidr := range []string{rule.From, rule.To} {
+			if cidr == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid rule network [%s]", cidr)
+			}
+		}
+		if rule.Iif != "" {
+			if err := iptools.CheckLinkName(rule.Iif); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check validate interfaces, protocol, port and nat address of firewall
+// rule, source and destination are checked when rules are built
+func (r *FirewallRule) Check() error {
+	for _, iface := range []string{r.InIface, r.OutIface} {
+		if iface == "" {
+			continue
+		}
+		if err := iptools.CheckLinkName(iface); err != nil {
+			return err
+		}
+	}
+	if r.Protocol != "" && !isToken(r.Protocol) {
+		return fmt.Errorf("invalid protocol [%s]", r.Protocol)
+	}
+	if r.Dport < 0 || r.Dport > 65535 {
+		return fmt.Errorf("invalid dport [%d]", r.Dport)
+	}
+	if r.ToAddr == "" || net.ParseIP(r.ToAddr) != nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(r.ToAddr)
+	if err != nil || net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid to address [%s]", r.ToAddr)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid to address port [%s]", r.ToAddr)
+	}
+	return nil
+}
+
+// isToken assert s only has letters, digits, '_', '-' and '.' and does
+// not start with '-'
+func isToken(s string) bool {
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '_', c == '.':
+		case c == '-' && i > 0:
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,206 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+)
+
+// DesiredConfig router configuration delivered by registry
+type DesiredConfig struct {
+	Wan       *EthernetConfig    `json:"wan,omitempty"`
+	DNSServer []string           `json:"dns_server,omitempty"`
+	Wireguard []*WireguardConfig `json:"wireguard,omitempty"`
+	Firewall  []*FirewallRule    `json:"firewall,omitempty"`
+}
+
+// EthernetConfig wan ethernet card config
+type EthernetConfig struct {
+	Name       string   `json:"name"`
+	Addresses  []string `json:"addresses,omitempty"`
+	Gateway    string   `json:"gateway,omitempty"`
+	DhcpClient string   `json:"dhcp_client,omitempty"`
+}
+
+// WireguardConfig wireguard interface config
+type WireguardConfig struct {
+	Name    string           `json:"name"`
+	PrivKey string           `json:"priv_key"`
+	Port    int              `json:"port"`
+	Address string           `json:"address"`
+	Peers   []*WireguardPeer `json:"peers,omitempty"`
+	// Table routing table of peer routes, main table when empty
+	Table string `json:"table,omitempty"`
+	// Rules policy routing rules which lookup Table
+	Rules []*RoutingRule `json:"rules,omitempty"`
+}
+
+// RoutingRule policy routing rule selecting traffic into tunnel table
+type RoutingRule struct {
+	Priority int    `json:"priority"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Fwmark   uint32 `json:"fwmark,omitempty"`
+	Iif      string `json:"iif,omitempty"`
+}
+
+// WireguardPeer wireguard peer config
+type WireguardPeer struct {
+	PubKey    string   `json:"pub_key"`
+	PsKey     string   `json:"ps_key,omitempty"`
+	Keepalive int      `json:"keepalive,omitempty"`
+	PeerAddr  string   `json:"peer_addr"`
+	AllowIPs  []string `json:"allow_ips,omitempty"`
+	// Endpoint host:port the router dials, hostnames are resolved by the
+	// router and re-resolved periodically, passive peer when empty
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+const (
+	// FIREWALL_ACCEPT accept forwarded traffic
+	FIREWALL_ACCEPT = "accept"
+	// FIREWALL_DROP drop forwarded traffic
+	FIREWALL_DROP = "drop"
+	// FIREWALL_MASQUERADE masquerade outgoing traffic
+	FIREWALL_MASQUERADE = "masquerade"
+	// FIREWALL_SNAT source nat outgoing traffic to ToAddr
+	FIREWALL_SNAT = "snat"
+	// FIREWALL_DNAT destination nat incoming traffic to ToAddr
+	FIREWALL_DNAT = "dnat"
+)
+
+// FirewallRule forward filter or nat rule, empty match fields match any
+type FirewallRule struct {
+	Type        string `json:"type"`
+	Protocol    string `json:"protocol,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	InIface     string `json:"in_iface,omitempty"`
+	OutIface    string `json:"out_iface,omitempty"`
+	Dport       int    `json:"dport,omitempty"`
+	// ToAddr nat target address, ip or ip:port
+	ToAddr string `json:"to_addr,omitempty"`
+}
+
+// Revision config revision, digest of config content
+func (c *DesiredConfig) Revision() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// DeviceConfig build wgctrl device config
+func (c *WireguardConfig) DeviceConfig() (*wgtypes.Config, error) {
+	privKey, err := wgtypes.ParseKey(c.PrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse wireguard private failed: %v", err)
+	}
+	lisPort := c.Port
+	wgPeers := make([]wgtypes.PeerConfig, 0)
+	for _, wgPeer := range c.Peers {
+		pc, err := wgPeer.PeerConfig()
+		if err != nil {
+			return nil, err
+		}
+		wgPeers = append(wgPeers, *pc)
+	}
+	return &wgtypes.Config{
+		PrivateKey:   &privKey,
+		ListenPort:   &lisPort,
+		ReplacePeers: false,
+		Peers:        wgPeers,
+	}, nil
+}
+
+// Addresses ipv4 and ipv6 addresses of wireguard interface, multiple
+// addresses are separated by comma like wg-quick
+func (c *WireguardConfig) Addresses() []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(c.Address, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// HasIPv6 assert wireguard interface carries ipv6 traffic
+func (c *WireguardConfig) HasIPv6() bool {
+	for _, addr := range append(c.Addresses(), c.Routes()...) {
+		if strings.Contains(addr, ":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Routes routes of wireguard interface
+func (c *WireguardConfig) Routes() []string {
+	routes := make([]string, 0)
+	for _, wgPeer := range c.Peers {
+		routes = append(routes, wgPeer.AllowIPs...)
+	}
+	return routes
+}
+
+// PeerConfig build wgctrl peer config
+func (p *WireguardPeer) PeerConfig() (*wgtypes.PeerConfig, error) {
+	pubKey, err := wgtypes.ParseKey(p.PubKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse wireguard public key failed: %v", err)
+	}
+	var psk *wgtypes.Key
+	if p.PsKey != "" {
+		if _psk, err := wgtypes.ParseKey(p.PsKey); err != nil {
+			return nil, fmt.Errorf("parse wireguard presharedkey failed: %v", err)
+		} else {
+			psk = &_psk
+		}
+	}
+	var kad *time.Duration
+	if p.Keepalive != 0 {
+		_kad := time.Duration(time.Second * time.Duration(p.Keepalive))
+		kad = &_kad
+	}
+	_, peerIPNet, err := net.ParseCIDR(p.PeerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve peer address [%s] failed: %v", p.PeerAddr, err)
+	}
+	allowIPS := make([]net.IPNet, 0)
+	allowIPS = append(allowIPS, *peerIPNet)
+	for _, in := range p.AllowIPs {
+		if _, ipnet, err := net.ParseCIDR(in); err != nil {
+			return nil, fmt.Errorf("parse net cidr [%s] failed: %v", in, err)
+		} else {
+			allowIPS = append(allowIPS, *ipnet)
+		}
+	}
+	// hostname endpoint is left to the router resolver
+	var endpoint *net.UDPAddr
+	if p.Endpoint != "" {
+		host, port, err := wireguard.SplitEndpoint(p.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			endpoint = &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+	return &wgtypes.PeerConfig{
+		PublicKey:                   pubKey,
+		PresharedKey:                psk,
+		PersistentKeepaliveInterval: kad,
+		Endpoint:                    endpoint,
+		AllowedIPs:                  allowIPS,
+	}, nil
+}
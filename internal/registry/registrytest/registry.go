@@ -0,0 +1,91 @@
+package registrytest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"ntsc.ac.cn/ta-router/internal/registry"
+)
+
+// FakeRegistry in memory registry for tests
+type FakeRegistry struct {
+	lock   sync.Mutex
+	conf   *registry.DesiredConfig
+	err    error
+	fetchs int
+	// reports delivered status reports
+	reports   []*registry.StatusReport
+	reportErr error
+}
+
+// NewFakeRegistry create fake registry serving conf
+func NewFakeRegistry(conf *registry.DesiredConfig) *FakeRegistry {
+	return &FakeRegistry{conf: conf}
+}
+
+// SetConfig replace served config
+func (f *FakeRegistry) SetConfig(conf *registry.DesiredConfig) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.conf = conf
+}
+
+// SetError make fetch fail with err until cleared with nil
+func (f *FakeRegistry) SetError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.err = err
+}
+
+// Fetchs count of fetch calls
+func (f *FakeRegistry) Fetchs() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.fetchs
+}
+
+// FetchConfig implement registry.Registry
+func (f *FakeRegistry) FetchConfig(ctx context.Context) (*registry.DesiredConfig, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fetchs++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.conf == nil {
+		return nil, fmt.Errorf("router not registed")
+	}
+	return f.conf, nil
+}
+
+// SetReportError make report fail with err until cleared with nil
+func (f *FakeRegistry) SetReportError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.reportErr = err
+}
+
+// Reports delivered status reports
+func (f *FakeRegistry) Reports() []*registry.StatusReport {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*registry.StatusReport{}, f.reports...)
+}
+
+// ReportStatus implement registry.Reporter
+func (f *FakeRegistry) ReportStatus(ctx context.Context, status *registry.StatusReport) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.reportErr != nil {
+		return f.reportErr
+	}
+	f.reports = append(f.reports, status)
+	return nil
+}
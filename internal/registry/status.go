@@ -0,0 +1,123 @@
+package registry
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Reporter router status sink
+type Reporter interface {
+	// ReportStatus send router status to registry
+	ReportStatus(ctx context.Context, status *StatusReport) error
+}
+
+// StatusReport router status reported by heartbeat
+type StatusReport struct {
+	ReportedAt time.Time          `json:"reported_at"`
+	Revision   string             `json:"revision"`
+	Interfaces []*InterfaceStatus `json:"interfaces,omitempty"`
+	// Errors errors raised since the last delivered report
+	Errors []string `json:"errors,omitempty"`
+}
+
+// InterfaceStatus wireguard interface status
+type InterfaceStatus struct {
+	Name       string        `json:"name"`
+	Up         bool          `json:"up"`
+	ListenPort int           `json:"listen_port"`
+	Peers      []*PeerStatus `json:"peers,omitempty"`
+}
+
+// PeerStatus wireguard peer status
+type PeerStatus struct {
+	PubKey        string    `json:"pub_key"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	LastHandshake time.Time `json:"last_handshake"`
+	// HandshakeAge age of last handshake, zero when never
+	HandshakeAge time.Duration `json:"handshake_age"`
+	RxBytes      int64         `json:"rx_bytes"`
+	TxBytes      int64         `json:"tx_bytes"`
+	// Stale last handshake is older than the monitor threshold
+	Stale bool `json:"stale,omitempty"`
+}
+
+// Heartbeat report router status to registry periodically
+type Heartbeat struct {
+	reporter Reporter
+	interval time.Duration
+	collect  func() (*StatusReport, error)
+	lock     sync.Mutex
+	errors   []string
+	// MaxErrors max pending errors kept between reports, oldest dropped
+	MaxErrors int
+	// OnError called when collecting or reporting status failed
+	OnError func(err error)
+}
+
+// HEARTBEAT_MAX_ERRORS default max pending errors of heartbeat
+const HEARTBEAT_MAX_ERRORS = 16
+
+// NewHeartbeat create heartbeat, collect builds the status of each report
+func NewHeartbeat(reporter Reporter, interval time.Duration,
+	collect func() (*StatusReport, error)) *Heartbeat {
+	return &Heartbeat{
+		reporter:  reporter,
+		interval:  interval,
+		collect:   collect,
+		errors:    make([]string, 0),
+		MaxErrors: HEARTBEAT_MAX_ERRORS,
+	}
+}
+
+// RecordError keep error to be sent with next report
+func (h *Heartbeat) RecordError(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.errors = append(h.errors, err.Error())
+	if over := len(h.errors) - h.MaxErrors; over > 0 {
+		h.errors = h.errors[over:]
+	}
+}
+
+// Beat collect and report status once, pending errors are cleared only
+// after the report is delivered
+func (h *Heartbeat) Beat(ctx context.Context) error {
+	status, err := h.collect()
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	status.Errors = append([]string{}, h.errors...)
+	sent := len(h.errors)
+	h.lock.Unlock()
+	if status.ReportedAt.IsZero() {
+		status.ReportedAt = time.Now()
+	}
+	if err = h.reporter.ReportStatus(ctx, status); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	if sent > len(h.errors) {
+		sent = len(h.errors)
+	}
+	h.errors = h.errors[sent:]
+	h.lock.Unlock()
+	return nil
+}
+
+// Run beat every interval until ctx done
+func (h *Heartbeat) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		if err := h.Beat(ctx); err != nil && ctx.Err() == nil && h.OnError != nil {
+			h.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	WATCH_MIN_BACKOFF = time.Second
+	WATCH_MAX_BACKOFF = time.Minute
+)
+
+// ConfigRevision desired config with its revision
+type ConfigRevision struct {
+	Revision string
+	Config   *DesiredConfig
+}
+
+// Registry router desired config source
+type Registry interface {
+	// FetchConfig fetch current desired config of router
+	FetchConfig(ctx context.Context) (*DesiredConfig, error)
+}
+
+// Watcher watch registry and deliver changed config revisions
+type Watcher struct {
+	registry     Registry
+	interval     time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	lock         sync.Mutex
+	lastRevision string
+	// OnError called when registry fetch failed, before backoff
+	OnError func(err error)
+}
+
+// NewWatcher create registry watcher, resume from last applied revision
+func NewWatcher(registry Registry, interval time.Duration, lastRevision string) *Watcher {
+	return &Watcher{
+		registry:     registry,
+		interval:     interval,
+		minBackoff:   WATCH_MIN_BACKOFF,
+		maxBackoff:   WATCH_MAX_BACKOFF,
+		lastRevision: lastRevision,
+	}
+}
+
+// SetBackoff set reconnect backoff range
+func (w *Watcher) SetBackoff(min, max time.Duration) {
+	w.minBackoff = min
+	w.maxBackoff = max
+}
+
+// Ack mark revision applied, only newer revisions are delivered afterwards
+func (w *Watcher) Ack(revision string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.lastRevision = revision
+}
+
+// LastRevision last applied revision
+func (w *Watcher) LastRevision() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.lastRevision
+}
+
+// Watch poll registry and deliver revisions which differ from the last
+// applied one, unacked revisions are delivered again on next poll,
+// the channel is closed after ctx done
+func (w *Watcher) Watch(ctx context.Context) <-chan *ConfigRevision {
+	revChan := make(chan *ConfigRevision)
+	go func() {
+		defer close(revChan)
+		backoff := w.minBackoff
+		wait := time.Duration(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			conf, err := w.registry.FetchConfig(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if w.OnError != nil {
+					w.OnError(err)
+				}
+				wait = backoff
+				if backoff *= 2; backoff > w.maxBackoff {
+					backoff = w.maxBackoff
+				}
+				continue
+			}
+			backoff = w.minBackoff
+			wait = w.interval
+			rev := conf.Revision()
+			if rev == w.LastRevision() {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case revChan <- &ConfigRevision{Revision: rev, Config: conf}:
+			}
+		}
+	}()
+	return revChan
+}
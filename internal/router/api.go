@@ -0,0 +1,271 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+)
+
+// FirewallState live chains of firewall backend
+type FirewallState struct {
+	Protocol string `json:"protocol"`
+	Backend  string `json:"backend"`
+	// Chains live rules by chain in backend notation
+	Chains map[string][]string `json:"chains,omitempty"`
+	Error  string              `json:"error,omitempty"`
+}
+
+// apiLoop serve management api on Config.APISocket and Config.APIAddr
+// until ctx done
+func (r *WireguardRouter) apiLoop(ctx context.Context) {
+	listeners := make([]net.Listener, 0)
+	if r.conf.APISocket != "" {
+		if l, err := listenAPISocket(r.conf.APISocket); err != nil {
+			r.reportError(err)
+		} else {
+			listeners = append(listeners, l)
+		}
+	}
+	if r.conf.APIAddr != "" {
+		if tlsConf, err := apiTLSConfig(r.conf.CertPath); err != nil {
+			r.reportError(err)
+		} else if l, err := tls.Listen("tcp", r.conf.APIAddr, tlsConf); err != nil {
+			r.reportError(fmt.Errorf("listen management api [%s] failed: %v", r.conf.APIAddr, err))
+		} else {
+			listeners = append(listeners, l)
+		}
+	}
+	if len(listeners) == 0 {
+		return
+	}
+	srv := &http.Server{
+		Handler:           r.APIHandler(),
+		ReadHeaderTimeout: time.Second * 5,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			logrus.WithField("prefix", "router.api").
+				Infof("serve management api on [%s]", l.Addr())
+			if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				r.reportError(fmt.Errorf("serve management api failed: %v", err))
+			}
+		}(l)
+	}
+	wg.Wait()
+}
+
+// listenAPISocket listen unix socket accessible by owner only, stale
+// socket file of previous run is removed
+func listenAPISocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("create management api socket dir failed: %v", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale management api socket failed: %v", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen management api [%s] failed: %v", path, err)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("chmod management api socket failed: %v", err)
+	}
+	return l, nil
+}
+
+// apiTLSConfig server tls config from router certificate, clients must
+// present a certificate signed by the trusted chain
+func apiTLSConfig(certPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(certPath, CLIENT_CERT_NAME),
+		filepath.Join(certPath, CLIENT_PRIVATE_KEY_NAME))
+	if err != nil {
+		return nil, fmt.Errorf("load management api certificate failed: %v", err)
+	}
+	chain, err := os.ReadFile(filepath.Join(certPath, TRUSTED_CERT_CHAIN_NAME))
+	if err != nil {
+		return nil, fmt.Errorf("read trusted certificate chain failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(chain) {
+		return nil, fmt.Errorf("parse trusted certificate chain failed")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// APIHandler management api routes, served on Config.APISocket and
+// Config.APIAddr
+func (r *WireguardRouter) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/config", apiMethod(http.MethodGet, r.apiConfig))
+	mux.HandleFunc("/v1/status", apiMethod(http.MethodGet, r.apiStatus))
+	mux.HandleFunc("/v1/firewall", apiMethod(http.MethodGet, r.apiFirewall))
+	mux.HandleFunc("/v1/history", apiMethod(http.MethodGet, r.apiHistory))
+	mux.HandleFunc("/v1/plan", apiMethod(http.MethodGet, r.apiPlan))
+	mux.HandleFunc("/v1/resync", apiMethod(http.MethodPost, r.apiResync))
+	mux.HandleFunc("/v1/reload", apiMethod(http.MethodPost, r.apiReload))
+	return mux
+}
+
+// apiMethod reject requests of other methods
+func apiMethod(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			w.Header().Set("Allow", method)
+			writeAPIError(w, http.StatusMethodNotAllowed,
+				fmt.Errorf("method [%s] not allowed", req.Method))
+			return
+		}
+		h(w, req)
+	}
+}
+
+func writeAPIJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logrus.WithField("prefix", "router.api").
+			Warnf("write response failed: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeAPIJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// apiConfig current desired config, keys are redacted
+func (r *WireguardRouter) apiConfig(w http.ResponseWriter, req *http.Request) {
+	conf := r.desiredConfig()
+	if conf == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, fmt.Errorf("no config applied"))
+		return
+	}
+	redacted, err := redactConfig(conf)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, redacted)
+}
+
+// redactConfig copy of config without private and preshared keys
+func redactConfig(conf *registry.DesiredConfig) (*registry.DesiredConfig, error) {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return nil, fmt.Errorf("marshal config failed: %v", err)
+	}
+	redacted := &registry.DesiredConfig{}
+	if err = json.Unmarshal(data, redacted); err != nil {
+		return nil, fmt.Errorf("unmarshal config failed: %v", err)
+	}
+	for _, wgconf := range redacted.Wireguard {
+		wgconf.PrivKey = ""
+		for _, p := range wgconf.Peers {
+			p.PsKey = ""
+		}
+	}
+	return redacted, nil
+}
+
+// apiStatus live interface and peer state
+func (r *WireguardRouter) apiStatus(w http.ResponseWriter, req *http.Request) {
+	status, err := r.statusReport()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, status)
+}
+
+// apiFirewall live chains of firewall backends
+func (r *WireguardRouter) apiFirewall(w http.ResponseWriter, req *http.Request) {
+	states := make([]*FirewallState, 0)
+	for _, protocol := range []iptables.Protocol{iptables.PROTOCOL_IPV4, iptables.PROTOCOL_IPV6} {
+		fw, err := r.firewall(protocol)
+		if err != nil {
+			continue
+		}
+		state := &FirewallState{Protocol: protocol.String(), Backend: fw.Name()}
+		if state.Chains, err = fw.ListChains(reconcile.FirewallChains()); err != nil {
+			state.Error = err.Error()
+		}
+		states = append(states, state)
+	}
+	writeAPIJSON(w, http.StatusOK, states)
+}
+
+// apiHistory latest sync events, newest first
+func (r *WireguardRouter) apiHistory(w http.ResponseWriter, req *http.Request) {
+	writeAPIJSON(w, http.StatusOK, r.history.list())
+}
+
+// apiPlan changes applying registry config would make
+func (r *WireguardRouter) apiPlan(w http.ResponseWriter, req *http.Request) {
+	plan, err := r.Plan(req.Context())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, plan)
+}
+
+// apiResync fetch config from registry and apply it
+func (r *WireguardRouter) apiResync(w http.ResponseWriter, req *http.Request) {
+	err := r.track(SYNC_RESYNC, "", func() error {
+		conf, err := r.source.FetchConfig(req.Context())
+		if err != nil {
+			return fmt.Errorf("fetch config failed: %v", err)
+		}
+		return r.applyConfig(conf)
+	})
+	r.writeSyncResult(w, err)
+}
+
+// apiReload apply current config again including wan and dns
+func (r *WireguardRouter) apiReload(w http.ResponseWriter, req *http.Request) {
+	r.writeSyncResult(w, r.track(SYNC_RELOAD, "", r.reapplyConfig))
+}
+
+// writeSyncResult write sync error or revision of desired config
+func (r *WireguardRouter) writeSyncResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	revision := ""
+	if conf := r.desiredConfig(); conf != nil {
+		revision = conf.Revision()
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]string{"revision": revision})
+}
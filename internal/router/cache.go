@@ -0,0 +1,31 @@
+package router
+
+import (
+	"path/filepath"
+
+	"ntsc.ac.cn/ta-router/internal/registry"
+)
+
+const (
+	CONFIG_CACHE_NAME = "config.cache"
+)
+
+// cacheStore config cache of router keyed by client private key and
+// machine id
+func (r *WireguardRouter) cacheStore() *registry.CacheStore {
+	return &registry.CacheStore{
+		Path:      filepath.Join(r.conf.StateDir, CONFIG_CACHE_NAME),
+		KeyPath:   filepath.Join(r.conf.CertPath, CLIENT_PRIVATE_KEY_NAME),
+		MachineID: r.machineID,
+	}
+}
+
+// saveConfigCache encrypt and persist last applied registry config
+func (r *WireguardRouter) saveConfigCache(conf *registry.DesiredConfig) error {
+	return r.cacheStore().Save(conf)
+}
+
+// loadConfigCache load and verify last known good config
+func (r *WireguardRouter) loadConfigCache() (*registry.ConfigCache, error) {
+	return r.cacheStore().Load()
+}
@@ -2,43 +2,76 @@ package router
 
 import (
 	"fmt"
-	"net/url"
 
 	"github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"ntsc.ac.cn/ta-router/pkg/iptables"
 	"ntsc.ac.cn/ta-router/pkg/iptools"
-	"ntsc.ac.cn/ta-router/pkg/tools"
 	"ntsc.ac.cn/ta-router/pkg/wireguard"
 )
 
 func (r *WireguardRouter) checkEnvs() (err error) {
-	if r.wireguard, err = wireguard.NewWireguardTools(
-		r.conf.WireguardPath, r.conf.WireguardToolsPath, r.conf.IPToolsPath); err != nil {
-		return fmt.Errorf("check wireguard tools failed: %v", err)
+	if r.ipTools = r.conf.IPTools; r.ipTools == nil {
+		if r.ipTools, err = iptools.NewIPToolsWithRunner(r.conf.IPToolsPath, r.runner); err != nil {
+			return fmt.Errorf("check ip tools failed: %v", err)
+		}
 	}
-
-	if r.wgctl, err = wgctrl.New(); err != nil {
-		return fmt.Errorf("check wireguard ctrl client failed: %v", err)
+	logrus.WithField("prefix", "router.check_envs").
+		Infof("check ip tools success, backend [%s]", r.ipTools.Backend())
+	if r.wireguard, err = wireguard.NewWireguardToolsWithRunner(r.conf.WireguardPath,
+		r.conf.WireguardToolsPath, r.ipTools, r.runner); err != nil {
+		return fmt.Errorf("check wireguard tools failed: %v", err)
 	}
-	if r.ipTools, err = iptools.NewIPTools(r.conf.IPToolsPath); err != nil {
-		return fmt.Errorf("check ip tools failed: %v", err)
+	if r.wgctl = r.conf.WireguardClient; r.wgctl == nil {
+		client, err := wgctrl.New()
+		if err != nil {
+			return fmt.Errorf("check wireguard ctrl client failed: %v", err)
+		}
+		r.wgctl = client
 	}
 	logrus.WithField("prefix", "router.check_envs").
 		Infof("check wireguard environment success")
-	if r.iptables, err = iptables.NewIPTables(
-		r.conf.IPTablesPath, r.conf.IPSetPath); err != nil {
-		return fmt.Errorf("check iptables and ipset failed: %v", err)
+	if r.firewall4, err = r.checkFirewall(iptables.PROTOCOL_IPV4); err != nil {
+		return fmt.Errorf("check ipv4 firewall failed: %v", err)
 	}
 	logrus.WithField("prefix", "router.check_envs").
-		Infof("check iptables environment success")
-	pingAddr, _ := url.Parse(r.conf.ManagerEndpoint)
-	if rtt, err := tools.Ping(pingAddr.Hostname()); err != nil {
-		return fmt.Errorf("check internet failed: %v", err)
+		Infof("check ipv4 firewall success, backend [%s]", r.firewall4.Name())
+	if r.firewall6, err = r.checkFirewall(iptables.PROTOCOL_IPV6); err != nil {
+		logrus.WithField("prefix", "router.check_envs").
+			Warnf("check ipv6 firewall failed, ipv6 firewall disabled: %v", err)
 	} else {
 		logrus.WithField("prefix", "router.check_envs").
-			Infof("check internet success,ping addr [%s] counter [%d] rtt avg [%s]",
-				pingAddr.Hostname(), tools.DEFAULT_PING_COUNT, rtt)
+			Infof("check ipv6 firewall success, backend [%s]", r.firewall6.Name())
 	}
 	return nil
 }
+
+// checkFirewall detect firewall backend of protocol, iptables is preferred
+// and nftables is used on hosts without iptables
+func (r *WireguardRouter) checkFirewall(protocol iptables.Protocol) (iptables.Firewall, error) {
+	iptablesPath := r.conf.IPTablesPath
+	if protocol == iptables.PROTOCOL_IPV6 {
+		iptablesPath = r.conf.IP6TablesPath
+	}
+	ipt, err := iptables.NewIPTablesWithRunner(protocol, iptablesPath,
+		r.conf.IPSetPath, r.runner)
+	if err == nil {
+		ipt.SetOwner(r.routerID())
+		return ipt, nil
+	}
+	nft, nerr := iptables.NewNFTablesWithRunner(protocol, r.conf.NFTPath, r.runner)
+	if nerr != nil {
+		return nil, fmt.Errorf("iptables: %v, nftables: %v", err, nerr)
+	}
+	if drops, err := nft.ForwardDropChains(); err != nil {
+		logrus.WithField("prefix", "router.check_envs").
+			Warnf("list %s nftables chains failed: %v", protocol, err)
+	} else {
+		for _, chain := range drops {
+			logrus.WithField("prefix", "router.check_envs").
+				Warnf("nftables chain [%s] drops forwarded traffic by policy, "+
+					"accept rules of table [%s] do not override it", chain, iptables.NFT_TABLE_NAME)
+		}
+	}
+	return nft, nil
+}
@@ -2,6 +2,11 @@ package router
 
 import (
 	"fmt"
+	"time"
+
+	"ntsc.ac.cn/ta-router/pkg/iptools"
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
 )
 
 const (
@@ -9,6 +14,30 @@ const (
 	TRUSTED_CERT_CHAIN_NAME = "trusted.crt"
 	CLIENT_CERT_NAME        = "client.crt"
 	CLIENT_PRIVATE_KEY_NAME = "client.key"
+
+	REGISTRY_REQUEST_TIMEOUT = time.Second * 5
+	// HANDSHAKE_CHECK_INTERVAL interval of checking peer handshake age
+	HANDSHAKE_CHECK_INTERVAL = time.Second * 15
+	// METRICS_SAMPLE_INTERVAL interval of sampling peer and rule counters
+	METRICS_SAMPLE_INTERVAL = time.Second * 15
+	// DHCLIENT_TIMEOUT time after which a wan lease not obtained by dhclient
+	// is warned
+	DHCLIENT_TIMEOUT = time.Minute * 2
+	// ENDPOINT_APPLY_TIMEOUT max time of resolving peer endpoints of one
+	// interface while applying config
+	ENDPOINT_APPLY_TIMEOUT = time.Second * 10
+	// RESOLV_CONF_PATH resolver config replaced by dns servers
+	RESOLV_CONF_PATH = "/etc/resolv.conf"
+)
+
+const (
+	// STALE_ACTION_NONE only report stale peers
+	STALE_ACTION_NONE = "none"
+	// STALE_ACTION_RECONFIGURE remove and re-add stale peer
+	STALE_ACTION_RECONFIGURE = "reconfigure"
+	// STALE_ACTION_RERESOLVE resolve endpoint of stale peer again and
+	// update it when the address changed
+	STALE_ACTION_RERESOLVE = "reresolve"
 )
 
 // Config wireguard router config
@@ -20,7 +49,47 @@ type Config struct {
 	WireguardToolsPath string
 	IPToolsPath        string
 	IPTablesPath       string
+	IP6TablesPath      string
 	IPSetPath          string
+	NFTPath            string
+	ReconcileInterval  time.Duration
+	WatchInterval      time.Duration
+	StateDir           string
+	// Teardown remove managed interfaces, routes and chains on stop
+	Teardown bool
+	// HeartbeatInterval interval of reporting status to registry
+	HeartbeatInterval time.Duration
+	// HandshakeTimeout peers without handshake for longer are stale,
+	// monitor disabled when zero
+	HandshakeTimeout time.Duration
+	// StaleAction action on stale peer, STALE_ACTION_NONE when empty
+	StaleAction string
+	// HandshakeCheckInterval interval of checking peer handshake age,
+	// HANDSHAKE_CHECK_INTERVAL when zero
+	HandshakeCheckInterval time.Duration
+	// ResolveInterval interval of re-resolving peer endpoints, resolver
+	// disabled when zero
+	ResolveInterval time.Duration
+	// APISocket unix socket of local management api, disabled when empty
+	APISocket string
+	// APIAddr tcp listen address of management api with mutual tls from
+	// CertPath, disabled when empty
+	APIAddr string
+	// Runner runner of external commands, rexec.DefaultRunner when nil
+	Runner rexec.Runner
+	// AuditCommands log every external command with rexec.AuditRunner
+	AuditCommands bool
+	// IPTools ip tools of links, addresses, routes and rules, created with
+	// Runner when nil
+	IPTools *iptools.IPTools
+	// WireguardClient wireguard device ctrl client, wgctrl client when nil
+	WireguardClient wireguard.Client
+	// ProcRoot mount point of proc filesystem whose ip forward sysctl is
+	// enabled, wireguard.PROC_ROOT when empty
+	ProcRoot string
+	// MetricsAddr listen address of prometheus metrics endpoint,
+	// disabled when empty
+	MetricsAddr string
 }
 
 // Check check wireguard router config
@@ -34,5 +103,31 @@ func (c *Config) Check() error {
 	if c.ManagerEndpoint == "" {
 		return fmt.Errorf("management service endpoint not define")
 	}
+	if c.StateDir == "" {
+		return fmt.Errorf("state dir not define")
+	}
+	if c.ReconcileInterval <= 0 {
+		return fmt.Errorf("reconcile interval must be positive")
+	}
+	if c.WatchInterval <= 0 {
+		return fmt.Errorf("watch interval must be positive")
+	}
+	if c.HeartbeatInterval <= 0 {
+		return fmt.Errorf("heartbeat interval must be positive")
+	}
+	if c.ResolveInterval < 0 {
+		return fmt.Errorf("resolve interval must not be negative")
+	}
+	if c.HandshakeTimeout < 0 {
+		return fmt.Errorf("handshake timeout must not be negative")
+	}
+	if c.HandshakeCheckInterval < 0 {
+		return fmt.Errorf("handshake check interval must not be negative")
+	}
+	switch c.StaleAction {
+	case "", STALE_ACTION_NONE, STALE_ACTION_RECONFIGURE, STALE_ACTION_RERESOLVE:
+	default:
+		return fmt.Errorf("unknow stale action [%s]", c.StaleAction)
+	}
 	return nil
 }
@@ -0,0 +1,95 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+)
+
+// DHCLIENT_BOUND output line prefix of dhclient after lease obtained
+const DHCLIENT_BOUND = "bound to "
+
+// dhcpClient supervised dhclient of wan interface
+type dhcpClient struct {
+	iface string
+	sv    *rexec.Supervisor
+	done  chan struct{}
+}
+
+// startDHClient run dhclient of wan interface in foreground under a
+// supervisor bound to router ctx, a dhclient already running for the
+// interface is kept, the lease is waited in background so applyLock is
+// never held while waiting, called with applyLock held
+func (r *WireguardRouter) startDHClient(iface string) error {
+	if r.dhclient != nil && r.dhclient.iface == iface {
+		return nil
+	}
+	r.stopDHClient()
+	path, err := r.runner.LookPath("dhclient")
+	if err != nil {
+		return fmt.Errorf("look path of dhclient failed: %v", err)
+	}
+	log := logrus.WithField("prefix", "router.dhclient")
+	bound := make(chan string, 1)
+	sv := &rexec.Supervisor{
+		Name: "dhclient",
+		Path: path,
+		Args: []string{"-d", iface},
+		OnLine: func(line rexec.Line) {
+			log.Debugf("%s: %s", line.Stream, line.Text)
+			if strings.HasPrefix(line.Text, DHCLIENT_BOUND) {
+				select {
+				case bound <- line.Text:
+				default:
+				}
+			}
+		},
+	}
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err = sv.Start(ctx); err != nil {
+		return err
+	}
+	dc := &dhcpClient{iface: iface, sv: sv, done: make(chan struct{})}
+	r.dhclient = dc
+	r.goLoop(func() { dc.waitLease(ctx, bound) })
+	return nil
+}
+
+// waitLease log first lease of dhclient, a lease not obtained within
+// DHCLIENT_TIMEOUT is only warned since dhclient keeps retrying
+func (dc *dhcpClient) waitLease(ctx context.Context, bound chan string) {
+	log := logrus.WithField("prefix", "router.dhclient")
+	timer := time.NewTimer(DHCLIENT_TIMEOUT)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dc.done:
+			return
+		case text := <-bound:
+			log.Infof("dhclient of [%s] %s", dc.iface, text)
+			return
+		case <-timer.C:
+			log.Warnf("dhclient of [%s] not bound after %s, keep retrying",
+				dc.iface, DHCLIENT_TIMEOUT)
+		}
+	}
+}
+
+// stopDHClient stop supervised dhclient if running, called with
+// applyLock held
+func (r *WireguardRouter) stopDHClient() {
+	if r.dhclient != nil {
+		close(r.dhclient.done)
+		r.dhclient.sv.Stop()
+		r.dhclient = nil
+	}
+}
@@ -0,0 +1,155 @@
+package router
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+)
+
+// previousWireguard interface config of the previous applied config, nil
+// when not applied yet
+func (r *WireguardRouter) previousWireguard(name string) *registry.WireguardConfig {
+	return reconcile.FindWireguard(r.desiredConfig(), name)
+}
+
+// resolveCtx ctx of resolving endpoints during apply, bounded by
+// ENDPOINT_APPLY_TIMEOUT and ended by router stop
+func (r *WireguardRouter) resolveCtx() (context.Context, context.CancelFunc) {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithTimeout(ctx, ENDPOINT_APPLY_TIMEOUT)
+}
+
+// resolveEndpoints resolve hostname endpoints of device config for peers
+// whose live endpoint is not kept, peers failed to resolve stay without
+// endpoint until the resolver retries
+func resolveEndpoints(ctx context.Context, wgconf *registry.WireguardConfig,
+	devConf *wgtypes.Config, kept map[wgtypes.Key]bool) {
+	endpoints := make(map[string]string)
+	for _, p := range wgconf.Peers {
+		if p.Endpoint != "" {
+			endpoints[p.PubKey] = p.Endpoint
+		}
+	}
+	for i := range devConf.Peers {
+		pc := &devConf.Peers[i]
+		endpoint, ok := endpoints[pc.PublicKey.String()]
+		if !ok || pc.Endpoint != nil || kept[pc.PublicKey] {
+			continue
+		}
+		addr, err := wireguard.ResolveEndpoint(ctx, endpoint)
+		if err != nil {
+			logrus.WithField("prefix", "router.endpoint").
+				Warnf("peer [%s] of [%s]: %v", pc.PublicKey, wgconf.Name, err)
+			continue
+		}
+		pc.Endpoint = addr
+	}
+}
+
+// endpointLoop re-resolve peer endpoints until ctx done
+func (r *WireguardRouter) endpointLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.conf.ResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.reresolveEndpoints(ctx)
+	}
+}
+
+// reresolveEndpoints resolve endpoints of peers without a recent
+// handshake and update the peers whose address changed, like
+// reresolve-dns.sh
+func (r *WireguardRouter) reresolveEndpoints(ctx context.Context) {
+	conf := r.desiredConfig()
+	if conf == nil {
+		return
+	}
+	now := time.Now()
+	for _, wgconf := range conf.Wireguard {
+		dev, err := r.wgctl.Device(wgconf.Name)
+		if err != nil {
+			continue
+		}
+		livePeers := make(map[string]*wgtypes.Peer)
+		for i := range dev.Peers {
+			livePeers[dev.Peers[i].PublicKey.String()] = &dev.Peers[i]
+		}
+		for _, p := range wgconf.Peers {
+			live, ok := livePeers[p.PubKey]
+			if p.Endpoint == "" || !ok || !wireguard.NeedReresolve(live, now) {
+				continue
+			}
+			r.resolvePeer(ctx, wgconf.Name, p, live)
+		}
+	}
+}
+
+// reresolvePeer resolve endpoint of one peer of device regardless of its
+// handshake age, used on stale peers
+func (r *WireguardRouter) reresolvePeer(ctx context.Context, device string, p *registry.WireguardPeer) {
+	if p.Endpoint == "" {
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	dev, err := r.wgctl.Device(device)
+	if err != nil {
+		return
+	}
+	for i := range dev.Peers {
+		if dev.Peers[i].PublicKey.String() == p.PubKey {
+			r.resolvePeer(ctx, device, p, &dev.Peers[i])
+		}
+	}
+}
+
+// resolvePeer resolve peer endpoint and update live peer when the address
+// changed
+func (r *WireguardRouter) resolvePeer(ctx context.Context, device string,
+	p *registry.WireguardPeer, live *wgtypes.Peer) {
+	log := logrus.WithField("prefix", "router.endpoint").WithFields(logrus.Fields{
+		"device":   device,
+		"peer":     p.PubKey,
+		"endpoint": p.Endpoint,
+	})
+	addr, err := wireguard.ResolveEndpoint(ctx, p.Endpoint)
+	if err != nil {
+		log.Warnf("re-resolve peer endpoint failed: %v", err)
+		return
+	}
+	if !wireguard.EndpointChanged(live, addr) {
+		return
+	}
+	if err = r.updateEndpoint(device, live.PublicKey, addr); err != nil {
+		log.Warnf("update peer endpoint to [%s] failed: %v", addr, err)
+		return
+	}
+	log.Infof("update peer endpoint to [%s] success", addr)
+}
+
+// updateEndpoint set endpoint of existing peer
+func (r *WireguardRouter) updateEndpoint(device string, publicKey wgtypes.Key, addr *net.UDPAddr) error {
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	return r.wgctl.ConfigureDevice(device, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:  publicKey,
+			UpdateOnly: true,
+			Endpoint:   addr,
+		}},
+	})
+}
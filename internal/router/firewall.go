@@ -0,0 +1,51 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+)
+
+// applyFirewall converge router chains and their hooks to desired config
+// with the firewall backend of each protocol
+func (r *WireguardRouter) applyFirewall(conf *registry.DesiredConfig) error {
+	rules, err := reconcile.FirewallRules(conf)
+	if err != nil {
+		return err
+	}
+	for _, protocol := range []iptables.Protocol{
+		iptables.PROTOCOL_IPV4, iptables.PROTOCOL_IPV6} {
+		fw, err := r.firewall(protocol)
+		if err != nil {
+			if len(conf.Firewall) > 0 {
+				logrus.WithField("prefix", "router.firewall").
+					Warnf("skip %s firewall rules: %v", protocol, err)
+			}
+			continue
+		}
+		if err = fw.ApplyChains(rules[protocol]); err != nil {
+			return fmt.Errorf("apply %s firewall chains with [%s] failed: %v",
+				protocol, fw.Name(), err)
+		}
+	}
+	return nil
+}
+
+// removeFirewall unhook and remove router chains
+func (r *WireguardRouter) removeFirewall() error {
+	for _, fw := range []iptables.Firewall{r.firewall4, r.firewall6} {
+		if fw == nil {
+			continue
+		}
+		if err := fw.RemoveChains(reconcile.FirewallChains()); err != nil {
+			return fmt.Errorf("remove %s firewall chains with [%s] failed: %v",
+				fw.Protocol(), fw.Name(), err)
+		}
+		logrus.WithField("prefix", "router.teardown").
+			Infof("remove %s firewall chains with [%s] success", fw.Protocol(), fw.Name())
+	}
+	return nil
+}
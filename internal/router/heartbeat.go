@@ -0,0 +1,55 @@
+package router
+
+import (
+	"net"
+	"time"
+
+	"ntsc.ac.cn/ta-router/internal/registry"
+)
+
+// statusReport collect interface and peer status of applied config
+func (r *WireguardRouter) statusReport() (*registry.StatusReport, error) {
+	status := &registry.StatusReport{
+		ReportedAt: time.Now(),
+		Interfaces: make([]*registry.InterfaceStatus, 0),
+	}
+	conf := r.desiredConfig()
+	if conf == nil || r.wgctl == nil {
+		return status, nil
+	}
+	status.Revision = conf.Revision()
+	for _, wgconf := range conf.Wireguard {
+		ifs := &registry.InterfaceStatus{
+			Name:  wgconf.Name,
+			Peers: make([]*registry.PeerStatus, 0),
+		}
+		status.Interfaces = append(status.Interfaces, ifs)
+		if link, err := net.InterfaceByName(wgconf.Name); err == nil {
+			ifs.Up = link.Flags&net.FlagUp != 0
+		}
+		dev, err := r.wgctl.Device(wgconf.Name)
+		if err != nil {
+			continue
+		}
+		ifs.ListenPort = dev.ListenPort
+		for _, peer := range dev.Peers {
+			ps := &registry.PeerStatus{
+				PubKey:        peer.PublicKey.String(),
+				LastHandshake: peer.LastHandshakeTime,
+				RxBytes:       peer.ReceiveBytes,
+				TxBytes:       peer.TransmitBytes,
+			}
+			if peer.Endpoint != nil {
+				ps.Endpoint = peer.Endpoint.String()
+			}
+			if r.monitor != nil {
+				ps.Stale = r.monitor.IsStale(wgconf.Name, ps.PubKey)
+			}
+			if !peer.LastHandshakeTime.IsZero() {
+				ps.HandshakeAge = status.ReportedAt.Sub(peer.LastHandshakeTime)
+			}
+			ifs.Peers = append(ifs.Peers, ps)
+		}
+	}
+	return status, nil
+}
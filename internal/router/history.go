@@ -0,0 +1,80 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// SYNC_INIT initial apply on start
+	SYNC_INIT = "init"
+	// SYNC_APPLY apply of config revision delivered by registry
+	SYNC_APPLY = "apply"
+	// SYNC_RECONCILE periodic drift repair
+	SYNC_RECONCILE = "reconcile"
+	// SYNC_RESYNC forced fetch and apply of registry config
+	SYNC_RESYNC = "resync"
+	// SYNC_RELOAD forced apply of current config
+	SYNC_RELOAD = "reload"
+
+	// SYNC_HISTORY_SIZE sync events kept for management api
+	SYNC_HISTORY_SIZE = 64
+)
+
+// SyncEvent apply or reconcile attempt
+type SyncEvent struct {
+	Time     time.Time     `json:"time"`
+	Kind     string        `json:"kind"`
+	Revision string        `json:"revision,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// syncHistory latest sync events, oldest dropped
+type syncHistory struct {
+	lock   sync.Mutex
+	events []*SyncEvent
+}
+
+func (h *syncHistory) add(ev *SyncEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.events = append(h.events, ev)
+	if over := len(h.events) - SYNC_HISTORY_SIZE; over > 0 {
+		h.events = h.events[over:]
+	}
+}
+
+// list sync events, newest first
+func (h *syncHistory) list() []*SyncEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	events := make([]*SyncEvent, 0, len(h.events))
+	for i := len(h.events) - 1; i >= 0; i-- {
+		events = append(events, h.events[i])
+	}
+	return events
+}
+
+// track run sync and record it to history, revision is taken from the
+// desired config after sync when empty
+func (r *WireguardRouter) track(kind, revision string, sync func() error) error {
+	start := time.Now()
+	err := sync()
+	ev := &SyncEvent{
+		Time:     start,
+		Kind:     kind,
+		Revision: revision,
+		Duration: time.Since(start),
+	}
+	if ev.Revision == "" {
+		if conf := r.desiredConfig(); conf != nil {
+			ev.Revision = conf.Revision()
+		}
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	r.history.add(ev)
+	return err
+}
@@ -0,0 +1,51 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/metrics"
+)
+
+// metricsLoop sample peer and router chain counters and serve them on
+// Config.MetricsAddr until ctx done
+func (r *WireguardRouter) metricsLoop(ctx context.Context) {
+	collector := metrics.NewCollector(r.wgctl.Devices)
+	if r.monitor != nil {
+		collector.Stale = r.monitor.IsStale
+	}
+	for _, fw := range []iptables.Firewall{r.firewall4, r.firewall6} {
+		ipt, ok := fw.(*iptables.IPTables)
+		if !ok {
+			continue
+		}
+		for _, chain := range reconcile.FirewallChains() {
+			collector.AddChain(ipt, chain.Table, chain.Name)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector)
+	srv := &http.Server{
+		Addr:              r.conf.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 5,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	r.goLoop(func() { collector.Run(ctx, METRICS_SAMPLE_INTERVAL) })
+	logrus.WithField("prefix", "router.metrics").
+		Infof("serve metrics on [%s]", r.conf.MetricsAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		r.reportError(fmt.Errorf("serve metrics failed: %v", err))
+	}
+}
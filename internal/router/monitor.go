@@ -0,0 +1,128 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+)
+
+// monitorLoop check handshake age of managed peers until ctx done
+func (r *WireguardRouter) monitorLoop(ctx context.Context) {
+	interval := r.conf.HandshakeCheckInterval
+	if interval == 0 {
+		interval = HANDSHAKE_CHECK_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.checkHandshakes()
+	}
+}
+
+// checkHandshakes check managed interfaces once and handle stale peers
+func (r *WireguardRouter) checkHandshakes() {
+	conf := r.desiredConfig()
+	if conf == nil {
+		return
+	}
+	devs := make([]*wgtypes.Device, 0, len(conf.Wireguard))
+	for _, wgconf := range conf.Wireguard {
+		dev, err := r.wgctl.Device(wgconf.Name)
+		if err != nil {
+			continue
+		}
+		devs = append(devs, dev)
+	}
+	for _, ev := range r.monitor.Check(devs, time.Now()) {
+		r.handlePeerEvent(conf, ev)
+	}
+}
+
+// handlePeerEvent log peer liveness transition and apply stale action
+func (r *WireguardRouter) handlePeerEvent(conf *registry.DesiredConfig, ev *wireguard.PeerEvent) {
+	log := logrus.WithField("prefix", "router.monitor").WithFields(logrus.Fields{
+		"device":    ev.Device,
+		"peer":      ev.PublicKey,
+		"endpoint":  ev.Endpoint,
+		"age":       ev.Age.Round(time.Second).String(),
+		"threshold": ev.Threshold.String(),
+	})
+	if !ev.Stale {
+		log.Infof("peer handshake recovered")
+		return
+	}
+	log.Warnf("peer handshake stale")
+	r.heartbeat.RecordError(fmt.Errorf("peer [%s] of [%s] handshake stale for %s",
+		ev.PublicKey, ev.Device, ev.Age.Round(time.Second)))
+	switch r.conf.StaleAction {
+	case STALE_ACTION_RECONFIGURE:
+		if err := r.reconfigurePeer(conf, ev.Device, ev.PublicKey); err != nil {
+			log.Warnf("reconfigure stale peer failed: %v", err)
+			return
+		}
+		log.Infof("reconfigure stale peer success")
+	case STALE_ACTION_RERESOLVE:
+		wgconf := reconcile.FindWireguard(conf, ev.Device)
+		if wgconf == nil {
+			return
+		}
+		for _, p := range wgconf.Peers {
+			if p.PubKey == ev.PublicKey {
+				r.reresolvePeer(r.ctx, wgconf.Name, p)
+			}
+		}
+	}
+}
+
+// reconfigurePeer remove and re-add peer from desired config so its
+// session state is reset, the current endpoint is kept
+func (r *WireguardRouter) reconfigurePeer(conf *registry.DesiredConfig, device, publicKey string) error {
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	var peerConf *registry.WireguardPeer
+	for _, wgconf := range conf.Wireguard {
+		if wgconf.Name != device {
+			continue
+		}
+		for _, p := range wgconf.Peers {
+			if p.PubKey == publicKey {
+				peerConf = p
+			}
+		}
+	}
+	if peerConf == nil {
+		return fmt.Errorf("peer not in desired config")
+	}
+	pc, err := peerConf.PeerConfig()
+	if err != nil {
+		return err
+	}
+	dev, err := r.wgctl.Device(device)
+	if err != nil {
+		return err
+	}
+	for _, p := range dev.Peers {
+		if p.PublicKey == pc.PublicKey && pc.Endpoint == nil {
+			pc.Endpoint = p.Endpoint
+		}
+	}
+	if err = r.wgctl.ConfigureDevice(device, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: pc.PublicKey, Remove: true}},
+	}); err != nil {
+		return err
+	}
+	return r.wgctl.ConfigureDevice(device, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{*pc},
+	})
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"context"
+	"fmt"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+)
+
+// Plan changes applying config revision would make to the host
+type Plan = reconcile.Plan
+
+// Plan fetch config from registry and compute the changes applying it
+// would make, only read-only queries are run against the host
+func (r *WireguardRouter) Plan(ctx context.Context) (*Plan, error) {
+	if r.wgctl == nil {
+		if err := r.checkEnvs(); err != nil {
+			return nil, err
+		}
+	}
+	conf, err := r.source.FetchConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetch config failed: %v", err)
+	}
+	return r.planner().Plan(conf)
+}
+
+// planner planner of live host state on top of the current desired config
+func (r *WireguardRouter) planner() *reconcile.Planner {
+	firewalls := make(map[iptables.Protocol]iptables.Firewall)
+	for _, protocol := range []iptables.Protocol{
+		iptables.PROTOCOL_IPV4, iptables.PROTOCOL_IPV6} {
+		if fw, err := r.firewall(protocol); err == nil {
+			firewalls[protocol] = fw
+		}
+	}
+	return &reconcile.Planner{
+		IPTools:    r.ipTools,
+		Device:     r.wgctl.Device,
+		Firewalls:  firewalls,
+		ResolvConf: RESOLV_CONF_PATH,
+		Forward:    r.forward(),
+		Previous:   r.desiredConfig(),
+		Resolve: func(wgconf *registry.WireguardConfig, devConf *wgtypes.Config,
+			kept map[wgtypes.Key]bool) {
+			ctx, cancel := r.resolveCtx()
+			defer cancel()
+			resolveEndpoints(ctx, wgconf, devConf, kept)
+		},
+	}
+}
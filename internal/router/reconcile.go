@@ -0,0 +1,222 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+)
+
+// reconcileLoop periodically fetch desired config from registry and
+// converge live state to it, the applied config is used while registry is
+// unreachable
+func (r *WireguardRouter) reconcileLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.conf.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.track(SYNC_RECONCILE, "", func() error {
+				return r.reconcile(ctx)
+			}); err != nil {
+				r.reportError(fmt.Errorf("reconcile wireguard failed: %v", err))
+			}
+		}
+	}
+}
+
+// watchLoop apply config revisions delivered by registry watcher
+func (r *WireguardRouter) watchLoop(ctx context.Context) {
+	for rev := range r.watcher.Watch(ctx) {
+		if err := r.track(SYNC_APPLY, rev.Revision, func() error {
+			return r.applyConfig(rev.Config)
+		}); err != nil {
+			r.reportError(fmt.Errorf("apply config revision [%s] failed: %v",
+				rev.Revision, err))
+			continue
+		}
+		logrus.WithField("prefix", "router.watch").
+			Infof("apply config revision [%s] success", rev.Revision)
+	}
+}
+
+// reconcile fetch desired config and apply it when its revision differs
+// from the applied one, otherwise repair drift of live state against the
+// applied config
+func (r *WireguardRouter) reconcile(ctx context.Context) error {
+	fetched, err := r.source.FetchConfig(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logrus.WithField("prefix", "router.reconcile").
+			Warnf("fetch config failed: %v, reconcile with applied config", err)
+	}
+	conf := r.desiredConfig()
+	if fetched != nil && (conf == nil || conf.Revision() != fetched.Revision()) {
+		logrus.WithField("prefix", "router.reconcile").
+			Infof("registry config revision [%s] differs from applied, apply it",
+				fetched.Revision())
+		return r.applyConfig(fetched)
+	}
+	if conf == nil {
+		return nil
+	}
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	for _, wgconf := range conf.Wireguard {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.applyInterface(wgconf); err != nil {
+			return err
+		}
+	}
+	return r.applyFirewall(conf)
+}
+
+// applyInterface converge wireguard interface to desired config without
+// recreating it, only changed peers, addresses and routes are touched
+func (r *WireguardRouter) applyInterface(wgconf *registry.WireguardConfig) error {
+	dev, err := r.wgctl.Device(wgconf.Name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("query wireguard interface [%s] failed: %v", wgconf.Name, err)
+		}
+		if err = r.wireguard.AddWireguardInterface(wgconf.Name); err != nil {
+			return err
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("add wireguard interface [%s] success", wgconf.Name)
+		if dev, err = r.wgctl.Device(wgconf.Name); err != nil {
+			return fmt.Errorf("query wireguard interface [%s] failed: %v", wgconf.Name, err)
+		}
+	}
+	devConf, err := wgconf.DeviceConfig()
+	if err != nil {
+		return err
+	}
+	kept := reconcile.KeptEndpoints(dev, wgconf, r.previousWireguard(wgconf.Name))
+	ctx, cancel := r.resolveCtx()
+	resolveEndpoints(ctx, wgconf, devConf, kept)
+	cancel()
+	if delta := reconcile.DeviceDelta(dev, devConf, kept); delta != nil {
+		if err = r.wgctl.ConfigureDevice(wgconf.Name, *delta); err != nil {
+			return fmt.Errorf("config wireguard interface [%s] failed: %v",
+				wgconf.Name, err)
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("config wireguard interface [%s] success, [%d] peers changed",
+				wgconf.Name, len(delta.Peers))
+	}
+	if err = r.applyAddress(wgconf); err != nil {
+		return err
+	}
+	if ifi, err := net.InterfaceByName(wgconf.Name); err != nil {
+		return fmt.Errorf("query dev [%s] failed: %v", wgconf.Name, err)
+	} else if ifi.Flags&net.FlagUp == 0 || ifi.MTU != 1420 {
+		if err = r.wireguard.UpDevice(wgconf.Name); err != nil {
+			return err
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("up dev [%s] success and set mtu to [1420]", wgconf.Name)
+	}
+	if err = r.applyRoutes(wgconf); err != nil {
+		return err
+	}
+	return r.applyRules(wgconf)
+}
+
+// applyAddress add desired addresses and remove stale addresses of dev
+func (r *WireguardRouter) applyAddress(wgconf *registry.WireguardConfig) error {
+	addrs, err := r.ipTools.ListAddresses(wgconf.Name)
+	if err != nil {
+		return err
+	}
+	stale, missing := reconcile.AddressDelta(addrs, wgconf.Addresses())
+	for _, addr := range stale {
+		if err = r.ipTools.DeleteAddress(addr, wgconf.Name); err != nil {
+			return fmt.Errorf("delete ip address [%s] from dev [%s] failed: %v",
+				addr, wgconf.Name, err)
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("delete stale ip address [%s] from dev [%s] success",
+				addr, wgconf.Name)
+	}
+	for _, addr := range missing {
+		if err = r.ipTools.EnsureAddress(addr, wgconf.Name); err != nil {
+			return fmt.Errorf("add ip address [%s] to dev [%s] failed: %v",
+				addr, wgconf.Name, err)
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("add ip address [%s] to dev [%s] success",
+				addr, wgconf.Name)
+	}
+	return nil
+}
+
+// applyRoutes add missing routes and remove stale routes of dev
+func (r *WireguardRouter) applyRoutes(wgconf *registry.WireguardConfig) error {
+	routes, err := r.ipTools.ListRoutes(wgconf.Table)
+	if err != nil {
+		return err
+	}
+	stale, missing := reconcile.RouteDelta(routes, wgconf)
+	for _, route := range stale {
+		if err = r.ipTools.DeleteRoute(route.Network(), wgconf.Name, wgconf.Table); err != nil {
+			return err
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("delete stale address [%s] route from dev [%s] table [%s] success",
+				route.Dst, wgconf.Name, route.Table)
+	}
+	for _, addr := range missing {
+		if err = r.ipTools.EnsureRoute(addr, wgconf.Name, wgconf.Table); err != nil {
+			return err
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("add address [%s] route to dev [%s] table [%s] success",
+				addr, wgconf.Name, wgconf.Table)
+	}
+	return nil
+}
+
+// applyRules add missing rules and remove stale rules which lookup the
+// dedicated routing table of dev
+func (r *WireguardRouter) applyRules(wgconf *registry.WireguardConfig) error {
+	if !reconcile.DedicatedTable(wgconf.Table) {
+		if len(wgconf.Rules) > 0 {
+			logrus.WithField("prefix", "wireguard").
+				Warnf("dev [%s] has no dedicated routing table, rules ignored", wgconf.Name)
+		}
+		return nil
+	}
+	rules, err := r.ipTools.ListRules()
+	if err != nil {
+		return err
+	}
+	stale, missing := reconcile.RuleDelta(rules, wgconf)
+	for _, rule := range stale {
+		if err = r.ipTools.DeleteRule(rule); err != nil {
+			return err
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("delete stale rule [%s] success", rule)
+	}
+	for _, rule := range missing {
+		if err = r.ipTools.EnsureRule(rule); err != nil {
+			return err
+		}
+		logrus.WithField("prefix", "wireguard").
+			Infof("add rule [%s] success", rule)
+	}
+	return nil
+}
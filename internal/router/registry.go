@@ -0,0 +1,171 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"ntsc.ac.cn/ta-registry/pkg/pb"
+	"ntsc.ac.cn/ta-router/internal/registry"
+)
+
+// grpcRegistry registry backed by ta-registry grpc service, the
+// connection is dialed lazily so an unreachable registry at boot is retried
+type grpcRegistry struct {
+	machineID string
+	dial      func() (pb.RegistryServiceClient, io.Closer, error)
+	lock      sync.Mutex
+	rsc       pb.RegistryServiceClient
+	conn      io.Closer
+}
+
+// client get registry service client, dial when not connected
+func (g *grpcRegistry) client() (pb.RegistryServiceClient, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.rsc != nil {
+		return g.rsc, nil
+	}
+	rsc, conn, err := g.dial()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"dial management grpc connection failed: %v", err)
+	}
+	g.rsc, g.conn = rsc, conn
+	return rsc, nil
+}
+
+// Close close registry connection
+func (g *grpcRegistry) Close() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.rsc, g.conn = nil, nil
+	return err
+}
+
+// FetchConfig regist router and fetch desired config from registry
+func (g *grpcRegistry) FetchConfig(ctx context.Context) (*registry.DesiredConfig, error) {
+	rsc, err := g.client()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, REGISTRY_REQUEST_TIMEOUT)
+	defer cancel()
+	conf, err := rsc.RegistRouter(ctx, &pb.RegistRouterRequest{
+		MachineID: g.machineID,
+		SysTime:   timestamppb.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	dc := &registry.DesiredConfig{
+		DNSServer: conf.DnsServer,
+		Wireguard: make([]*registry.WireguardConfig, 0),
+	}
+	if wanInfo := conf.WanInfo; wanInfo != nil {
+		dc.Wan = &registry.EthernetConfig{
+			Name:       wanInfo.Name,
+			Addresses:  wanInfo.Addresses,
+			Gateway:    wanInfo.Gateway,
+			DhcpClient: wanInfo.DhcpClient,
+		}
+	}
+	for _, wgconf := range conf.WgConfig {
+		wgIf := wgconf.InterfaceDef
+		if wgIf == nil {
+			return nil, fmt.Errorf("wireguard interface [%s] not define", wgconf.Name)
+		}
+		wc := &registry.WireguardConfig{
+			Name:    wgconf.Name,
+			PrivKey: wgIf.PrivKey,
+			Port:    int(wgIf.Port),
+			Address: wgIf.Address,
+			Table:   wgIf.Table,
+			Peers:   make([]*registry.WireguardPeer, 0),
+			Rules:   make([]*registry.RoutingRule, 0),
+		}
+		for _, rule := range wgconf.Rules {
+			wc.Rules = append(wc.Rules, &registry.RoutingRule{
+				Priority: int(rule.Priority),
+				From:     rule.From,
+				To:       rule.To,
+				Fwmark:   rule.Fwmark,
+				Iif:      rule.Iif,
+			})
+		}
+		for _, wgPeer := range wgconf.Peers {
+			wc.Peers = append(wc.Peers, &registry.WireguardPeer{
+				PubKey:    wgPeer.PubKey,
+				PsKey:     wgPeer.PsKey,
+				Keepalive: int(wgPeer.Keepalive),
+				PeerAddr:  wgPeer.PeerAddr,
+				AllowIPs:  wgPeer.AllowIPs,
+				Endpoint:  wgPeer.Endpoint,
+			})
+		}
+		dc.Wireguard = append(dc.Wireguard, wc)
+	}
+	for _, rule := range conf.Firewall {
+		dc.Firewall = append(dc.Firewall, &registry.FirewallRule{
+			Type:        rule.Type,
+			Protocol:    rule.Protocol,
+			Source:      rule.Source,
+			Destination: rule.Destination,
+			InIface:     rule.InIface,
+			OutIface:    rule.OutIface,
+			Dport:       int(rule.Dport),
+			ToAddr:      rule.ToAddr,
+		})
+	}
+	return dc, nil
+}
+
+// ReportStatus report router status to registry
+func (g *grpcRegistry) ReportStatus(ctx context.Context, status *registry.StatusReport) error {
+	rsc, err := g.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, REGISTRY_REQUEST_TIMEOUT)
+	defer cancel()
+	req := &pb.ReportStatusRequest{
+		MachineID:  g.machineID,
+		SysTime:    timestamppb.New(status.ReportedAt),
+		Revision:   status.Revision,
+		Interfaces: make([]*pb.InterfaceStatus, 0, len(status.Interfaces)),
+		Errors:     status.Errors,
+	}
+	for _, ifs := range status.Interfaces {
+		is := &pb.InterfaceStatus{
+			Name:       ifs.Name,
+			Up:         ifs.Up,
+			ListenPort: int32(ifs.ListenPort),
+			Peers:      make([]*pb.PeerStatus, 0, len(ifs.Peers)),
+		}
+		for _, ps := range ifs.Peers {
+			peer := &pb.PeerStatus{
+				PubKey:       ps.PubKey,
+				Endpoint:     ps.Endpoint,
+				HandshakeAge: int64(ps.HandshakeAge.Seconds()),
+				RxBytes:      ps.RxBytes,
+				TxBytes:      ps.TxBytes,
+				Stale:        ps.Stale,
+			}
+			if !ps.LastHandshake.IsZero() {
+				peer.LastHandshake = timestamppb.New(ps.LastHandshake)
+			}
+			is.Peers = append(is.Peers, peer)
+		}
+		req.Interfaces = append(req.Interfaces, is)
+	}
+	if _, err = rsc.ReportStatus(ctx, req); err != nil {
+		return fmt.Errorf("report status failed: %v", err)
+	}
+	return nil
+}
@@ -1,26 +1,51 @@
 package router
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
 
 	"github.com/denisbrodbeck/machineid"
-	"golang.zx2c4.com/wireguard/wgctrl"
+	"github.com/sirupsen/logrus"
 	"ntsc.ac.cn/ta-registry/pkg/pb"
 	"ntsc.ac.cn/ta-registry/pkg/rpc"
+	"ntsc.ac.cn/ta-router/internal/registry"
 	"ntsc.ac.cn/ta-router/pkg/iptables"
 	"ntsc.ac.cn/ta-router/pkg/iptools"
+	"ntsc.ac.cn/ta-router/pkg/rexec"
 	"ntsc.ac.cn/ta-router/pkg/wireguard"
 )
 
 // WireguardRouter wireguard router
 type WireguardRouter struct {
 	conf      *Config
-	rsc       pb.RegistryServiceClient
+	conn      io.Closer
+	source    registry.Registry
+	watcher   *registry.Watcher
+	heartbeat *registry.Heartbeat
+	monitor   *wireguard.HandshakeMonitor
 	machineID string
 	wireguard *wireguard.WireguardTools
-	iptables  *iptables.IPTables
-	wgctl     *wgctrl.Client
+	firewall4 iptables.Firewall
+	firewall6 iptables.Firewall
+	wgctl     wireguard.Client
 	ipTools   *iptools.IPTools
+	errChan   chan error
+	cancel    context.CancelFunc
+	loops     sync.WaitGroup
+	// done closed after loops exit and errChan is closed
+	done       chan struct{}
+	release    sync.Once
+	releaseErr error
+	applyLock  sync.Mutex
+	stateLock  sync.RWMutex
+	desired    *registry.DesiredConfig
+	history    *syncHistory
+	runner     rexec.Runner
+	dhclient   *dhcpClient
+	ctx        context.Context
 }
 
 // NewWireguardRouter create wireguard router
@@ -39,31 +64,216 @@ func NewWireguardRouter(conf *Config) (*WireguardRouter, error) {
 	if err != nil {
 		return nil, fmt.Errorf("generate tls config failed: %v", err)
 	}
-	conn, err := rpc.DialRPCConn(&rpc.DialOptions{
-		RemoteAddr: conf.ManagerEndpoint,
-		TLSConfig:  tlsConf,
-	})
+	rgs := &grpcRegistry{
+		machineID: machineID,
+		dial: func() (pb.RegistryServiceClient, io.Closer, error) {
+			conn, err := rpc.DialRPCConn(&rpc.DialOptions{
+				RemoteAddr: conf.ManagerEndpoint,
+				TLSConfig:  tlsConf,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			return pb.NewRegistryServiceClient(conn), conn, nil
+		},
+	}
+	if _, err = rgs.client(); err != nil {
+		logrus.WithField("prefix", "router").
+			Warnf("%v, retry in background", err)
+	}
+	r, err := NewWireguardRouterWithRegistry(conf, machineID, rgs, rgs)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"dial management grpc connection failed: %v", err)
+		return nil, err
 	}
-	return &WireguardRouter{
+	r.conn = rgs
+	return r, nil
+}
+
+// NewWireguardRouterWithRegistry create wireguard router fetching config
+// from source and reporting status to reporter
+func NewWireguardRouterWithRegistry(conf *Config, machineID string,
+	source registry.Registry, reporter registry.Reporter) (*WireguardRouter, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("rpc server config is not define")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("check config failed: %v", err)
+	}
+	r := &WireguardRouter{
 		conf:      conf,
 		machineID: machineID,
-		rsc:       pb.NewRegistryServiceClient(conn),
-	}, nil
+		source:    source,
+		history:   &syncHistory{},
+		runner:    conf.Runner,
+	}
+	if r.runner == nil {
+		r.runner = rexec.DefaultRunner
+	}
+	if conf.AuditCommands {
+		r.runner = rexec.NewAuditRunner(r.runner)
+	}
+	r.watcher = registry.NewWatcher(r.source, conf.WatchInterval, "")
+	r.watcher.OnError = func(err error) {
+		r.reportError(fmt.Errorf("watch registry config failed: %v", err))
+	}
+	if conf.HandshakeTimeout > 0 {
+		r.monitor = wireguard.NewHandshakeMonitor(conf.HandshakeTimeout)
+	}
+	r.heartbeat = registry.NewHeartbeat(reporter, conf.HeartbeatInterval, r.statusReport)
+	r.heartbeat.OnError = func(err error) {
+		logrus.WithField("prefix", "router.heartbeat").
+			Warnf("report status failed: %v", err)
+	}
+	return r, nil
 }
 
-// Start start wireguard router
-func (r *WireguardRouter) Start() chan error {
-	errChan := make(chan error, 1)
+// Start start wireguard router, background errors are reported through
+// the returned channel which is closed after ctx done
+func (r *WireguardRouter) Start(ctx context.Context) chan error {
+	r.errChan = make(chan error, 16)
+	r.done = make(chan struct{})
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.ctx = ctx
 	if err := r.checkEnvs(); err != nil {
-		errChan <- err
-		return errChan
+		r.errChan <- err
+		close(r.errChan)
+		close(r.done)
+		return r.errChan
+	}
+	if err := r.track(SYNC_INIT, "", func() error {
+		return r.initWireguard(ctx)
+	}); err != nil {
+		r.reportError(fmt.Errorf("init wireguard service failed: %v", err))
+	}
+	r.goLoop(func() { r.watchLoop(ctx) })
+	r.goLoop(func() { r.reconcileLoop(ctx) })
+	r.goLoop(func() { r.heartbeat.Run(ctx) })
+	if r.monitor != nil {
+		r.goLoop(func() { r.monitorLoop(ctx) })
+	}
+	if r.conf.ResolveInterval > 0 {
+		r.goLoop(func() { r.endpointLoop(ctx) })
+	}
+	if r.conf.MetricsAddr != "" {
+		r.goLoop(func() { r.metricsLoop(ctx) })
+	}
+	if r.conf.APISocket != "" || r.conf.APIAddr != "" {
+		r.goLoop(func() { r.apiLoop(ctx) })
+	}
+	go func() {
+		r.loops.Wait()
+		close(r.errChan)
+		close(r.done)
+	}()
+	return r.errChan
+}
+
+// Stop stop background loops and release wgctrl client and registry
+// connection, managed interfaces are removed when Config.Teardown is set,
+// the error channel of Start is closed when Stop returns and calling Stop
+// again only returns the first result
+func (r *WireguardRouter) Stop(ctx context.Context) error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.done != nil {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return fmt.Errorf("wait background loops stop failed: %v", ctx.Err())
+		}
+	}
+	r.release.Do(func() {
+		r.releaseErr = r.releaseResources()
+	})
+	return r.releaseErr
+}
+
+// releaseResources stop dhclient, teardown and close clients once loops
+// exited
+func (r *WireguardRouter) releaseResources() error {
+	r.applyLock.Lock()
+	r.stopDHClient()
+	r.applyLock.Unlock()
+	errs := make([]string, 0)
+	if r.conf.Teardown {
+		if err := r.teardown(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if r.wgctl != nil {
+		if err := r.wgctl.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("close wireguard ctrl client failed: %v", err))
+		}
+	}
+	if r.ipTools != nil {
+		if err := r.ipTools.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("close ip tools failed: %v", err))
+		}
+	}
+	if r.conn != nil {
+		if err := r.conn.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("close registry connection failed: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("stop wireguard router failed: %s", strings.Join(errs, "; "))
+	}
+	logrus.WithField("prefix", "router").Infof("stop wireguard router success")
+	return nil
+}
+
+// goLoop run background loop
+func (r *WireguardRouter) goLoop(loop func()) {
+	r.loops.Add(1)
+	go func() {
+		defer r.loops.Done()
+		loop()
+	}()
+}
+
+// reportError report background error without blocking, the error is
+// also sent to registry with next heartbeat
+func (r *WireguardRouter) reportError(err error) {
+	if r.heartbeat != nil {
+		r.heartbeat.RecordError(err)
+	}
+	select {
+	case r.errChan <- err:
+	default:
+		logrus.WithField("prefix", "router").
+			Errorf("error channel full, drop error: %v", err)
+	}
+}
+
+// desiredConfig current desired config, nil before first apply
+func (r *WireguardRouter) desiredConfig() *registry.DesiredConfig {
+	r.stateLock.RLock()
+	defer r.stateLock.RUnlock()
+	return r.desired
+}
+
+// forward ip forward sysctl of Config.ProcRoot
+func (r *WireguardRouter) forward() *wireguard.IPForward {
+	return &wireguard.IPForward{ProcRoot: r.conf.ProcRoot}
+}
+
+// routerID short router id tagged to firewall rules owned by router
+func (r *WireguardRouter) routerID() string {
+	if len(r.machineID) > 8 {
+		return r.machineID[:8]
+	}
+	return r.machineID
+}
+
+// firewall firewall backend of protocol, ipv6 backend may be absent
+func (r *WireguardRouter) firewall(protocol iptables.Protocol) (iptables.Firewall, error) {
+	fw := r.firewall4
+	if protocol == iptables.PROTOCOL_IPV6 {
+		fw = r.firewall6
 	}
-	if err := r.initWireguard(); err != nil {
-		errChan <- fmt.Errorf("init wireguard service failed: %v", err)
-		return errChan
+	if fw == nil {
+		return nil, fmt.Errorf("%s firewall not available", protocol)
 	}
-	return errChan
+	return fw, nil
 }
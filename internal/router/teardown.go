@@ -0,0 +1,41 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+)
+
+// teardown remove firewall chains, interfaces and policy routing rules
+// created by router, addresses and routes of the interfaces are removed by
+// kernel together
+func (r *WireguardRouter) teardown() error {
+	r.applyLock.Lock()
+	defer r.applyLock.Unlock()
+	if err := r.removeFirewall(); err != nil {
+		return err
+	}
+	conf := r.desiredConfig()
+	if conf == nil || r.wireguard == nil {
+		return nil
+	}
+	for _, wgconf := range conf.Wireguard {
+		for _, rule := range reconcile.TunnelRules(wgconf) {
+			if err := r.ipTools.DeleteRule(rule); err != nil {
+				return fmt.Errorf("delete rule [%s] failed: %v", rule, err)
+			}
+			logrus.WithField("prefix", "router.teardown").
+				Infof("delete rule [%s] success", rule)
+		}
+		if _, err := r.wgctl.Device(wgconf.Name); err != nil {
+			continue
+		}
+		if err := r.wireguard.DelWireguardInterface(wgconf.Name); err != nil {
+			return fmt.Errorf("delete interface [%s] failed: %v", wgconf.Name, err)
+		}
+		logrus.WithField("prefix", "router.teardown").
+			Infof("delete wireguard interface [%s] success", wgconf.Name)
+	}
+	return nil
+}
@@ -20,7 +20,8 @@ func (t *IPTables) NewChain(tableName, chainName string) error {
 
 // ChainExist assert iptables chain exist with table
 func (t *IPTables) ChainExist(tableName, chainName string) (bool, error) {
-	_, err := t.List(tableName, chainName)
+	_, err := t.iptablesExec("iptables_chain_exist",
+		[]string{"-t", tableName, "-S", chainName})
 	if err != nil {
 		if strings.Contains(err.Error(), "No chain/target/match") {
 			return false, nil
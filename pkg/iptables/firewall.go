@@ -0,0 +1,264 @@
+package iptables
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Firewall firewall backend managing chains owned by caller, implemented
+// by IPTables and NFTables
+type Firewall interface {
+	// Name backend name
+	Name() string
+	// Protocol ip protocol of backend
+	Protocol() Protocol
+	// ApplyChains converge owned chains and their hooks atomically,
+	// nothing is written when chains already match
+	ApplyChains(chains []*FirewallChain) error
+	// RemoveChains unhook and remove owned chains
+	RemoveChains(chains []*FirewallChain) error
+	// PlanChains changes ApplyChains would write in backend notation,
+	// empty when chains already match, nothing is written
+	PlanChains(chains []*FirewallChain) ([]string, error)
+	// ListChains live rules of owned chains in backend notation by chain
+	// name, absent chains are omitted
+	ListChains(chains []*FirewallChain) (map[string][]string, error)
+}
+
+const (
+	// TARGET_ACCEPT accept packet
+	TARGET_ACCEPT = "ACCEPT"
+	// TARGET_DROP drop packet
+	TARGET_DROP = "DROP"
+	// TARGET_MASQUERADE masquerade source to out interface address
+	TARGET_MASQUERADE = "MASQUERADE"
+	// TARGET_SNAT source nat to ToAddr
+	TARGET_SNAT = "SNAT"
+	// TARGET_DNAT destination nat to ToAddr
+	TARGET_DNAT = "DNAT"
+)
+
+// FirewallChain chain owned by caller, Table is filter or nat and Hook is
+// the built-in chain jumping to it
+type FirewallChain struct {
+	Name  string
+	Table string
+	Hook  string
+	Rules []*FirewallRule
+}
+
+// FirewallRule backend neutral firewall rule, empty match fields match any
+type FirewallRule struct {
+	Source      string
+	Destination string
+	InIface     string
+	OutIface    string
+	Protocol    string
+	Dport       int
+	// Established match related and established connections
+	Established bool
+	Target      string
+	// ToAddr nat target address, ip or ip:port
+	ToAddr string
+}
+
+// Spec render rule in iptables-save notation, addresses are expected as
+// network cidr
+func (r *FirewallRule) Spec() ([]string, error) {
+	spec := make([]string, 0)
+	for _, match := range [][2]string{
+		{"-s", r.Source},
+		{"-d", r.Destination},
+		{"-i", r.InIface},
+		{"-o", r.OutIface},
+		{"-p", r.Protocol},
+	} {
+		if match[1] != "" {
+			spec = append(spec, match[0], match[1])
+		}
+	}
+	if r.Dport != 0 {
+		if r.Protocol == "" {
+			return nil, fmt.Errorf("firewall rule dport requires protocol")
+		}
+		spec = append(spec, "-m", r.Protocol, "--dport", strconv.Itoa(r.Dport))
+	}
+	if r.Established {
+		spec = append(spec, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED")
+	}
+	spec = append(spec, "-j", r.Target)
+	switch r.Target {
+	case TARGET_ACCEPT, TARGET_DROP, TARGET_MASQUERADE:
+	case TARGET_SNAT:
+		spec = append(spec, "--to-source", r.ToAddr)
+	case TARGET_DNAT:
+		spec = append(spec, "--to-destination", r.ToAddr)
+	default:
+		return nil, fmt.Errorf("unknow firewall target [%s]", r.Target)
+	}
+	return spec, nil
+}
+
+// Name backend name
+func (t *IPTables) Name() string {
+	return filepath.Base(t.iptablesPath)
+}
+
+// ApplyChains compare chains and hooks with iptables-save dump and restore
+// them as a whole when any chain or hook differs, rules are tagged with
+// ownership comment and stale owned rules of hook chains are deleted
+func (t *IPTables) ApplyChains(chains []*FirewallChain) error {
+	rs, changed, err := t.chainsRuleset(chains)
+	if err != nil || !changed {
+		return err
+	}
+	return t.Restore(rs)
+}
+
+// PlanChains iptables-restore input ApplyChains would write
+func (t *IPTables) PlanChains(chains []*FirewallChain) ([]string, error) {
+	rs, changed, err := t.chainsRuleset(chains)
+	if err != nil || !changed {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(rs.String(), "\n"), "\n"), nil
+}
+
+// chainsRuleset ruleset converging chains and hooks, changed is false
+// when the iptables-save dump already matches
+func (t *IPTables) chainsRuleset(chains []*FirewallChain) (*Ruleset, bool, error) {
+	rs := NewRuleset()
+	hooks := make(map[[2]string][]string)
+	for _, chain := range chains {
+		rs.AddChain(chain.Table, chain.Name)
+		for _, rule := range chain.Rules {
+			spec, err := rule.Spec()
+			if err != nil {
+				return nil, false, err
+			}
+			if spec, err = t.tagRule(chain.Name, spec); err != nil {
+				return nil, false, err
+			}
+			rs.AppendRule(chain.Table, chain.Name, spec)
+		}
+		hook, err := t.tagRule(chain.Hook, []string{"-j", chain.Name})
+		if err != nil {
+			return nil, false, err
+		}
+		key := [2]string{chain.Table, chain.Hook}
+		hooks[key] = append(hooks[key], FormatRuleSpec(append([]string{"-A", chain.Hook}, hook...)))
+	}
+	dumps := make(map[string]*TableDump)
+	changed := false
+	for _, chain := range chains {
+		dump, ok := dumps[chain.Table]
+		if !ok {
+			var err error
+			if dump, err = t.Save(chain.Table); err != nil {
+				return nil, false, err
+			}
+			dumps[chain.Table] = dump
+		}
+		if dump.Chain(chain.Name) == nil ||
+			!sameRuleSpecs(dump.Rules[chain.Name], rs.ChainRules(chain.Table, chain.Name)) {
+			changed = true
+		}
+	}
+	for key, desired := range hooks {
+		table, hook := key[0], key[1]
+		for _, l := range desired {
+			if !containsRuleSpec(dumps[table].Rules[hook], l) {
+				spec, _ := ParseRuleSpec(l)
+				rs.InsertRule(table, hook, spec.Args())
+				changed = true
+			}
+		}
+		for _, l := range dumps[table].Rules[hook] {
+			spec, err := ParseRuleSpec(l)
+			if err != nil {
+				return nil, false, fmt.Errorf("parse rule [%s] failed: %v", l, err)
+			}
+			if t.IsOwned(spec) && !containsRuleSpec(desired, l) {
+				rs.DeleteRule(table, hook, spec.Args())
+				changed = true
+			}
+		}
+	}
+	return rs, changed, nil
+}
+
+// RemoveChains delete owned rules of chain tables, then flush and remove
+// chains, rules of other owners are kept
+func (t *IPTables) RemoveChains(chains []*FirewallChain) error {
+	pruned := make(map[string]bool)
+	for _, chain := range chains {
+		if pruned[chain.Table] {
+			continue
+		}
+		if _, err := t.PruneOwnedRules(chain.Table, nil); err != nil {
+			return err
+		}
+		pruned[chain.Table] = true
+	}
+	for _, chain := range chains {
+		if err := t.FlushAndRemoveChain(chain.Table, chain.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListChains live rules of chains in iptables-save notation
+func (t *IPTables) ListChains(chains []*FirewallChain) (map[string][]string, error) {
+	dumps := make(map[string]*TableDump)
+	rules := make(map[string][]string)
+	for _, chain := range chains {
+		dump, ok := dumps[chain.Table]
+		if !ok {
+			var err error
+			if dump, err = t.Save(chain.Table); err != nil {
+				return nil, err
+			}
+			dumps[chain.Table] = dump
+		}
+		if dump.Chain(chain.Name) == nil {
+			continue
+		}
+		rules[chain.Name] = append([]string{}, dump.Rules[chain.Name]...)
+	}
+	return rules, nil
+}
+
+// sameRuleSpecs compare rule lines after parsing, so option spelling and
+// quoting differences are ignored
+func sameRuleSpecs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameRuleSpec(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRuleSpec(a, b string) bool {
+	ra, err := ParseRuleSpec(a)
+	if err != nil {
+		return false
+	}
+	rb, err := ParseRuleSpec(b)
+	return err == nil && ra.Equal(rb)
+}
+
+func containsRuleSpec(list []string, spec string) bool {
+	for _, l := range list {
+		if sameRuleSpec(l, spec) {
+			return true
+		}
+	}
+	return false
+}
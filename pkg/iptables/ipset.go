@@ -0,0 +1,273 @@
+package iptables
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+)
+
+// SetType ipset set type
+type SetType string
+
+const (
+	// SET_HASH_IP set of ip addresses
+	SET_HASH_IP SetType = "hash:ip"
+	// SET_HASH_NET set of network cidrs
+	SET_HASH_NET SetType = "hash:net"
+	// SET_HASH_IP_PORT set of ip and protocol:port pairs
+	SET_HASH_IP_PORT SetType = "hash:ip,port"
+)
+
+// IPSET_MAX_NAME_LEN max length of ipset name
+const IPSET_MAX_NAME_LEN = 31
+
+// IPSET_SWAP_SUFFIX suffix of temporary set used by RestoreSet
+const IPSET_SWAP_SUFFIX = "-swap"
+
+// IPSet ipset set information
+type IPSet struct {
+	Name    string
+	Type    SetType
+	Family  string
+	Options []string
+	Entries []string
+}
+
+// family ipset family of iptables protocol
+func (t *IPTables) family() string {
+	if t.protocol == PROTOCOL_IPV6 {
+		return "inet6"
+	}
+	return "inet"
+}
+
+// ipsetExec ipset executer
+func (t *IPTables) ipsetExec(name string, args []string) (string, error) {
+	return t.exec(name, t.ipsetPath, args, "")
+}
+
+func checkSetName(name string) error {
+	if name == "" || len(name)+len(IPSET_SWAP_SUFFIX) > IPSET_MAX_NAME_LEN {
+		return fmt.Errorf("ipset name [%s] must have 1 to %d characters",
+			name, IPSET_MAX_NAME_LEN-len(IPSET_SWAP_SUFFIX))
+	}
+	if strings.HasPrefix(name, "-") || strings.IndexFunc(name, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid ipset name %q", name)
+	}
+	return nil
+}
+
+// checkEntry check entry against set type and protocol family, entries
+// are written into ipset restore scripts so anything else is rejected
+func (t *IPTables) checkEntry(setType SetType, entry string) error {
+	if entry == "" || strings.IndexFunc(entry, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid ipset entry %q", entry)
+	}
+	var addr string
+	switch setType {
+	case SET_HASH_IP:
+		addr = entry
+	case SET_HASH_NET:
+		addr = entry
+		if i := strings.Index(entry, "/"); i >= 0 {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return fmt.Errorf("invalid ipset entry [%s]: bad cidr", entry)
+			}
+			addr = entry[:i]
+		}
+	case SET_HASH_IP_PORT:
+		parts := strings.SplitN(entry, ",", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid ipset entry [%s]: want ip,proto:port", entry)
+		}
+		addr = parts[0]
+		port := parts[1]
+		if i := strings.Index(port, ":"); i >= 0 {
+			switch port[:i] {
+			case "tcp", "udp", "sctp", "udplite":
+			default:
+				return fmt.Errorf("invalid ipset entry [%s]: bad protocol", entry)
+			}
+			port = port[i+1:]
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			return fmt.Errorf("invalid ipset entry [%s]: bad port", entry)
+		}
+	default:
+		return fmt.Errorf("unsupported ipset type [%s]", setType)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid ipset entry [%s]: bad address", entry)
+	}
+	if (ip.To4() != nil) != (t.protocol != PROTOCOL_IPV6) {
+		return fmt.Errorf("invalid ipset entry [%s]: not family %s", entry, t.family())
+	}
+	return nil
+}
+
+// CreateSet create ipset set of protocol family, options like
+// "maxelem 65536" are passed to ipset, existing set is kept
+func (t *IPTables) CreateSet(name string, setType SetType, options ...string) error {
+	if err := checkSetName(name); err != nil {
+		return err
+	}
+	args := []string{"create", name, string(setType), "family", t.family()}
+	args = append(args, options...)
+	args = append(args, "-exist")
+	if _, err := t.ipsetExec("ipset_create", args); err != nil {
+		return fmt.Errorf("create ipset [%s] failed: %v", name, err)
+	}
+	return nil
+}
+
+// DestroySet destroy ipset set, absent set is ignored
+func (t *IPTables) DestroySet(name string) error {
+	if err := checkSetName(name); err != nil {
+		return err
+	}
+	_, err := t.ipsetExec("ipset_destroy", []string{"destroy", name})
+	if err == nil {
+		return nil
+	}
+	// ipset exits with 1 for any kernel error, like a set still
+	// referenced by rules, so the set must be absent to ignore it
+	if rexec.ExitCode(err) == 1 {
+		if exist, lerr := t.setExists(name); lerr == nil && !exist {
+			return nil
+		}
+	}
+	return fmt.Errorf("destroy ipset [%s] failed: %v", name, err)
+}
+
+// setExists assert ipset set exists by listing set names
+func (t *IPTables) setExists(name string) (bool, error) {
+	result, err := t.ipsetExec("ipset_list", []string{"list", "-name"})
+	if err != nil {
+		return false, err
+	}
+	for _, l := range strings.Split(result, "\n") {
+		if strings.TrimSpace(l) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddEntry add entry to ipset set of type, existing entry is ignored
+func (t *IPTables) AddEntry(name string, setType SetType, entry string) error {
+	if err := checkSetName(name); err != nil {
+		return err
+	}
+	if err := t.checkEntry(setType, entry); err != nil {
+		return fmt.Errorf("add ipset [%s] entry failed: %v", name, err)
+	}
+	if _, err := t.ipsetExec("ipset_add",
+		[]string{"add", name, entry, "-exist"}); err != nil {
+		return fmt.Errorf("add ipset [%s] entry [%s] failed: %v", name, entry, err)
+	}
+	return nil
+}
+
+// DelEntry delete entry from ipset set of type, absent entry is ignored
+func (t *IPTables) DelEntry(name string, setType SetType, entry string) error {
+	if err := checkSetName(name); err != nil {
+		return err
+	}
+	if err := t.checkEntry(setType, entry); err != nil {
+		return fmt.Errorf("delete ipset [%s] entry failed: %v", name, err)
+	}
+	if _, err := t.ipsetExec("ipset_del",
+		[]string{"del", name, entry, "-exist"}); err != nil {
+		return fmt.Errorf("delete ipset [%s] entry [%s] failed: %v", name, entry, err)
+	}
+	return nil
+}
+
+// ListSet list ipset set and its entries
+func (t *IPTables) ListSet(name string) (*IPSet, error) {
+	result, err := t.ipsetExec("ipset_list", []string{"save", name})
+	if err != nil {
+		return nil, fmt.Errorf("list ipset [%s] failed: %v", name, err)
+	}
+	set := &IPSet{Name: name, Entries: make([]string, 0)}
+	scanner := bufio.NewScanner(strings.NewReader(result))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 3 || parts[1] != name {
+			continue
+		}
+		switch parts[0] {
+		case "create":
+			set.Type = SetType(parts[2])
+			for i := 3; i < len(parts); i++ {
+				if parts[i] == "family" && i+1 < len(parts) {
+					set.Family = parts[i+1]
+					i++
+					continue
+				}
+				set.Options = append(set.Options, parts[i])
+			}
+		case "add":
+			set.Entries = append(set.Entries, parts[2])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("parse ipset [%s] failed: %v", name, err)
+	}
+	return set, nil
+}
+
+// SwapSet swap content of two ipset sets of the same type
+func (t *IPTables) SwapSet(from, to string) error {
+	if _, err := t.ipsetExec("ipset_swap", []string{"swap", from, to}); err != nil {
+		return fmt.Errorf("swap ipset [%s] and [%s] failed: %v", from, to, err)
+	}
+	return nil
+}
+
+// RestoreSet replace set entries in bulk with ipset restore, entries are
+// loaded into a temporary set and swapped in so rules referencing the set
+// never see a partial list, every entry is checked against set type
+// before the script is built
+func (t *IPTables) RestoreSet(name string, setType SetType, entries []string) error {
+	if err := checkSetName(name); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := t.checkEntry(setType, entry); err != nil {
+			return fmt.Errorf("restore ipset [%s] failed: %v", name, err)
+		}
+	}
+	tmp := name + IPSET_SWAP_SUFFIX
+	var sb strings.Builder
+	for _, set := range []string{name, tmp} {
+		sb.WriteString(fmt.Sprintf("create %s %s family %s\n", set, setType, t.family()))
+	}
+	sb.WriteString("flush " + tmp + "\n")
+	for _, entry := range entries {
+		sb.WriteString("add " + tmp + " " + entry + "\n")
+	}
+	sb.WriteString("swap " + tmp + " " + name + "\n")
+	sb.WriteString("destroy " + tmp + "\n")
+	if _, err := t.exec("ipset_restore", t.ipsetPath, []string{"restore", "-exist"},
+		sb.String()); err != nil {
+		return fmt.Errorf("restore ipset [%s] failed: %v", name, err)
+	}
+	return nil
+}
+
+// MatchSet rule spec matching ipset set, directions like "src" or
+// "src,dst" select packet fields for each set dimension, src when empty
+func MatchSet(name string, directions ...string) []string {
+	flags := "src"
+	if len(directions) > 0 {
+		flags = strings.Join(directions, ",")
+	}
+	return []string{"-m", "set", "--match-set", name, flags}
+}
@@ -4,42 +4,95 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"os/exec"
+	"net"
 	"strconv"
 	"strings"
 
 	"ntsc.ac.cn/ta-router/pkg/rexec"
 )
 
+// Protocol iptables ip protocol
+type Protocol int
+
+const (
+	// PROTOCOL_IPV4 iptables
+	PROTOCOL_IPV4 Protocol = iota
+	// PROTOCOL_IPV6 ip6tables
+	PROTOCOL_IPV6
+)
+
+// String protocol to string
+func (p Protocol) String() string {
+	switch p {
+	case PROTOCOL_IPV4:
+		return "ipv4"
+	case PROTOCOL_IPV6:
+		return "ipv6"
+	default:
+		return "unknow"
+	}
+}
+
 // IPTables iptables wrap
 type IPTables struct {
+	protocol     Protocol
 	iptablesPath string
 	ipsetPath    string
+	owner        string
+	runner       rexec.Runner
 }
 
 // NewIPTables new iptables wrap
 func NewIPTables(iptablesPath, ipsetPath string) (*IPTables, error) {
+	return NewIPTablesWithProtocol(PROTOCOL_IPV4, iptablesPath, ipsetPath)
+}
+
+// NewIP6Tables new ip6tables wrap
+func NewIP6Tables(ip6tablesPath, ipsetPath string) (*IPTables, error) {
+	return NewIPTablesWithProtocol(PROTOCOL_IPV6, ip6tablesPath, ipsetPath)
+}
+
+// NewIPTablesWithProtocol new iptables or ip6tables wrap with protocol
+func NewIPTablesWithProtocol(protocol Protocol, iptablesPath, ipsetPath string) (*IPTables, error) {
+	return NewIPTablesWithRunner(protocol, iptablesPath, ipsetPath, rexec.DefaultRunner)
+}
+
+// NewIPTablesWithRunner new iptables or ip6tables wrap running commands
+// with runner
+func NewIPTablesWithRunner(protocol Protocol, iptablesPath, ipsetPath string,
+	runner rexec.Runner) (*IPTables, error) {
 	var err error
 	if iptablesPath == "" {
 		iptablesPath = "iptables"
+		if protocol == PROTOCOL_IPV6 {
+			iptablesPath = "ip6tables"
+		}
 	}
 	if ipsetPath == "" {
 		ipsetPath = "ipset"
 	}
-	if iptablesPath, err = exec.LookPath(iptablesPath); err != nil {
+	if iptablesPath, err = runner.LookPath(iptablesPath); err != nil {
 		return nil, fmt.Errorf("loop path [%s] failed: %s",
 			iptablesPath, err.Error())
 	}
-	if ipsetPath, err = exec.LookPath(ipsetPath); err != nil {
+	if ipsetPath, err = runner.LookPath(ipsetPath); err != nil {
 		return nil, fmt.Errorf("loop path [%s] failed: %s",
 			ipsetPath, err.Error())
 	}
 	return &IPTables{
+		protocol:     protocol,
 		iptablesPath: iptablesPath,
 		ipsetPath:    ipsetPath,
+		owner:        DEFAULT_OWNER,
+		runner:       runner,
 	}, nil
 }
 
+// Protocol ip protocol of iptables wrap
+func (t *IPTables) Protocol() Protocol {
+	return t.protocol
+}
+
 // Rule iptables rule information
 type Rule struct {
 	Num         int
@@ -56,19 +109,57 @@ type Rule struct {
 
 // iptablesExec iptables executer
 func (t *IPTables) iptablesExec(name string, args []string) (string, error) {
-	exe, err := rexec.NewExecuter(name,
-		t.iptablesPath, args)
-	if err != nil {
-		return "", fmt.Errorf(
-			"exec iptables [%s] failed: %s", name, err.Error())
+	return t.exec(name, t.iptablesPath, args, "")
+}
+
+// listFields align fields of iptables -L -v -n -x row to num, pkts,
+// bytes, target, prot, opt, in, out, source and destination, the blank
+// target of rules without one and the blank opt of ip6tables are filled
+// with empty strings, nil when row can not be aligned
+func listFields(values []string) []string {
+	if len(values) < 8 {
+		return nil
+	}
+	rest := values[3:]
+	// in is followed by out, source and destination, with -n source and
+	// destination are always numeric
+	in := -1
+	for i := 1; i <= 3 && i+3 < len(rest); i++ {
+		if isListAddr(rest[i+2]) && isListAddr(rest[i+3]) {
+			in = i
+			break
+		}
 	}
+	var head []string
+	switch in {
+	case 3:
+		head = rest[:3]
+	case 2:
+		if isListOpt(rest[1]) {
+			head = []string{"", rest[0], rest[1]}
+		} else {
+			head = []string{rest[0], rest[1], ""}
+		}
+	case 1:
+		head = []string{"", rest[0], ""}
+	default:
+		return nil
+	}
+	fields := append(append(append([]string{}, values[:3]...), head...), rest[in:in+4]...)
+	return append(fields, rest[in+4:]...)
+}
 
-	result, err := exe.Run()
-	if err != nil {
-		return "", fmt.Errorf(
-			"exec iptables [%s] failed: %s", name, result)
+// isListOpt assert field is opt column of iptables -L
+func isListOpt(s string) bool {
+	return s == "--" || s == "-f" || s == "!f"
+}
+
+// isListAddr assert field is numeric source or destination of iptables -L
+func isListAddr(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
 	}
-	return result, nil
+	return net.ParseIP(s) != nil
 }
 
 // List list iptables rules with table and chain name
@@ -77,7 +168,7 @@ func (t *IPTables) List(tableName string, chainName string) ([]*Rule, error) {
 	if chainName != "" {
 		args = append(args, chainName)
 	}
-	args = append(args, []string{"-v", "-n", "--line-numbers"}...)
+	args = append(args, []string{"-v", "-n", "-x", "--line-numbers"}...)
 	if tableName != "" {
 		args = append(args, []string{"-t", tableName}...)
 	}
@@ -110,9 +201,9 @@ func (t *IPTables) List(tableName string, chainName string) ([]*Rule, error) {
 			header2 = string(l)
 			continue
 		}
-		values := strings.Fields(string(l))
-		if len(values) < 10 {
-			return nil, fmt.Errorf("parse iptables rule failed,size [%d]", len(values))
+		values := listFields(strings.Fields(string(l)))
+		if values == nil {
+			return nil, fmt.Errorf("parse iptables rule [%s] failed", string(l))
 		}
 		num, err := strconv.Atoi(values[0])
 		if err != nil {
@@ -0,0 +1,328 @@
+package iptables
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+)
+
+// NFT_TABLE_NAME nftables table holding chains owned by NFTables
+const NFT_TABLE_NAME = "ta-router"
+
+// NFT_COMMENT_PREFIX prefix of rule comment carrying rule digest
+const NFT_COMMENT_PREFIX = "ta:"
+
+// NFTables nftables firewall backend, owned chains are base chains of a
+// dedicated table so no jump from built-in chains is needed. A packet is
+// evaluated by every base chain of a hook, so accept rules of the owned
+// table can not override a drop in the forward chain of another table,
+// see ForwardDropChains
+type NFTables struct {
+	protocol Protocol
+	nftPath  string
+	runner   rexec.Runner
+}
+
+// NewNFTables new nftables backend of protocol
+func NewNFTables(protocol Protocol, nftPath string) (*NFTables, error) {
+	return NewNFTablesWithRunner(protocol, nftPath, rexec.DefaultRunner)
+}
+
+// NewNFTablesWithRunner new nftables backend of protocol running nft with
+// runner
+func NewNFTablesWithRunner(protocol Protocol, nftPath string, runner rexec.Runner) (*NFTables, error) {
+	var err error
+	if nftPath == "" {
+		nftPath = "nft"
+	}
+	if nftPath, err = runner.LookPath(nftPath); err != nil {
+		return nil, fmt.Errorf("loop path [%s] failed: %s",
+			nftPath, err.Error())
+	}
+	nft := &NFTables{protocol: protocol, nftPath: nftPath, runner: runner}
+	if _, err = nft.nftExec("nft_list", []string{"list", "tables"}, ""); err != nil {
+		return nil, err
+	}
+	return nft, nil
+}
+
+// Name backend name
+func (n *NFTables) Name() string {
+	return "nftables"
+}
+
+// Protocol ip protocol of backend
+func (n *NFTables) Protocol() Protocol {
+	return n.protocol
+}
+
+// family nftables table family
+func (n *NFTables) family() string {
+	if n.protocol == PROTOCOL_IPV6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// nftExec nft executer
+func (n *NFTables) nftExec(name string, args []string, stdin string) (string, error) {
+	result, err := n.runner.Run(&rexec.Command{
+		Name:  name,
+		Path:  n.nftPath,
+		Args:  args,
+		Stdin: stdin,
+	})
+	if err != nil {
+		if result == "" {
+			result = err.Error()
+		}
+		return "", fmt.Errorf("exec nft [%s] failed: %s", name, result)
+	}
+	return result, nil
+}
+
+// ApplyChains replace owned table in one nft transaction when rules
+// listed by nft -j differ from chains
+func (n *NFTables) ApplyChains(chains []*FirewallChain) error {
+	script, err := n.chainsScript(chains)
+	if err != nil || script == "" {
+		return err
+	}
+	if _, err = n.nftExec("nft_apply", []string{"-f", "-"}, script); err != nil {
+		return fmt.Errorf("apply nftables table [%s %s] failed: %v",
+			n.family(), NFT_TABLE_NAME, err)
+	}
+	return nil
+}
+
+// PlanChains nft script ApplyChains would run
+func (n *NFTables) PlanChains(chains []*FirewallChain) ([]string, error) {
+	script, err := n.chainsScript(chains)
+	if err != nil || script == "" {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(script, "\n"), "\n"), nil
+}
+
+// chainsScript nft script replacing owned table, empty when rules listed
+// by nft -j already match chains
+func (n *NFTables) chainsScript(chains []*FirewallChain) (string, error) {
+	var body strings.Builder
+	desired := make(map[string][]string)
+	for _, chain := range chains {
+		hook, err := nftHook(chain)
+		if err != nil {
+			return "", err
+		}
+		body.WriteString(fmt.Sprintf("\tchain %s {\n\t\t%s\n", chain.Name, hook))
+		desired[chain.Name] = make([]string, 0)
+		for _, rule := range chain.Rules {
+			stmt, err := n.statement(rule)
+			if err != nil {
+				return "", err
+			}
+			sum := sha256.Sum256([]byte(stmt))
+			comment := NFT_COMMENT_PREFIX + hex.EncodeToString(sum[:8])
+			desired[chain.Name] = append(desired[chain.Name], comment)
+			body.WriteString(fmt.Sprintf("\t\t%s comment \"%s\"\n", stmt, comment))
+		}
+		body.WriteString("\t}\n")
+	}
+	current, err := n.listComments()
+	if err != nil {
+		return "", err
+	}
+	if current != nil && len(current) == len(desired) {
+		same := true
+		for name, comments := range desired {
+			if strings.Join(current[name], ",") != strings.Join(comments, ",") {
+				same = false
+				break
+			}
+		}
+		if same {
+			return "", nil
+		}
+	}
+	table := n.family() + " " + NFT_TABLE_NAME
+	return "add table " + table + "\n" +
+		"delete table " + table + "\n" +
+		"table " + table + " {\n" + body.String() + "}\n", nil
+}
+
+// RemoveChains delete owned table with all its chains
+func (n *NFTables) RemoveChains(chains []*FirewallChain) error {
+	table := n.family() + " " + NFT_TABLE_NAME
+	script := "add table " + table + "\n" + "delete table " + table + "\n"
+	if _, err := n.nftExec("nft_remove", []string{"-f", "-"}, script); err != nil {
+		return fmt.Errorf("remove nftables table [%s] failed: %v", table, err)
+	}
+	return nil
+}
+
+// ListChains live rules of owned table by chain in nft notation, base
+// chain declarations are omitted
+func (n *NFTables) ListChains(chains []*FirewallChain) (map[string][]string, error) {
+	rules := make(map[string][]string)
+	result, err := n.nftExec("nft_list_table",
+		[]string{"list", "table", n.family(), NFT_TABLE_NAME}, "")
+	if err != nil {
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return rules, nil
+		}
+		return nil, err
+	}
+	chain := ""
+	for _, l := range strings.Split(result, "\n") {
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, "chain ") && strings.HasSuffix(l, "{"):
+			chain = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(l, "chain "), "{"))
+			rules[chain] = make([]string, 0)
+		case l == "}":
+			chain = ""
+		case chain == "" || l == "" || strings.HasPrefix(l, "type "):
+		default:
+			rules[chain] = append(rules[chain], l)
+		}
+	}
+	return rules, nil
+}
+
+// listComments rule comments of owned table by chain, nil when table absent
+func (n *NFTables) listComments() (map[string][]string, error) {
+	result, err := n.nftExec("nft_list_table",
+		[]string{"-j", "list", "table", n.family(), NFT_TABLE_NAME}, "")
+	if err != nil {
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ruleset struct {
+		Nftables []struct {
+			Chain *struct {
+				Name string `json:"name"`
+			} `json:"chain"`
+			Rule *struct {
+				Chain   string `json:"chain"`
+				Comment string `json:"comment"`
+			} `json:"rule"`
+		} `json:"nftables"`
+	}
+	if err = json.Unmarshal([]byte(result), &ruleset); err != nil {
+		return nil, fmt.Errorf("parse nftables json failed: %v", err)
+	}
+	comments := make(map[string][]string)
+	for _, obj := range ruleset.Nftables {
+		if obj.Chain != nil {
+			if _, ok := comments[obj.Chain.Name]; !ok {
+				comments[obj.Chain.Name] = make([]string, 0)
+			}
+		}
+		if obj.Rule != nil {
+			comments[obj.Rule.Chain] = append(comments[obj.Rule.Chain], obj.Rule.Comment)
+		}
+	}
+	return comments, nil
+}
+
+// ForwardDropChains base chains of other tables hooked on forward with
+// drop policy in family and inet tables, traffic accepted by owned chains
+// is still dropped by them
+func (n *NFTables) ForwardDropChains() ([]string, error) {
+	result, err := n.nftExec("nft_list_chains", []string{"-j", "list", "chains"}, "")
+	if err != nil {
+		return nil, err
+	}
+	var ruleset struct {
+		Nftables []struct {
+			Chain *struct {
+				Family string `json:"family"`
+				Table  string `json:"table"`
+				Name   string `json:"name"`
+				Hook   string `json:"hook"`
+				Policy string `json:"policy"`
+			} `json:"chain"`
+		} `json:"nftables"`
+	}
+	if err = json.Unmarshal([]byte(result), &ruleset); err != nil {
+		return nil, fmt.Errorf("parse nftables json failed: %v", err)
+	}
+	chains := make([]string, 0)
+	for _, obj := range ruleset.Nftables {
+		c := obj.Chain
+		if c == nil || c.Hook != "forward" || c.Policy != "drop" ||
+			(c.Family != n.family() && c.Family != "inet") ||
+			(c.Family == n.family() && c.Table == NFT_TABLE_NAME) {
+			continue
+		}
+		chains = append(chains, c.Family+" "+c.Table+" "+c.Name)
+	}
+	return chains, nil
+}
+
+// nftHook base chain declaration of chain
+func nftHook(chain *FirewallChain) (string, error) {
+	var prio int
+	switch strings.ToUpper(chain.Hook) {
+	case "FORWARD":
+		prio = 0
+	case "PREROUTING":
+		prio = -100
+	case "POSTROUTING":
+		prio = 100
+	default:
+		return "", fmt.Errorf("unsupported nftables hook [%s]", chain.Hook)
+	}
+	return fmt.Sprintf("type %s hook %s priority %d; policy accept;",
+		chain.Table, strings.ToLower(chain.Hook), prio), nil
+}
+
+// statement render rule as nftables statement
+func (n *NFTables) statement(r *FirewallRule) (string, error) {
+	parts := make([]string, 0)
+	if r.Source != "" {
+		parts = append(parts, n.family()+" saddr "+r.Source)
+	}
+	if r.Destination != "" {
+		parts = append(parts, n.family()+" daddr "+r.Destination)
+	}
+	if r.InIface != "" {
+		parts = append(parts, "iifname "+strconv.Quote(r.InIface))
+	}
+	if r.OutIface != "" {
+		parts = append(parts, "oifname "+strconv.Quote(r.OutIface))
+	}
+	if r.Dport != 0 {
+		if r.Protocol == "" {
+			return "", fmt.Errorf("firewall rule dport requires protocol")
+		}
+		parts = append(parts, r.Protocol+" dport "+strconv.Itoa(r.Dport))
+	} else if r.Protocol != "" {
+		parts = append(parts, "meta l4proto "+r.Protocol)
+	}
+	if r.Established {
+		parts = append(parts, "ct state established,related")
+	}
+	switch r.Target {
+	case TARGET_ACCEPT:
+		parts = append(parts, "accept")
+	case TARGET_DROP:
+		parts = append(parts, "drop")
+	case TARGET_MASQUERADE:
+		parts = append(parts, "masquerade")
+	case TARGET_SNAT:
+		parts = append(parts, "snat to "+r.ToAddr)
+	case TARGET_DNAT:
+		parts = append(parts, "dnat to "+r.ToAddr)
+	default:
+		return "", fmt.Errorf("unknow firewall target [%s]", r.Target)
+	}
+	return strings.Join(parts, " "), nil
+}
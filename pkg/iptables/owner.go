@@ -0,0 +1,114 @@
+package iptables
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// OWNER_TAG_PREFIX prefix of ownership comment, the full tag is
+// ta-router:<owner>:<rule id>
+const OWNER_TAG_PREFIX = "ta-router"
+
+// DEFAULT_OWNER owner of rules when SetOwner is not called
+const DEFAULT_OWNER = "default"
+
+// SetOwner set owner id tagged to rules added by this wrap
+func (t *IPTables) SetOwner(owner string) {
+	if owner == "" {
+		owner = DEFAULT_OWNER
+	}
+	t.owner = owner
+}
+
+// Owner owner id tagged to rules added by this wrap
+func (t *IPTables) Owner() string {
+	return t.owner
+}
+
+func (t *IPTables) ownerPrefix() string {
+	return OWNER_TAG_PREFIX + ":" + t.owner + ":"
+}
+
+// IsOwned assert rule carries ownership tag of this wrap
+func (t *IPTables) IsOwned(spec *RuleSpec) bool {
+	return strings.HasPrefix(spec.Comment(), t.ownerPrefix())
+}
+
+// tagRule add ownership comment to rule args, the rule id is a digest of
+// chain and normalized args so the same rule always gets the same tag,
+// rules already carrying a tag are kept as is
+func (t *IPTables) tagRule(chainName string, args []string) ([]string, error) {
+	spec, err := ParseRuleArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("parse rule [%s] failed: %v", FormatRuleSpec(args), err)
+	}
+	spec.Chain = chainName
+	return t.tagSpec(spec).Args(), nil
+}
+
+// tagSpec copy of spec with ownership comment
+func (t *IPTables) tagSpec(spec *RuleSpec) *RuleSpec {
+	if strings.HasPrefix(spec.Comment(), OWNER_TAG_PREFIX+":") {
+		return spec
+	}
+	sum := sha256.Sum256([]byte(spec.String()))
+	tagged := *spec
+	tagged.Matches = append(append([]*Match{}, spec.Matches...), &Match{
+		Name: "comment",
+		Options: []*Option{{
+			Name:   "--comment",
+			Values: []string{t.ownerPrefix() + hex.EncodeToString(sum[:4])},
+		}},
+	})
+	return &tagged
+}
+
+// ListOwnedRules list rules of table tagged by this wrap
+func (t *IPTables) ListOwnedRules(tableName string) ([]*RuleSpec, error) {
+	dump, err := t.Save(tableName)
+	if err != nil {
+		return nil, err
+	}
+	owned := make([]*RuleSpec, 0)
+	for _, chain := range dump.Chains {
+		for _, l := range dump.Rules[chain.Name] {
+			spec, err := ParseRuleSpec(l)
+			if err != nil {
+				return nil, fmt.Errorf("parse rule [%s] failed: %v", l, err)
+			}
+			if t.IsOwned(spec) {
+				owned = append(owned, spec)
+			}
+		}
+	}
+	return owned, nil
+}
+
+// PruneOwnedRules delete rules of table tagged by this wrap except the
+// ones equal to keep, rules of other owners are never touched
+func (t *IPTables) PruneOwnedRules(tableName string, keep []*RuleSpec) (int, error) {
+	owned, err := t.ListOwnedRules(tableName)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, spec := range owned {
+		kept := false
+		for _, k := range keep {
+			if t.tagSpec(k).Equal(spec) {
+				kept = true
+				break
+			}
+		}
+		if kept {
+			continue
+		}
+		if err = t.ruleOP(tableName, spec.Chain, RULE_DELETE, spec.Args()); err != nil {
+			return pruned, fmt.Errorf("prune rule [%s] failed: %v", spec, err)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
@@ -0,0 +1,278 @@
+package iptables
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+)
+
+// Ruleset iptables-restore ruleset, declared chains are flushed and
+// refilled as a whole by Restore while other chains are left untouched
+type Ruleset struct {
+	tables []*rulesetTable
+}
+
+type rulesetTable struct {
+	name   string
+	chains []string
+	rules  []string
+}
+
+// NewRuleset create empty ruleset
+func NewRuleset() *Ruleset {
+	return &Ruleset{tables: make([]*rulesetTable, 0)}
+}
+
+func (rs *Ruleset) table(name string) *rulesetTable {
+	for _, t := range rs.tables {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &rulesetTable{name: name}
+	rs.tables = append(rs.tables, t)
+	return t
+}
+
+// AddChain declare custom chain, it is created or flushed on restore
+func (rs *Ruleset) AddChain(tableName, chainName string) {
+	t := rs.table(tableName)
+	for _, c := range t.chains {
+		if c == chainName {
+			return
+		}
+	}
+	t.chains = append(t.chains, chainName)
+}
+
+// AppendRule append rule spec to chain
+func (rs *Ruleset) AppendRule(tableName, chainName string, spec []string) {
+	t := rs.table(tableName)
+	t.rules = append(t.rules, FormatRuleSpec(append([]string{"-A", chainName}, spec...)))
+}
+
+// InsertRule insert rule spec at the top of chain
+func (rs *Ruleset) InsertRule(tableName, chainName string, spec []string) {
+	t := rs.table(tableName)
+	t.rules = append(t.rules, FormatRuleSpec(append([]string{"-I", chainName}, spec...)))
+}
+
+// DeleteRule delete rule spec from chain
+func (rs *Ruleset) DeleteRule(tableName, chainName string, spec []string) {
+	t := rs.table(tableName)
+	t.rules = append(t.rules, FormatRuleSpec(append([]string{"-D", chainName}, spec...)))
+}
+
+// ChainRules appended rules of chain in iptables-save notation
+func (rs *Ruleset) ChainRules(tableName, chainName string) []string {
+	rules := make([]string, 0)
+	prefix := "-A " + chainName + " "
+	for _, t := range rs.tables {
+		if t.name != tableName {
+			continue
+		}
+		for _, rule := range t.rules {
+			if strings.HasPrefix(rule, prefix) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// Empty assert ruleset has no chain or rule
+func (rs *Ruleset) Empty() bool {
+	for _, t := range rs.tables {
+		if len(t.chains) > 0 || len(t.rules) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// String render ruleset in iptables-restore format
+func (rs *Ruleset) String() string {
+	var sb strings.Builder
+	for _, t := range rs.tables {
+		if len(t.chains) == 0 && len(t.rules) == 0 {
+			continue
+		}
+		sb.WriteString("*" + t.name + "\n")
+		for _, c := range t.chains {
+			sb.WriteString(":" + c + " - [0:0]\n")
+		}
+		for _, rule := range t.rules {
+			sb.WriteString(rule + "\n")
+		}
+		sb.WriteString("COMMIT\n")
+	}
+	return sb.String()
+}
+
+// TableDump iptables-save content of table
+type TableDump struct {
+	Name   string
+	Chains []*Chain
+	// Rules rules of chain in iptables-save notation
+	Rules map[string][]string
+}
+
+// Chain get chain of dump
+func (d *TableDump) Chain(name string) *Chain {
+	for _, c := range d.Chains {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// ParseSave parse iptables-save output
+func ParseSave(r io.Reader) ([]*TableDump, error) {
+	dumps := make([]*TableDump, 0)
+	var cur *TableDump
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		l := strings.TrimSpace(scanner.Text())
+		switch {
+		case l == "" || strings.HasPrefix(l, "#"):
+		case strings.HasPrefix(l, "*"):
+			cur = &TableDump{
+				Name:   l[1:],
+				Chains: make([]*Chain, 0),
+				Rules:  make(map[string][]string),
+			}
+			dumps = append(dumps, cur)
+		case cur == nil:
+			return nil, fmt.Errorf("parse iptables-save line [%d] failed: no table", n)
+		case l == "COMMIT":
+			cur = nil
+		case strings.HasPrefix(l, ":"):
+			parts := strings.Fields(l[1:])
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("parse iptables-save line [%d] failed: bad chain", n)
+			}
+			chain := &Chain{Name: parts[0]}
+			if parts[1] != "-" {
+				chain.Policy = parts[1]
+			}
+			cur.Chains = append(cur.Chains, chain)
+		case strings.HasPrefix(l, "-A "):
+			parts := strings.Fields(l)
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("parse iptables-save line [%d] failed: bad rule", n)
+			}
+			cur.Rules[parts[1]] = append(cur.Rules[parts[1]], l)
+		default:
+			return nil, fmt.Errorf("parse iptables-save line [%d] failed: unknow [%s]", n, l)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read iptables-save output failed: %v", err)
+	}
+	return dumps, nil
+}
+
+// FormatRuleSpec join rule arguments like iptables-save, arguments with
+// spaces are double quoted
+func FormatRuleSpec(args []string) string {
+	parts := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"") {
+			arg = "\"" + strings.ReplaceAll(arg, "\"", "\\\"") + "\""
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Save dump table with iptables-save
+func (t *IPTables) Save(tableName string) (*TableDump, error) {
+	path, err := t.toolPath("save")
+	if err != nil {
+		return nil, err
+	}
+	result, err := t.exec("iptables_save", path, []string{"-t", tableName}, "")
+	if err != nil {
+		return nil, err
+	}
+	dumps, err := ParseSave(strings.NewReader(result))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dumps {
+		if d.Name == tableName {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("table [%s] not found in iptables-save output", tableName)
+}
+
+// Restore apply ruleset atomically with iptables-restore --noflush, either
+// every table of ruleset is committed or nothing is changed
+func (t *IPTables) Restore(rs *Ruleset) error {
+	if rs.Empty() {
+		return nil
+	}
+	path, err := t.toolPath("restore")
+	if err != nil {
+		return err
+	}
+	if _, err = t.exec("iptables_restore", path, []string{"--noflush"},
+		rs.String()); err != nil {
+		return fmt.Errorf("restore iptables ruleset failed: %v", err)
+	}
+	return nil
+}
+
+// toolPath path of iptables-save or iptables-restore companion tool,
+// prefer the one next to iptables binary
+func (t *IPTables) toolPath(suffix string) (string, error) {
+	if path, err := t.runner.LookPath(t.iptablesPath + "-" + suffix); err == nil {
+		return path, nil
+	}
+	name := filepath.Base(t.iptablesPath) + "-" + suffix
+	path, err := t.runner.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("loop path [%s] failed: %s", name, err.Error())
+	}
+	return path, nil
+}
+
+// exec run iptables family tool with optional stdin
+func (t *IPTables) exec(name, path string, args []string, stdin string) (string, error) {
+	result, err := t.runner.Run(&rexec.Command{
+		Name:  name,
+		Path:  path,
+		Args:  args,
+		Stdin: stdin,
+	})
+	if err != nil {
+		if result == "" {
+			result = err.Error()
+		}
+		return "", &execError{name: name, output: result, err: err}
+	}
+	return result, nil
+}
+
+// execError failed iptables family tool, the runner error is kept so its
+// exit code can be checked with rexec.ExitCode
+type execError struct {
+	name   string
+	output string
+	err    error
+}
+
+func (e *execError) Error() string {
+	return fmt.Sprintf("exec iptables [%s] failed: %s", e.name, e.output)
+}
+
+// Unwrap unwrap runner error
+func (e *execError) Unwrap() error {
+	return e.err
+}
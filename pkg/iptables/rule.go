@@ -3,6 +3,8 @@ package iptables
 import (
 	"fmt"
 	"strconv"
+
+	"ntsc.ac.cn/ta-router/pkg/rexec"
 )
 
 // RuleOP iptables rule operate type
@@ -44,16 +46,31 @@ func (t *IPTables) ruleOP(tableName, chainName string, op RuleOP, args []string)
 	return nil
 }
 
-// AppendRule append iptables rule
+// ownedRuleOP operate rule tagged with ownership comment
+func (t *IPTables) ownedRuleOP(tableName, chainName string, op RuleOP, args []string) error {
+	args, err := t.tagRule(chainName, args)
+	if err != nil {
+		return err
+	}
+	return t.ruleOP(tableName, chainName, op, args)
+}
+
+// AppendRule append iptables rule tagged with ownership comment
 func (t *IPTables) AppendRule(tableName, chainName, action string, rule []string) error {
 	rule = append(rule, []string{"-j", action}...)
-	return t.ruleOP(tableName, chainName, RULE_APPEND, rule)
+	return t.ownedRuleOP(tableName, chainName, RULE_APPEND, rule)
 }
 
-// InsertRule insert iptables rule
+// InsertRule insert iptables rule tagged with ownership comment
 func (t *IPTables) InsertRule(tableName, chainName, action string, rule []string) error {
 	rule = append(rule, []string{"-j", action}...)
-	return t.ruleOP(tableName, chainName, RULE_INSERT, rule)
+	return t.ownedRuleOP(tableName, chainName, RULE_INSERT, rule)
+}
+
+// AppendRuleSpec append iptables rule with full rule spec, for targets
+// carrying options like SNAT --to-source
+func (t *IPTables) AppendRuleSpec(tableName, chainName string, spec []string) error {
+	return t.ownedRuleOP(tableName, chainName, RULE_APPEND, spec)
 }
 
 // DeleteRuleByIndex delete iptables rule by index
@@ -65,3 +82,37 @@ func (t *IPTables) DeleteRuleByIndex(tableName, chainName string, idx int) error
 func (t *IPTables) DeleteRule(tableName, chainName string, rule []string) error {
 	return t.ruleOP(tableName, chainName, RULE_DELETE, rule)
 }
+
+// DeleteOwnedRule delete iptables rule tagged with ownership comment
+func (t *IPTables) DeleteOwnedRule(tableName, chainName string, rule []string) error {
+	return t.ownedRuleOP(tableName, chainName, RULE_DELETE, rule)
+}
+
+// RuleExists assert iptables rule exist
+func (t *IPTables) RuleExists(tableName, chainName, action string, rule []string) (bool, error) {
+	rule = append(append([]string{}, rule...), []string{"-j", action}...)
+	return t.ruleCheck(tableName, chainName, rule)
+}
+
+// OwnedRuleExists assert iptables rule tagged with ownership comment exist
+func (t *IPTables) OwnedRuleExists(tableName, chainName, action string, rule []string) (bool, error) {
+	rule = append(append([]string{}, rule...), []string{"-j", action}...)
+	rule, err := t.tagRule(chainName, rule)
+	if err != nil {
+		return false, err
+	}
+	return t.ruleCheck(tableName, chainName, rule)
+}
+
+// ruleCheck check rule with iptables -C, which exits with 1 when no rule
+// matches
+func (t *IPTables) ruleCheck(tableName, chainName string, rule []string) (bool, error) {
+	args := append([]string{"-t", tableName, "-C", chainName}, rule...)
+	if _, err := t.iptablesExec("iptables_check", args); err != nil {
+		if rexec.ExitCode(err) == 1 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
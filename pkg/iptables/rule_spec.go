@@ -0,0 +1,310 @@
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Option iptables option with its values, like --dport 80
+type Option struct {
+	Name   string
+	Values []string
+	Negate bool
+}
+
+// args render option to arguments
+func (o *Option) args() []string {
+	args := make([]string, 0, len(o.Values)+2)
+	if o.Negate {
+		args = append(args, "!")
+	}
+	args = append(args, o.Name)
+	return append(args, o.Values...)
+}
+
+// Match match extension loaded by -m and its options
+type Match struct {
+	Name    string
+	Options []*Option
+}
+
+// Option get match option by name, nil when absent
+func (m *Match) Option(name string) *Option {
+	return findOption(m.Options, name)
+}
+
+// RuleSpec typed iptables rule parsed from iptables -S or iptables-save
+type RuleSpec struct {
+	Chain string
+	// Basic basic matches -s, -d, -i, -o, -p and -f
+	Basic   []*Option
+	Matches []*Match
+	Target  string
+	// Goto target is jumped by -g instead of -j
+	Goto          bool
+	TargetOptions []*Option
+}
+
+// basicOptions short names of basic matches by their long names
+var basicOptions = map[string]string{
+	"-s": "-s", "--source": "-s", "--src": "-s",
+	"-d": "-d", "--destination": "-d", "--dst": "-d",
+	"-i": "-i", "--in-interface": "-i",
+	"-o": "-o", "--out-interface": "-o",
+	"-p": "-p", "--protocol": "-p",
+	"-f": "-f", "--fragment": "-f",
+}
+
+// SplitRuleSpec split rule line to arguments, double quoted arguments
+// may contain spaces and escaped quotes
+func SplitRuleSpec(line string) ([]string, error) {
+	args := make([]string, 0)
+	var sb strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			sb.WriteRune(c)
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, sb.String())
+				sb.Reset()
+				inArg = false
+			}
+		default:
+			sb.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in rule [%s]", line)
+	}
+	if inArg {
+		args = append(args, sb.String())
+	}
+	return args, nil
+}
+
+// ParseRuleSpec parse rule line like "-A FORWARD -i wg0 -j ACCEPT", the
+// leading -A chain is optional
+func ParseRuleSpec(line string) (*RuleSpec, error) {
+	args, err := SplitRuleSpec(line)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRuleArgs(args)
+}
+
+// ParseRuleArgs parse rule arguments
+func ParseRuleArgs(args []string) (*RuleSpec, error) {
+	spec := &RuleSpec{}
+	if len(args) >= 2 && (args[0] == "-A" || args[0] == "--append") {
+		spec.Chain = args[1]
+		args = args[2:]
+	}
+	var match *Match
+	inTarget := false
+	negate := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "!" {
+			negate = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("unexpected argument [%s] in rule", arg)
+		}
+		values := make([]string, 0)
+		for i+1 < len(args) && args[i+1] != "!" && !strings.HasPrefix(args[i+1], "-") {
+			i++
+			values = append(values, args[i])
+		}
+		switch {
+		case arg == "-m" || arg == "--match":
+			if len(values) != 1 {
+				return nil, fmt.Errorf("match requires one name, got %v", values)
+			}
+			match = &Match{Name: values[0]}
+			spec.Matches = append(spec.Matches, match)
+			inTarget = false
+		case arg == "-j" || arg == "--jump" || arg == "-g" || arg == "--goto":
+			if len(values) != 1 {
+				return nil, fmt.Errorf("target requires one name, got %v", values)
+			}
+			spec.Target = values[0]
+			spec.Goto = arg == "-g" || arg == "--goto"
+			inTarget = true
+		case basicOptions[arg] != "":
+			spec.Basic = append(spec.Basic, &Option{
+				Name: basicOptions[arg], Values: values, Negate: negate})
+			match = nil
+		case inTarget:
+			spec.TargetOptions = append(spec.TargetOptions, &Option{
+				Name: arg, Values: values, Negate: negate})
+		case match != nil:
+			match.Options = append(match.Options, &Option{
+				Name: arg, Values: values, Negate: negate})
+		default:
+			return nil, fmt.Errorf("option [%s] outside of match or target", arg)
+		}
+		negate = false
+	}
+	if negate {
+		return nil, fmt.Errorf("dangling negation in rule")
+	}
+	return spec, nil
+}
+
+// Args render rule to arguments without chain
+func (r *RuleSpec) Args() []string {
+	args := make([]string, 0)
+	for _, o := range r.Basic {
+		args = append(args, o.args()...)
+	}
+	for _, m := range r.Matches {
+		args = append(args, "-m", m.Name)
+		for _, o := range m.Options {
+			args = append(args, o.args()...)
+		}
+	}
+	if r.Target != "" {
+		if r.Goto {
+			args = append(args, "-g", r.Target)
+		} else {
+			args = append(args, "-j", r.Target)
+		}
+		for _, o := range r.TargetOptions {
+			args = append(args, o.args()...)
+		}
+	}
+	return args
+}
+
+// String render rule in iptables-save notation
+func (r *RuleSpec) String() string {
+	return FormatRuleSpec(append([]string{"-A", r.Chain}, r.Args()...))
+}
+
+// Equal assert two rules have the same chain, matches and target
+func (r *RuleSpec) Equal(o *RuleSpec) bool {
+	return r.String() == o.String()
+}
+
+// Match get match extension by name, nil when absent
+func (r *RuleSpec) Match(name string) *Match {
+	for _, m := range r.Matches {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (r *RuleSpec) basic(name string) string {
+	if o := findOption(r.Basic, name); o != nil && len(o.Values) > 0 {
+		return o.Values[0]
+	}
+	return ""
+}
+
+// Source source address match
+func (r *RuleSpec) Source() string {
+	return r.basic("-s")
+}
+
+// Destination destination address match
+func (r *RuleSpec) Destination() string {
+	return r.basic("-d")
+}
+
+// InIface in interface match
+func (r *RuleSpec) InIface() string {
+	return r.basic("-i")
+}
+
+// OutIface out interface match
+func (r *RuleSpec) OutIface() string {
+	return r.basic("-o")
+}
+
+// Protocol protocol match
+func (r *RuleSpec) Protocol() string {
+	return r.basic("-p")
+}
+
+// Comment comment of rule, empty when absent
+func (r *RuleSpec) Comment() string {
+	if m := r.Match("comment"); m != nil {
+		if o := m.Option("--comment"); o != nil && len(o.Values) > 0 {
+			return o.Values[0]
+		}
+	}
+	return ""
+}
+
+// TargetOption get target option by name, nil when absent
+func (r *RuleSpec) TargetOption(name string) *Option {
+	return findOption(r.TargetOptions, name)
+}
+
+func findOption(options []*Option, name string) *Option {
+	for _, o := range options {
+		if o.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// ListRuleSpecs list typed rules of chain from iptables -S
+func (t *IPTables) ListRuleSpecs(tableName, chainName string) ([]*RuleSpec, error) {
+	result, err := t.iptablesExec("iptables_list_specs",
+		[]string{"-t", tableName, "-S", chainName})
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]*RuleSpec, 0)
+	for _, l := range strings.Split(result, "\n") {
+		if !strings.HasPrefix(l, "-A ") {
+			continue
+		}
+		spec, err := ParseRuleSpec(strings.TrimSpace(l))
+		if err != nil {
+			return nil, fmt.Errorf("parse rule [%s] failed: %v", l, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// RuleSpecExists assert rule owned by this wrap with exactly the same
+// matches and target exists in its chain
+func (t *IPTables) RuleSpecExists(tableName string, spec *RuleSpec) (bool, error) {
+	spec = t.tagSpec(spec)
+	specs, err := t.ListRuleSpecs(tableName, spec.Chain)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range specs {
+		if s.Equal(spec) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteRuleSpec delete rule owned by this wrap by spec, absent rule is
+// ignored
+func (t *IPTables) DeleteRuleSpec(tableName string, spec *RuleSpec) error {
+	exist, err := t.RuleSpecExists(tableName, spec)
+	if err != nil || !exist {
+		return err
+	}
+	return t.ruleOP(tableName, spec.Chain, RULE_DELETE, t.tagSpec(spec).Args())
+}
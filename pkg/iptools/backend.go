@@ -0,0 +1,123 @@
+package iptools
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	// ErrExist link, address or route already exists
+	ErrExist = errors.New("already exists")
+	// ErrNotExist link, address or route not exists
+	ErrNotExist = errors.New("not exists")
+)
+
+// Backend ip tools implementation
+type Backend interface {
+	// Name backend name
+	Name() string
+	AddLink(name, linkType string) error
+	DeleteLink(name string) error
+	// SetLinkUp set link up, mtu is not changed when zero
+	SetLinkUp(name string, mtu int) error
+	AddAddress(addr, dev string) error
+	DeleteAddress(addr, dev string) error
+	FlushAddresses(dev string) error
+	ListAddresses(dev string) ([]string, error)
+	AddRoute(cidr, dev, table string) error
+	AddDefaultRoute(gw, dev string) error
+	DeleteRoute(cidr, dev, table string) error
+	ReplaceRoute(cidr, dev, table string) error
+	ListRoutes(table string) ([]*Route, error)
+	AddRule(rule *Rule) error
+	DeleteRule(rule *Rule) error
+	ListRules() ([]*Rule, error)
+}
+
+// OpError ip tools operate error
+type OpError struct {
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return e.Op + " failed: " + e.Err.Error()
+}
+
+// Unwrap unwrap cause error, which may be ErrExist or ErrNotExist
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// IsExist assert error caused by object already exists
+func IsExist(err error) bool {
+	return errors.Is(err, ErrExist)
+}
+
+// IsNotExist assert error caused by object not exists
+func IsNotExist(err error) bool {
+	return errors.Is(err, ErrNotExist)
+}
+
+const (
+	// FAMILY_INET ipv4 address family
+	FAMILY_INET = "inet"
+	// FAMILY_INET6 ipv6 address family
+	FAMILY_INET6 = "inet6"
+)
+
+// Route linux route information
+type Route struct {
+	Family string
+	Type   string
+	Dst    string
+	Via    string
+	Dev    string
+	Table  string
+	Proto  string
+}
+
+// Network route destination in cidr notation
+func (r *Route) Network() string {
+	if r.Dst == "default" {
+		if r.Family == FAMILY_INET6 {
+			return "::/0"
+		}
+		return "0.0.0.0/0"
+	}
+	_, ipnet, err := net.ParseCIDR(normalizeAddr(r.Dst))
+	if err != nil {
+		return r.Dst
+	}
+	return ipnet.String()
+}
+
+// AddrFamily address family of address or cidr
+func AddrFamily(addr string) string {
+	if strings.Contains(addr, ":") {
+		return FAMILY_INET6
+	}
+	return FAMILY_INET
+}
+
+// normalizeAddr append host prefix length to address without one
+func normalizeAddr(addr string) string {
+	if strings.Contains(addr, "/") {
+		return addr
+	}
+	if AddrFamily(addr) == FAMILY_INET6 {
+		return addr + "/128"
+	}
+	return addr + "/32"
+}
+
+// sameNetwork assert two route destinations are the same network
+func sameNetwork(a, b string) bool {
+	_, an, aerr := net.ParseCIDR(normalizeAddr(a))
+	_, bn, berr := net.ParseCIDR(normalizeAddr(b))
+	if aerr != nil || berr != nil {
+		return false
+	}
+	return an.String() == bn.String()
+}
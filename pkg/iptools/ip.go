@@ -2,101 +2,165 @@ package iptools
 
 import (
 	"fmt"
-	"os/exec"
+	"io"
 
+	"github.com/sirupsen/logrus"
 	"ntsc.ac.cn/ta-router/pkg/rexec"
 )
 
 // IPTools linux ip tools
 type IPTools struct {
 	ipToolsPath string
+	backend     Backend
 }
 
+// NewIPTools create ip tools, netlink backend is preferred and ip
+// command backend is used as fallback
 func NewIPTools(ipToolsPath string) (*IPTools, error) {
-	if ipToolsPath == "" {
-		ipToolsPath = "ip"
+	return NewIPToolsWithRunner(ipToolsPath, rexec.DefaultRunner)
+}
+
+// NewIPToolsWithRunner create ip tools like NewIPTools, the ip command
+// backend runs ip with runner
+func NewIPToolsWithRunner(ipToolsPath string, runner rexec.Runner) (*IPTools, error) {
+	nb, nerr := NewNetlinkBackend()
+	if nerr == nil {
+		t := NewIPToolsWithBackend(nb)
+		if eb, err := NewExecBackendWithRunner(ipToolsPath, runner); err == nil {
+			t.ipToolsPath = eb.ipToolsPath
+		}
+		return t, nil
 	}
-	var err error
-	if ipToolsPath, err = exec.LookPath(ipToolsPath); err != nil {
-		return nil, fmt.Errorf("loop path [%s] failed: %v", ipToolsPath, err)
+	eb, err := NewExecBackendWithRunner(ipToolsPath, runner)
+	if err != nil {
+		return nil, fmt.Errorf("create netlink backend failed: %v, %v", nerr, err)
 	}
-	return &IPTools{ipToolsPath: ipToolsPath}, nil
+	logrus.WithField("prefix", "iptools").
+		Warnf("create netlink backend failed: %v, fallback to [%s]", nerr, eb.ipToolsPath)
+	t := NewIPToolsWithBackend(eb)
+	t.ipToolsPath = eb.ipToolsPath
+	return t, nil
+}
+
+// NewIPToolsWithBackend create ip tools with backend
+func NewIPToolsWithBackend(backend Backend) *IPTools {
+	return &IPTools{backend: backend}
+}
+
+// Backend name of backend in use
+func (t *IPTools) Backend() string {
+	return t.backend.Name()
 }
 
 // DeleteLink delete link
 func (t *IPTools) DeleteLink(name string) error {
-	exe, err := rexec.NewExecuter("ip",
-		t.ipToolsPath, []string{"link", "del", name})
-	if err != nil {
-		return fmt.Errorf(
-			"del link [%s] failed: %v", name, err)
-	}
-	if _, err = exe.Run(); err != nil {
-		return fmt.Errorf(
-			"del link [%s] failed: %v", name, err)
+	return t.backend.DeleteLink(name)
+}
+
+// AddLink add link with type
+func (t *IPTools) AddLink(name, linkType string) error {
+	return t.backend.AddLink(name, linkType)
+}
+
+// SetLinkUp set link mtu and up
+func (t *IPTools) SetLinkUp(name string, mtu int) error {
+	return t.backend.SetLinkUp(name, mtu)
+}
+
+// AddRouteToDev add route to dev, main table when table is empty
+func (t *IPTools) AddRouteToDev(cidr, dev, table string) error {
+	return t.backend.AddRoute(cidr, dev, table)
+}
+
+// AddDefaultRoute add default route via gateway
+func (t *IPTools) AddDefaultRoute(gw, dev string) error {
+	return t.backend.AddDefaultRoute(gw, dev)
+}
+
+// AddAddress add ipv4 or ipv6 address to dev
+func (t *IPTools) AddAddress(addr, dev string) error {
+	return t.backend.AddAddress(addr, dev)
+}
+
+// AddIPv4Address add ip address to dev
+//
+// Deprecated: use AddAddress, which supports ipv6 too
+func (t *IPTools) AddIPv4Address(addr, dev string) error {
+	return t.AddAddress(addr, dev)
+}
+
+// ListAddresses list ip addresses of dev
+func (t *IPTools) ListAddresses(dev string) ([]string, error) {
+	return t.backend.ListAddresses(dev)
+}
+
+// FlushAddresses remove all ip addresses of dev
+func (t *IPTools) FlushAddresses(dev string) error {
+	return t.backend.FlushAddresses(dev)
+}
+
+// ListRoutes list ipv4 and ipv6 routes of table, main table when table is empty
+func (t *IPTools) ListRoutes(table string) ([]*Route, error) {
+	return t.backend.ListRoutes(table)
+}
+
+// DeleteAddress delete ip address from dev, absent address is not an error
+func (t *IPTools) DeleteAddress(addr, dev string) error {
+	if err := t.backend.DeleteAddress(addr, dev); err != nil && !IsNotExist(err) {
+		return err
 	}
 	return nil
 }
 
-func (t *IPTools) AddLink(name, linkType string) error {
-	exe, err := rexec.NewExecuter("ip",
-		t.ipToolsPath, []string{"link", "add", "dev", name, "type", linkType})
-	if err != nil {
-		return fmt.Errorf(
-			"add link [%s] with type [%s] failed: %v", name, linkType, err)
+// DeleteRoute delete route of dev, absent route is not an error
+func (t *IPTools) DeleteRoute(cidr, dev, table string) error {
+	if err := t.backend.DeleteRoute(cidr, dev, table); err != nil && !IsNotExist(err) {
+		return err
 	}
-	if _, err = exe.Run(); err != nil {
-		return fmt.Errorf(
-			"add link [%s] with type [%s] failed: %v", name, linkType, err)
+	return nil
+}
+
+// ReplaceRoute add route to dev or replace the route with same destination
+func (t *IPTools) ReplaceRoute(cidr, dev, table string) error {
+	return t.backend.ReplaceRoute(cidr, dev, table)
+}
+
+// EnsureAddress add ip address to dev, present address is not an error
+func (t *IPTools) EnsureAddress(addr, dev string) error {
+	if err := t.backend.AddAddress(addr, dev); err != nil && !IsExist(err) {
+		return err
 	}
 	return nil
 }
 
-func (t *IPTools) AddRouteToDev(cidr, dev, table string) error {
-	args := make([]string, 0)
-	args = append(args, "route")
-	args = append(args, "add")
-	args = append(args, cidr)
-	args = append(args, "dev")
-	args = append(args, dev)
-	if table != "" {
-		args = append(args, "table")
-		args = append(args, table)
+// EnsureRoute add route to dev, present route to the same dev is not an
+// error, route with same destination to other dev is reported as ErrExist
+func (t *IPTools) EnsureRoute(cidr, dev, table string) error {
+	err := t.backend.AddRoute(cidr, dev, table)
+	if err == nil || !IsExist(err) {
+		return err
 	}
-	exe, err := rexec.NewExecuter("ip",
-		t.ipToolsPath, args)
-	if err != nil {
-		return fmt.Errorf(
-			"add route failed: %v", err)
+	routes, lerr := t.backend.ListRoutes(table)
+	if lerr != nil {
+		return lerr
 	}
-	if _, err = exe.Run(); err != nil {
-		return fmt.Errorf(
-			"add route failed: %v", err)
+	for _, route := range routes {
+		if route.Dev == dev && sameNetwork(route.Network(), cidr) {
+			return nil
+		}
 	}
-	return nil
+	return err
 }
 
-func (t *IPTools) AddIPv4Address(addr, dev string) error {
-	args := make([]string, 0)
-	args = append(args, "-4")
-	args = append(args, "address")
-	args = append(args, "add")
-	args = append(args, addr)
-	args = append(args, "dev")
-	args = append(args, dev)
-	exe, err := rexec.NewExecuter("ip",
-		t.ipToolsPath, args)
-	if err != nil {
-		return fmt.Errorf(
-			"add ip v4 address failed: %v", err)
-	}
-	if _, err = exe.Run(); err != nil {
-		return fmt.Errorf(
-			"add ip v4 failed: %v", err)
+// Close release backend, the rtnetlink connection is closed
+func (t *IPTools) Close() error {
+	if c, ok := t.backend.(io.Closer); ok {
+		return c.Close()
 	}
 	return nil
 }
 
+// IPToolsPath ip command path, empty when ip command not found
 func (t *IPTools) IPToolsPath() string {
 	return t.ipToolsPath
 }
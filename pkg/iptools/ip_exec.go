@@ -0,0 +1,328 @@
+package iptools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+)
+
+// ExecBackend ip tools backend with ip command
+type ExecBackend struct {
+	ipToolsPath string
+	runner      rexec.Runner
+}
+
+// NewExecBackend create ip command backend
+func NewExecBackend(ipToolsPath string) (*ExecBackend, error) {
+	return NewExecBackendWithRunner(ipToolsPath, rexec.DefaultRunner)
+}
+
+// NewExecBackendWithRunner create ip command backend running ip with runner
+func NewExecBackendWithRunner(ipToolsPath string, runner rexec.Runner) (*ExecBackend, error) {
+	if ipToolsPath == "" {
+		ipToolsPath = "ip"
+	}
+	var err error
+	if ipToolsPath, err = runner.LookPath(ipToolsPath); err != nil {
+		return nil, fmt.Errorf("loop path [%s] failed: %v", ipToolsPath, err)
+	}
+	return &ExecBackend{ipToolsPath: ipToolsPath, runner: runner}, nil
+}
+
+// Name backend name
+func (b *ExecBackend) Name() string {
+	return "exec"
+}
+
+// ipExec run ip command, output of failed command is mapped to typed error
+func (b *ExecBackend) ipExec(op string, args []string) (string, error) {
+	result, err := b.runner.Run(&rexec.Command{
+		Name: "ip",
+		Path: b.ipToolsPath,
+		Args: args,
+		// error output is matched by execError, keep it untranslated
+		Env: []string{"LC_ALL=C"},
+	})
+	if err != nil {
+		return "", &OpError{Op: op, Err: execError(result, err)}
+	}
+	return result, nil
+}
+
+// execError map ip command error output to typed error
+func execError(result string, err error) error {
+	if result == "" {
+		result = err.Error()
+	}
+	switch {
+	case strings.Contains(result, "File exists"),
+		strings.Contains(result, "already assigned"):
+		return fmt.Errorf("%w: %s", ErrExist, result)
+	case strings.Contains(result, "Cannot find device"),
+		strings.Contains(result, "No such device"),
+		strings.Contains(result, "No such process"),
+		strings.Contains(result, "Cannot assign requested address"),
+		strings.Contains(result, "Address not found"),
+		strings.Contains(result, "No such file or directory"):
+		return fmt.Errorf("%w: %s", ErrNotExist, result)
+	}
+	return fmt.Errorf("%s", result)
+}
+
+func (b *ExecBackend) DeleteLink(name string) error {
+	_, err := b.ipExec(fmt.Sprintf("del link [%s]", name),
+		[]string{"link", "del", name})
+	return err
+}
+
+func (b *ExecBackend) AddLink(name, linkType string) error {
+	_, err := b.ipExec(fmt.Sprintf("add link [%s] with type [%s]", name, linkType),
+		[]string{"link", "add", "dev", name, "type", linkType})
+	return err
+}
+
+func (b *ExecBackend) SetLinkUp(name string, mtu int) error {
+	args := []string{"link", "set"}
+	if mtu > 0 {
+		args = append(args, "mtu")
+		args = append(args, fmt.Sprint(mtu))
+	}
+	args = append(args, "up")
+	args = append(args, "dev")
+	args = append(args, name)
+	_, err := b.ipExec(fmt.Sprintf("set link [%s] up", name), args)
+	return err
+}
+
+func (b *ExecBackend) AddRoute(cidr, dev, table string) error {
+	args := make([]string, 0)
+	args = append(args, "route")
+	args = append(args, "add")
+	args = append(args, cidr)
+	args = append(args, "dev")
+	args = append(args, dev)
+	if table != "" {
+		args = append(args, "table")
+		args = append(args, table)
+	}
+	_, err := b.ipExec(fmt.Sprintf("add route [%s] to dev [%s]", cidr, dev), args)
+	return err
+}
+
+func (b *ExecBackend) ReplaceRoute(cidr, dev, table string) error {
+	args := []string{"route", "replace", cidr, "dev", dev}
+	if table != "" {
+		args = append(args, "table")
+		args = append(args, table)
+	}
+	_, err := b.ipExec(fmt.Sprintf("replace route [%s] to dev [%s]", cidr, dev), args)
+	return err
+}
+
+func (b *ExecBackend) AddDefaultRoute(gw, dev string) error {
+	_, err := b.ipExec(fmt.Sprintf("add default route via [%s] dev [%s]", gw, dev),
+		[]string{"route", "add", "default", "via", gw, "dev", dev})
+	return err
+}
+
+func (b *ExecBackend) DeleteRoute(cidr, dev, table string) error {
+	args := []string{"route", "del", cidr, "dev", dev}
+	if table != "" {
+		args = append(args, "table")
+		args = append(args, table)
+	}
+	_, err := b.ipExec(fmt.Sprintf("del route [%s] from dev [%s]", cidr, dev), args)
+	return err
+}
+
+func (b *ExecBackend) AddAddress(addr, dev string) error {
+	args := make([]string, 0)
+	if AddrFamily(addr) == FAMILY_INET6 {
+		args = append(args, "-6")
+	} else {
+		args = append(args, "-4")
+	}
+	args = append(args, "address")
+	args = append(args, "add")
+	args = append(args, addr)
+	args = append(args, "dev")
+	args = append(args, dev)
+	_, err := b.ipExec(fmt.Sprintf("add address [%s] to dev [%s]", addr, dev), args)
+	return err
+}
+
+func (b *ExecBackend) DeleteAddress(addr, dev string) error {
+	_, err := b.ipExec(fmt.Sprintf("del address [%s] from dev [%s]", addr, dev),
+		[]string{"address", "del", addr, "dev", dev})
+	return err
+}
+
+func (b *ExecBackend) FlushAddresses(dev string) error {
+	_, err := b.ipExec(fmt.Sprintf("flush dev [%s] address", dev),
+		[]string{"address", "flush", "dev", dev})
+	return err
+}
+
+func (b *ExecBackend) ListAddresses(dev string) ([]string, error) {
+	result, err := b.ipExec(fmt.Sprintf("list dev [%s] address", dev),
+		[]string{"-o", "address", "show", "dev", dev})
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0)
+	for _, l := range strings.Split(result, "\n") {
+		fields := strings.Fields(l)
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] == "inet" || fields[i] == "inet6" {
+				addrs = append(addrs, fields[i+1])
+				break
+			}
+		}
+	}
+	return addrs, nil
+}
+
+var routeTypes = map[string]bool{
+	"unicast": true, "local": true, "broadcast": true, "multicast": true,
+	"throw": true, "unreachable": true, "prohibit": true, "blackhole": true,
+	"nat": true, "anycast": true,
+}
+
+func (b *ExecBackend) ListRoutes(table string) ([]*Route, error) {
+	routes := make([]*Route, 0)
+	for _, family := range []string{FAMILY_INET, FAMILY_INET6} {
+		args := []string{"-4", "route", "show"}
+		if family == FAMILY_INET6 {
+			args[0] = "-6"
+		}
+		if table != "" {
+			args = append(args, "table")
+			args = append(args, table)
+		}
+		result, err := b.ipExec("list route", args)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, parseRoutes(result, family, table)...)
+	}
+	return routes, nil
+}
+
+// parseRoutes parse ip route show output
+func parseRoutes(result, family, table string) []*Route {
+	routes := make([]*Route, 0)
+	for _, l := range strings.Split(result, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		route := &Route{Family: family, Type: "unicast", Table: table}
+		if routeTypes[fields[0]] {
+			route.Type = fields[0]
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		route.Dst = fields[0]
+		for i := 1; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "via":
+				route.Via = fields[i+1]
+			case "dev":
+				route.Dev = fields[i+1]
+			case "table":
+				route.Table = fields[i+1]
+			case "proto":
+				route.Proto = fields[i+1]
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+func (b *ExecBackend) ruleOP(op, action string, rule *Rule) error {
+	args := []string{"-4", "rule", action}
+	if rule.family() == FAMILY_INET6 {
+		args[0] = "-6"
+	}
+	args = append(args, rule.args()...)
+	_, err := b.ipExec(fmt.Sprintf("%s rule [%s]", op, rule), args)
+	return err
+}
+
+func (b *ExecBackend) AddRule(rule *Rule) error {
+	return b.ruleOP("add", "add", rule)
+}
+
+func (b *ExecBackend) DeleteRule(rule *Rule) error {
+	return b.ruleOP("del", "del", rule)
+}
+
+func (b *ExecBackend) ListRules() ([]*Rule, error) {
+	rules := make([]*Rule, 0)
+	for _, family := range []string{FAMILY_INET, FAMILY_INET6} {
+		args := []string{"-4", "rule", "show"}
+		if family == FAMILY_INET6 {
+			args[0] = "-6"
+		}
+		result, err := b.ipExec("list rule", args)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseRules(result, family)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, parsed...)
+	}
+	return rules, nil
+}
+
+// parseRules parse ip rule show output
+func parseRules(result, family string) ([]*Rule, error) {
+	rules := make([]*Rule, 0)
+	for _, l := range strings.Split(result, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		prio, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			return nil, fmt.Errorf("parse rule priority [%s] failed: %v", fields[0], err)
+		}
+		rule := &Rule{Family: family, Priority: prio}
+		for i := 1; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "from":
+				if fields[i+1] != "all" {
+					rule.From = fields[i+1]
+				}
+			case "to":
+				rule.To = fields[i+1]
+			case "iif":
+				rule.Iif = fields[i+1]
+			case "lookup", "table":
+				rule.Table = fields[i+1]
+			case "fwmark":
+				mark := strings.SplitN(fields[i+1], "/", 2)
+				v, err := strconv.ParseUint(mark[0], 0, 32)
+				if err != nil {
+					return nil, fmt.Errorf("parse rule fwmark [%s] failed: %v", fields[i+1], err)
+				}
+				rule.Fwmark = uint32(v)
+				if len(mark) == 2 {
+					if v, err = strconv.ParseUint(mark[1], 0, 32); err != nil {
+						return nil, fmt.Errorf("parse rule fwmask [%s] failed: %v", fields[i+1], err)
+					}
+					rule.FwMask = uint32(v)
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
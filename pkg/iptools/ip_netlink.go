@@ -0,0 +1,573 @@
+//go:build linux
+
+package iptools
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// NetlinkBackend ip tools backend with rtnetlink
+type NetlinkBackend struct {
+	conn *netlink.Conn
+}
+
+// NewNetlinkBackend create rtnetlink backend
+func NewNetlinkBackend() (*NetlinkBackend, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial rtnetlink failed: %v", err)
+	}
+	return &NetlinkBackend{conn: conn}, nil
+}
+
+// Name backend name
+func (b *NetlinkBackend) Name() string {
+	return "netlink"
+}
+
+// Close close rtnetlink connection
+func (b *NetlinkBackend) Close() error {
+	return b.conn.Close()
+}
+
+// netlinkError map errno to typed error
+func netlinkError(op string, err error) error {
+	switch {
+	case errors.Is(err, unix.EEXIST):
+		err = fmt.Errorf("%w: %v", ErrExist, err)
+	case errors.Is(err, unix.ENODEV),
+		errors.Is(err, unix.ESRCH),
+		errors.Is(err, unix.EADDRNOTAVAIL),
+		errors.Is(err, unix.ENOENT):
+		err = fmt.Errorf("%w: %v", ErrNotExist, err)
+	}
+	return &OpError{Op: op, Err: err}
+}
+
+func (b *NetlinkBackend) execute(op string, typ uint16, flags netlink.HeaderFlags, data []byte) ([]netlink.Message, error) {
+	msgs, err := b.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(typ),
+			Flags: netlink.Request | flags,
+		},
+		Data: data,
+	})
+	if err != nil {
+		return nil, netlinkError(op, err)
+	}
+	return msgs, nil
+}
+
+// linkIndex get link index with name
+func linkIndex(op, name string) (uint32, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, &OpError{Op: op, Err: fmt.Errorf("%w: %v", ErrNotExist, err)}
+	}
+	return uint32(ifi.Index), nil
+}
+
+// ifInfoMsg struct ifinfomsg
+func ifInfoMsg(index uint32, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	nlenc.PutInt32(b[4:8], int32(index))
+	nlenc.PutUint32(b[8:12], flags)
+	nlenc.PutUint32(b[12:16], change)
+	return b
+}
+
+// ifAddrMsg struct ifaddrmsg
+func ifAddrMsg(family, prefixLen uint8, index uint32) []byte {
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = prefixLen
+	nlenc.PutUint32(b[4:8], index)
+	return b
+}
+
+// rtMsg struct rtmsg
+type rtMsg struct {
+	Family   uint8
+	DstLen   uint8
+	SrcLen   uint8
+	Tos      uint8
+	Table    uint8
+	Protocol uint8
+	Scope    uint8
+	Type     uint8
+	Flags    uint32
+}
+
+func (m *rtMsg) marshal() []byte {
+	b := make([]byte, unix.SizeofRtMsg)
+	b[0], b[1], b[2], b[3] = m.Family, m.DstLen, m.SrcLen, m.Tos
+	b[4], b[5], b[6], b[7] = m.Table, m.Protocol, m.Scope, m.Type
+	nlenc.PutUint32(b[8:12], m.Flags)
+	return b
+}
+
+func (m *rtMsg) unmarshal(b []byte) error {
+	if len(b) < unix.SizeofRtMsg {
+		return fmt.Errorf("rtmsg size [%d] too short", len(b))
+	}
+	m.Family, m.DstLen, m.SrcLen, m.Tos = b[0], b[1], b[2], b[3]
+	m.Table, m.Protocol, m.Scope, m.Type = b[4], b[5], b[6], b[7]
+	m.Flags = nlenc.Uint32(b[8:12])
+	return nil
+}
+
+// parsePrefix parse address or cidr into ip, family and prefix length
+func parsePrefix(cidr string) (net.IP, *net.IPNet, uint8, error) {
+	ip, ipnet, err := net.ParseCIDR(normalizeAddr(cidr))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	family := uint8(unix.AF_INET6)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		ipnet.IP = ipnet.IP.To4()
+		family = unix.AF_INET
+	}
+	return ip, ipnet, family, nil
+}
+
+func (b *NetlinkBackend) AddLink(name, linkType string) error {
+	op := fmt.Sprintf("add link [%s] with type [%s]", name, linkType)
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.IFLA_IFNAME, name)
+	ae.Nested(unix.IFLA_LINKINFO, func(nae *netlink.AttributeEncoder) error {
+		nae.String(unix.IFLA_INFO_KIND, linkType)
+		return nil
+	})
+	attrs, err := ae.Encode()
+	if err != nil {
+		return &OpError{Op: op, Err: err}
+	}
+	_, err = b.execute(op, unix.RTM_NEWLINK,
+		netlink.Acknowledge|netlink.Create|netlink.Excl,
+		append(ifInfoMsg(0, 0, 0), attrs...))
+	return err
+}
+
+func (b *NetlinkBackend) DeleteLink(name string) error {
+	op := fmt.Sprintf("del link [%s]", name)
+	idx, err := linkIndex(op, name)
+	if err != nil {
+		return err
+	}
+	_, err = b.execute(op, unix.RTM_DELLINK, netlink.Acknowledge,
+		ifInfoMsg(idx, 0, 0))
+	return err
+}
+
+func (b *NetlinkBackend) SetLinkUp(name string, mtu int) error {
+	op := fmt.Sprintf("set link [%s] up", name)
+	idx, err := linkIndex(op, name)
+	if err != nil {
+		return err
+	}
+	data := ifInfoMsg(idx, unix.IFF_UP, unix.IFF_UP)
+	if mtu > 0 {
+		ae := netlink.NewAttributeEncoder()
+		ae.Uint32(unix.IFLA_MTU, uint32(mtu))
+		attrs, err := ae.Encode()
+		if err != nil {
+			return &OpError{Op: op, Err: err}
+		}
+		data = append(data, attrs...)
+	}
+	_, err = b.execute(op, unix.RTM_NEWLINK, netlink.Acknowledge, data)
+	return err
+}
+
+func (b *NetlinkBackend) addrOP(op string, typ uint16, flags netlink.HeaderFlags, addr, dev string) error {
+	idx, err := linkIndex(op, dev)
+	if err != nil {
+		return err
+	}
+	ip, ipnet, family, err := parsePrefix(addr)
+	if err != nil {
+		return &OpError{Op: op, Err: err}
+	}
+	ones, _ := ipnet.Mask.Size()
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.IFA_LOCAL, ip)
+	ae.Bytes(unix.IFA_ADDRESS, ip)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return &OpError{Op: op, Err: err}
+	}
+	_, err = b.execute(op, typ, flags,
+		append(ifAddrMsg(family, uint8(ones), idx), attrs...))
+	return err
+}
+
+func (b *NetlinkBackend) AddAddress(addr, dev string) error {
+	return b.addrOP(fmt.Sprintf("add address [%s] to dev [%s]", addr, dev),
+		unix.RTM_NEWADDR, netlink.Acknowledge|netlink.Create|netlink.Excl, addr, dev)
+}
+
+func (b *NetlinkBackend) DeleteAddress(addr, dev string) error {
+	return b.addrOP(fmt.Sprintf("del address [%s] from dev [%s]", addr, dev),
+		unix.RTM_DELADDR, netlink.Acknowledge, addr, dev)
+}
+
+func (b *NetlinkBackend) FlushAddresses(dev string) error {
+	addrs, err := b.ListAddresses(dev)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err = b.DeleteAddress(addr, dev); err != nil && !IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *NetlinkBackend) ListAddresses(dev string) ([]string, error) {
+	op := fmt.Sprintf("list dev [%s] address", dev)
+	idx, err := linkIndex(op, dev)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := b.execute(op, unix.RTM_GETADDR, netlink.Dump,
+		ifAddrMsg(unix.AF_UNSPEC, 0, 0))
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0)
+	for _, m := range msgs {
+		if len(m.Data) < unix.SizeofIfAddrmsg ||
+			nlenc.Uint32(m.Data[4:8]) != idx {
+			continue
+		}
+		prefixLen := m.Data[1]
+		ad, err := netlink.NewAttributeDecoder(m.Data[unix.SizeofIfAddrmsg:])
+		if err != nil {
+			return nil, &OpError{Op: op, Err: err}
+		}
+		var local, address net.IP
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.IFA_LOCAL:
+				local = net.IP(ad.Bytes())
+			case unix.IFA_ADDRESS:
+				address = net.IP(ad.Bytes())
+			}
+		}
+		if err = ad.Err(); err != nil {
+			return nil, &OpError{Op: op, Err: err}
+		}
+		if local == nil {
+			local = address
+		}
+		if local != nil {
+			addrs = append(addrs, fmt.Sprintf("%s/%d", local.String(), prefixLen))
+		}
+	}
+	return addrs, nil
+}
+
+// routeOP build and execute route message
+func (b *NetlinkBackend) routeOP(op string, typ uint16, flags netlink.HeaderFlags,
+	cidr, gw, dev, table string) error {
+	_, ipnet, family, err := parsePrefix(cidr)
+	if err != nil {
+		return &OpError{Op: op, Err: err}
+	}
+	tableID, err := parseTable(table)
+	if err != nil {
+		return &OpError{Op: op, Err: err}
+	}
+	ones, _ := ipnet.Mask.Size()
+	msg := &rtMsg{
+		Family: family,
+		DstLen: uint8(ones),
+		Type:   unix.RTN_UNICAST,
+	}
+	if tableID < 256 {
+		msg.Table = uint8(tableID)
+	}
+	if typ == unix.RTM_DELROUTE {
+		msg.Scope = unix.RT_SCOPE_NOWHERE
+		msg.Type = 0
+	} else {
+		msg.Protocol = unix.RTPROT_BOOT
+		msg.Scope = unix.RT_SCOPE_LINK
+		if gw != "" {
+			msg.Scope = unix.RT_SCOPE_UNIVERSE
+		}
+	}
+	ae := netlink.NewAttributeEncoder()
+	if ones > 0 {
+		ae.Bytes(unix.RTA_DST, ipnet.IP)
+	}
+	if gw != "" {
+		gwIP := net.ParseIP(gw)
+		if gwIP == nil {
+			return &OpError{Op: op, Err: fmt.Errorf("invalid gateway [%s]", gw)}
+		}
+		if ip4 := gwIP.To4(); ip4 != nil {
+			gwIP = ip4
+		}
+		ae.Bytes(unix.RTA_GATEWAY, gwIP)
+	}
+	if dev != "" {
+		idx, err := linkIndex(op, dev)
+		if err != nil {
+			return err
+		}
+		ae.Uint32(unix.RTA_OIF, idx)
+	}
+	ae.Uint32(unix.RTA_TABLE, tableID)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return &OpError{Op: op, Err: err}
+	}
+	_, err = b.execute(op, typ, flags, append(msg.marshal(), attrs...))
+	return err
+}
+
+func (b *NetlinkBackend) AddRoute(cidr, dev, table string) error {
+	return b.routeOP(fmt.Sprintf("add route [%s] to dev [%s]", cidr, dev),
+		unix.RTM_NEWROUTE, netlink.Acknowledge|netlink.Create|netlink.Excl,
+		cidr, "", dev, table)
+}
+
+func (b *NetlinkBackend) ReplaceRoute(cidr, dev, table string) error {
+	return b.routeOP(fmt.Sprintf("replace route [%s] to dev [%s]", cidr, dev),
+		unix.RTM_NEWROUTE, netlink.Acknowledge|netlink.Create|netlink.Replace,
+		cidr, "", dev, table)
+}
+
+func (b *NetlinkBackend) AddDefaultRoute(gw, dev string) error {
+	dst := "0.0.0.0/0"
+	if AddrFamily(gw) == FAMILY_INET6 {
+		dst = "::/0"
+	}
+	return b.routeOP(fmt.Sprintf("add default route via [%s] dev [%s]", gw, dev),
+		unix.RTM_NEWROUTE, netlink.Acknowledge|netlink.Create|netlink.Excl,
+		dst, gw, dev, "")
+}
+
+func (b *NetlinkBackend) DeleteRoute(cidr, dev, table string) error {
+	return b.routeOP(fmt.Sprintf("del route [%s] from dev [%s]", cidr, dev),
+		unix.RTM_DELROUTE, netlink.Acknowledge, cidr, "", dev, table)
+}
+
+var routeTypeNames = map[uint8]string{
+	unix.RTN_UNICAST:     "unicast",
+	unix.RTN_LOCAL:       "local",
+	unix.RTN_BROADCAST:   "broadcast",
+	unix.RTN_ANYCAST:     "anycast",
+	unix.RTN_MULTICAST:   "multicast",
+	unix.RTN_BLACKHOLE:   "blackhole",
+	unix.RTN_UNREACHABLE: "unreachable",
+	unix.RTN_PROHIBIT:    "prohibit",
+	unix.RTN_THROW:       "throw",
+	unix.RTN_NAT:         "nat",
+}
+
+var routeProtoNames = map[uint8]string{
+	unix.RTPROT_REDIRECT: "redirect",
+	unix.RTPROT_KERNEL:   "kernel",
+	unix.RTPROT_BOOT:     "boot",
+	unix.RTPROT_STATIC:   "static",
+	unix.RTPROT_DHCP:     "dhcp",
+}
+
+func (b *NetlinkBackend) ListRoutes(table string) ([]*Route, error) {
+	op := "list route"
+	tableID, err := parseTable(table)
+	if err != nil {
+		return nil, &OpError{Op: op, Err: err}
+	}
+	req := &rtMsg{Family: unix.AF_UNSPEC}
+	msgs, err := b.execute(op, unix.RTM_GETROUTE, netlink.Dump, req.marshal())
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]*Route, 0)
+	for _, m := range msgs {
+		msg := &rtMsg{}
+		if err = msg.unmarshal(m.Data); err != nil {
+			return nil, &OpError{Op: op, Err: err}
+		}
+		if msg.Family != unix.AF_INET && msg.Family != unix.AF_INET6 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[unix.SizeofRtMsg:])
+		if err != nil {
+			return nil, &OpError{Op: op, Err: err}
+		}
+		id := uint32(msg.Table)
+		route := &Route{
+			Family: FAMILY_INET,
+			Type:   routeTypeNames[msg.Type],
+			Dst:    "default",
+			Proto:  routeProtoNames[msg.Protocol],
+		}
+		if msg.Family == unix.AF_INET6 {
+			route.Family = FAMILY_INET6
+		}
+		if route.Proto == "" {
+			route.Proto = strconv.Itoa(int(msg.Protocol))
+		}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.RTA_TABLE:
+				id = ad.Uint32()
+			case unix.RTA_DST:
+				route.Dst = fmt.Sprintf("%s/%d", net.IP(ad.Bytes()).String(), msg.DstLen)
+			case unix.RTA_GATEWAY:
+				route.Via = net.IP(ad.Bytes()).String()
+			case unix.RTA_OIF:
+				if ifi, err := net.InterfaceByIndex(int(ad.Uint32())); err == nil {
+					route.Dev = ifi.Name
+				}
+			}
+		}
+		if err = ad.Err(); err != nil {
+			return nil, &OpError{Op: op, Err: err}
+		}
+		if id != tableID {
+			continue
+		}
+		route.Table = tableName(id)
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// ruleMsg build struct fib_rule_hdr and attributes of rule
+func ruleMsg(rule *Rule) ([]byte, error) {
+	family := uint8(unix.AF_INET)
+	if rule.family() == FAMILY_INET6 {
+		family = unix.AF_INET6
+	}
+	tableID, err := parseTable(rule.Table)
+	if err != nil {
+		return nil, err
+	}
+	hdr := &rtMsg{Family: family, Type: unix.FR_ACT_TO_TBL}
+	if tableID < 256 {
+		hdr.Table = uint8(tableID)
+	}
+	ae := netlink.NewAttributeEncoder()
+	if rule.Priority > 0 {
+		ae.Uint32(unix.FRA_PRIORITY, uint32(rule.Priority))
+	}
+	for _, sel := range []struct {
+		typ  uint16
+		cidr string
+		len  *uint8
+	}{
+		{unix.FRA_SRC, rule.From, &hdr.SrcLen},
+		{unix.FRA_DST, rule.To, &hdr.DstLen},
+	} {
+		if sel.cidr == "" || sel.cidr == "all" {
+			continue
+		}
+		_, ipnet, _, err := parsePrefix(sel.cidr)
+		if err != nil {
+			return nil, err
+		}
+		ones, _ := ipnet.Mask.Size()
+		*sel.len = uint8(ones)
+		ae.Bytes(sel.typ, ipnet.IP)
+	}
+	if rule.Fwmark != 0 {
+		ae.Uint32(unix.FRA_FWMARK, rule.Fwmark)
+		ae.Uint32(unix.FRA_FWMASK, rule.fwMask())
+	}
+	if rule.Iif != "" {
+		ae.String(unix.FRA_IIFNAME, rule.Iif)
+	}
+	ae.Uint32(unix.FRA_TABLE, tableID)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return append(hdr.marshal(), attrs...), nil
+}
+
+func (b *NetlinkBackend) AddRule(rule *Rule) error {
+	op := fmt.Sprintf("add rule [%s]", rule)
+	data, err := ruleMsg(rule)
+	if err != nil {
+		return &OpError{Op: op, Err: err}
+	}
+	_, err = b.execute(op, unix.RTM_NEWRULE,
+		netlink.Acknowledge|netlink.Create|netlink.Excl, data)
+	return err
+}
+
+func (b *NetlinkBackend) DeleteRule(rule *Rule) error {
+	op := fmt.Sprintf("del rule [%s]", rule)
+	data, err := ruleMsg(rule)
+	if err != nil {
+		return &OpError{Op: op, Err: err}
+	}
+	_, err = b.execute(op, unix.RTM_DELRULE, netlink.Acknowledge, data)
+	return err
+}
+
+func (b *NetlinkBackend) ListRules() ([]*Rule, error) {
+	op := "list rule"
+	req := &rtMsg{Family: unix.AF_UNSPEC}
+	msgs, err := b.execute(op, unix.RTM_GETRULE, netlink.Dump, req.marshal())
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*Rule, 0)
+	for _, m := range msgs {
+		hdr := &rtMsg{}
+		if err = hdr.unmarshal(m.Data); err != nil {
+			return nil, &OpError{Op: op, Err: err}
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[unix.SizeofRtMsg:])
+		if err != nil {
+			return nil, &OpError{Op: op, Err: err}
+		}
+		if hdr.Family != unix.AF_INET && hdr.Family != unix.AF_INET6 {
+			continue
+		}
+		rule := &Rule{Family: FAMILY_INET}
+		if hdr.Family == unix.AF_INET6 {
+			rule.Family = FAMILY_INET6
+		}
+		tableID := uint32(hdr.Table)
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.FRA_PRIORITY:
+				rule.Priority = int(ad.Uint32())
+			case unix.FRA_SRC:
+				rule.From = fmt.Sprintf("%s/%d", net.IP(ad.Bytes()).String(), hdr.SrcLen)
+			case unix.FRA_DST:
+				rule.To = fmt.Sprintf("%s/%d", net.IP(ad.Bytes()).String(), hdr.DstLen)
+			case unix.FRA_FWMARK:
+				rule.Fwmark = ad.Uint32()
+			case unix.FRA_FWMASK:
+				rule.FwMask = ad.Uint32()
+			case unix.FRA_IIFNAME:
+				rule.Iif = ad.String()
+			case unix.FRA_TABLE:
+				tableID = ad.Uint32()
+			}
+		}
+		if err = ad.Err(); err != nil {
+			return nil, &OpError{Op: op, Err: err}
+		}
+		rule.Table = tableName(tableID)
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package iptools
+
+import "fmt"
+
+// NetlinkBackend ip tools backend with rtnetlink, linux only
+type NetlinkBackend struct {
+	Backend
+}
+
+// NewNetlinkBackend create rtnetlink backend
+func NewNetlinkBackend() (*NetlinkBackend, error) {
+	return nil, fmt.Errorf("rtnetlink is not supported on this platform")
+}
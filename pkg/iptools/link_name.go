@@ -0,0 +1,29 @@
+package iptools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LINK_NAME_MAX_LEN max length of linux interface name, IFNAMSIZ - 1
+const LINK_NAME_MAX_LEN = 15
+
+// CheckLinkName check interface name like the kernel does, names starting
+// with '-' are rejected too so they are never taken as command options
+func CheckLinkName(name string) error {
+	if name == "" {
+		return fmt.Errorf("link name is empty")
+	}
+	if len(name) > LINK_NAME_MAX_LEN {
+		return fmt.Errorf("link name [%s] longer than %d", name, LINK_NAME_MAX_LEN)
+	}
+	if name == "." || name == ".." || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("invalid link name [%s]", name)
+	}
+	for _, c := range name {
+		if c <= ' ' || c > '~' || c == '/' || c == ':' {
+			return fmt.Errorf("invalid character %q in link name [%s]", c, name)
+		}
+	}
+	return nil
+}
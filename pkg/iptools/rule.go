@@ -0,0 +1,137 @@
+package iptools
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule linux policy routing rule information
+type Rule struct {
+	Family   string
+	Priority int
+	From     string
+	To       string
+	Fwmark   uint32
+	FwMask   uint32
+	Iif      string
+	Table    string
+}
+
+// family address family of rule, selectors decide it when not set
+func (r *Rule) family() string {
+	if r.Family != "" {
+		return r.Family
+	}
+	for _, addr := range []string{r.From, r.To} {
+		if addr != "" {
+			return AddrFamily(addr)
+		}
+	}
+	return FAMILY_INET
+}
+
+// Equal assert two rules have the same selectors, priority and table
+func (r *Rule) Equal(o *Rule) bool {
+	return r.family() == o.family() &&
+		r.Priority == o.Priority &&
+		sameSelector(r.From, o.From) &&
+		sameSelector(r.To, o.To) &&
+		r.Fwmark == o.Fwmark &&
+		(r.Fwmark == 0 || r.fwMask() == o.fwMask()) &&
+		r.Iif == o.Iif &&
+		SameTable(r.Table, o.Table)
+}
+
+func (r *Rule) fwMask() uint32 {
+	if r.FwMask == 0 {
+		return 0xffffffff
+	}
+	return r.FwMask
+}
+
+func sameSelector(a, b string) bool {
+	if a == "all" {
+		a = ""
+	}
+	if b == "all" {
+		b = ""
+	}
+	if a == "" || b == "" {
+		return a == b
+	}
+	return sameNetwork(a, b)
+}
+
+// String rule in ip rule notation
+func (r *Rule) String() string {
+	return strings.Join(r.args(), " ")
+}
+
+// args ip rule selector and action arguments
+func (r *Rule) args() []string {
+	args := make([]string, 0)
+	if r.Priority > 0 {
+		args = append(args, "priority")
+		args = append(args, fmt.Sprint(r.Priority))
+	}
+	from := r.From
+	if from == "" {
+		from = "all"
+	}
+	args = append(args, "from")
+	args = append(args, from)
+	if r.To != "" {
+		args = append(args, "to")
+		args = append(args, r.To)
+	}
+	if r.Fwmark != 0 {
+		args = append(args, "fwmark")
+		args = append(args, fmt.Sprintf("0x%x/0x%x", r.Fwmark, r.fwMask()))
+	}
+	if r.Iif != "" {
+		args = append(args, "iif")
+		args = append(args, r.Iif)
+	}
+	table := r.Table
+	if table == "" {
+		table = "main"
+	}
+	args = append(args, "lookup")
+	args = append(args, table)
+	return args
+}
+
+// ListRules list ipv4 and ipv6 policy routing rules
+func (t *IPTools) ListRules() ([]*Rule, error) {
+	return t.backend.ListRules()
+}
+
+// AddRule add policy routing rule
+func (t *IPTools) AddRule(rule *Rule) error {
+	return t.backend.AddRule(rule)
+}
+
+// DeleteRule delete policy routing rule, absent rule is not an error
+func (t *IPTools) DeleteRule(rule *Rule) error {
+	if err := t.backend.DeleteRule(rule); err != nil && !IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// EnsureRule add policy routing rule when no equal rule exists
+func (t *IPTools) EnsureRule(rule *Rule) error {
+	rules, err := t.backend.ListRules()
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if r.Equal(rule) {
+			return nil
+		}
+	}
+	if err = t.backend.AddRule(rule); err != nil && !IsExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package iptools
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	RT_TABLE_DEFAULT = 253
+	RT_TABLE_MAIN    = 254
+	RT_TABLE_LOCAL   = 255
+)
+
+// parseTable parse route table name or id, main table when empty
+func parseTable(table string) (uint32, error) {
+	switch table {
+	case "", "main":
+		return RT_TABLE_MAIN, nil
+	case "local":
+		return RT_TABLE_LOCAL, nil
+	case "default":
+		return RT_TABLE_DEFAULT, nil
+	}
+	if id, err := strconv.ParseUint(table, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	f, err := os.Open("/etc/iproute2/rt_tables")
+	if err != nil {
+		return 0, fmt.Errorf("unknow route table [%s]", table)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || fields[1] != table {
+			continue
+		}
+		if id, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+			return uint32(id), nil
+		}
+	}
+	return 0, fmt.Errorf("unknow route table [%s]", table)
+}
+
+// tableName format route table id like ip command
+func tableName(id uint32) string {
+	switch id {
+	case RT_TABLE_MAIN:
+		return "main"
+	case RT_TABLE_LOCAL:
+		return "local"
+	case RT_TABLE_DEFAULT:
+		return "default"
+	}
+	return strconv.Itoa(int(id))
+}
+
+// SameTable assert two route table names or ids refer to the same table
+func SameTable(a, b string) bool {
+	if a == b {
+		return true
+	}
+	aid, aerr := parseTable(a)
+	bid, berr := parseTable(b)
+	return aerr == nil && berr == nil && aid == bid
+}
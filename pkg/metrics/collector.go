@@ -0,0 +1,307 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+)
+
+// METRIC_PREFIX prefix of exported metric names
+const METRIC_PREFIX = "ta_router_"
+
+// PeerStats traffic of wireguard peer, rates are bytes per second
+// between the last two samples
+type PeerStats struct {
+	Device        string
+	PublicKey     string
+	Endpoint      string
+	RxBytes       int64
+	TxBytes       int64
+	RxRate        float64
+	TxRate        float64
+	LastHandshake time.Time
+}
+
+// RuleStats counters of iptables rule, rates are per second between the
+// last two samples
+type RuleStats struct {
+	Protocol   string
+	Table      string
+	Chain      string
+	Num        int
+	Target     string
+	Packets    int64
+	Bytes      int64
+	PacketRate float64
+	ByteRate   float64
+}
+
+type chainSource struct {
+	fw    *iptables.IPTables
+	table string
+	chain string
+}
+
+// Collector sample wireguard peer and iptables chain counters periodically
+// and export them in prometheus text format
+type Collector struct {
+	devices   func() ([]*wgtypes.Device, error)
+	chains    []*chainSource
+	lock      sync.RWMutex
+	peers     map[string]*PeerStats
+	rules     map[string]*RuleStats
+	sampledAt time.Time
+	// Stale assert peer is stale, peer stale metric is skipped when nil
+	Stale func(device, publicKey string) bool
+}
+
+// NewCollector create collector, devices lists wireguard devices like
+// wgctrl.Client.Devices
+func NewCollector(devices func() ([]*wgtypes.Device, error)) *Collector {
+	return &Collector{
+		devices: devices,
+		chains:  make([]*chainSource, 0),
+		peers:   make(map[string]*PeerStats),
+		rules:   make(map[string]*RuleStats),
+	}
+}
+
+// AddChain sample rule counters of iptables chain
+func (c *Collector) AddChain(fw *iptables.IPTables, tableName, chainName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.chains = append(c.chains, &chainSource{fw: fw, table: tableName, chain: chainName})
+}
+
+// rate counter rate per second, counter reset gives zero
+func rate(cur, prev int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 || cur < prev {
+		return 0
+	}
+	return float64(cur-prev) / elapsed.Seconds()
+}
+
+// chainRules rule counters of chain from iptables -L -v -x
+func chainRules(src *chainSource) ([]*RuleStats, error) {
+	rules, err := src.fw.List(src.table, src.chain)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*RuleStats, 0, len(rules))
+	for _, r := range rules {
+		list = append(list, &RuleStats{
+			Protocol: src.fw.Protocol().String(),
+			Table:    src.table,
+			Chain:    src.chain,
+			Num:      r.Num,
+			Target:   r.Target,
+			Packets:  int64(r.Pkts),
+			Bytes:    int64(r.Bytes),
+		})
+	}
+	return list, nil
+}
+
+// Sample sample counters now and compute rates against previous sample
+func (c *Collector) Sample() error {
+	now := time.Now()
+	peers := make(map[string]*PeerStats)
+	if c.devices != nil {
+		devs, err := c.devices()
+		if err != nil {
+			return fmt.Errorf("list wireguard devices failed: %v", err)
+		}
+		for _, dev := range devs {
+			for _, p := range dev.Peers {
+				ps := &PeerStats{
+					Device:        dev.Name,
+					PublicKey:     p.PublicKey.String(),
+					RxBytes:       p.ReceiveBytes,
+					TxBytes:       p.TransmitBytes,
+					LastHandshake: p.LastHandshakeTime,
+				}
+				if p.Endpoint != nil {
+					ps.Endpoint = p.Endpoint.String()
+				}
+				peers[dev.Name+"/"+ps.PublicKey] = ps
+			}
+		}
+	}
+	c.lock.RLock()
+	chains := append([]*chainSource{}, c.chains...)
+	c.lock.RUnlock()
+	rules := make(map[string]*RuleStats)
+	for _, src := range chains {
+		list, err := chainRules(src)
+		if err != nil {
+			logrus.WithField("prefix", "metrics").Warnf(
+				"sample %s chain [%s/%s] failed, skipped: %v",
+				src.fw.Protocol(), src.table, src.chain, err)
+			continue
+		}
+		for _, rs := range list {
+			rules[rs.Protocol+"/"+rs.Table+"/"+rs.Chain+"/"+strconv.Itoa(rs.Num)] = rs
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elapsed := now.Sub(c.sampledAt)
+	for key, ps := range peers {
+		if prev, ok := c.peers[key]; ok {
+			ps.RxRate = rate(ps.RxBytes, prev.RxBytes, elapsed)
+			ps.TxRate = rate(ps.TxBytes, prev.TxBytes, elapsed)
+		}
+	}
+	for key, rs := range rules {
+		if prev, ok := c.rules[key]; ok && prev.Target == rs.Target {
+			rs.PacketRate = rate(rs.Packets, prev.Packets, elapsed)
+			rs.ByteRate = rate(rs.Bytes, prev.Bytes, elapsed)
+		}
+	}
+	c.peers, c.rules, c.sampledAt = peers, rules, now
+	return nil
+}
+
+// Run sample counters every interval until ctx done, sample errors are
+// logged and retried on next tick
+func (c *Collector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Sample(); err != nil {
+			logrus.WithField("prefix", "metrics").
+				Warnf("sample metrics failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Peers peer stats of last sample
+func (c *Collector) Peers() []*PeerStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	peers := make([]*PeerStats, 0, len(c.peers))
+	for _, ps := range c.peers {
+		peers = append(peers, ps)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Device != peers[j].Device {
+			return peers[i].Device < peers[j].Device
+		}
+		return peers[i].PublicKey < peers[j].PublicKey
+	})
+	return peers
+}
+
+// Rules rule stats of last sample
+func (c *Collector) Rules() []*RuleStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	rules := make([]*RuleStats, 0, len(c.rules))
+	for _, rs := range c.rules {
+		rules = append(rules, rs)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		ka, kb := a.Protocol+"/"+a.Table+"/"+a.Chain, b.Protocol+"/"+b.Table+"/"+b.Chain
+		if ka != kb {
+			return ka < kb
+		}
+		return a.Num < b.Num
+	})
+	return rules
+}
+
+// Metrics metric families of last sample
+func (c *Collector) Metrics() []*Metric {
+	rx := &Metric{Name: METRIC_PREFIX + "peer_receive_bytes_total", Type: TYPE_COUNTER,
+		Help: "Bytes received from wireguard peer."}
+	tx := &Metric{Name: METRIC_PREFIX + "peer_transmit_bytes_total", Type: TYPE_COUNTER,
+		Help: "Bytes transmitted to wireguard peer."}
+	rxRate := &Metric{Name: METRIC_PREFIX + "peer_receive_bytes_per_second", Type: TYPE_GAUGE,
+		Help: "Receive rate of wireguard peer between the last two samples."}
+	txRate := &Metric{Name: METRIC_PREFIX + "peer_transmit_bytes_per_second", Type: TYPE_GAUGE,
+		Help: "Transmit rate of wireguard peer between the last two samples."}
+	handshake := &Metric{Name: METRIC_PREFIX + "peer_last_handshake_seconds", Type: TYPE_GAUGE,
+		Help: "Unix time of the last wireguard handshake, 0 when never."}
+	stale := &Metric{Name: METRIC_PREFIX + "peer_stale", Type: TYPE_GAUGE,
+		Help: "1 when the last wireguard handshake is older than the stale threshold."}
+	info := &Metric{Name: METRIC_PREFIX + "peer_info", Type: TYPE_GAUGE,
+		Help: "Endpoint of wireguard peer, always 1."}
+	for _, ps := range c.Peers() {
+		// endpoint roams, so it is kept out of the counter series
+		labels := map[string]string{
+			"device":     ps.Device,
+			"public_key": ps.PublicKey,
+		}
+		info.Add(1, map[string]string{
+			"device":     ps.Device,
+			"public_key": ps.PublicKey,
+			"endpoint":   ps.Endpoint,
+		})
+		rx.Add(float64(ps.RxBytes), labels)
+		tx.Add(float64(ps.TxBytes), labels)
+		rxRate.Add(ps.RxRate, labels)
+		txRate.Add(ps.TxRate, labels)
+		var hs float64
+		if !ps.LastHandshake.IsZero() {
+			hs = float64(ps.LastHandshake.Unix())
+		}
+		handshake.Add(hs, labels)
+		if c.Stale != nil {
+			var v float64
+			if c.Stale(ps.Device, ps.PublicKey) {
+				v = 1
+			}
+			stale.Add(v, labels)
+		}
+	}
+	pkts := &Metric{Name: METRIC_PREFIX + "rule_packets_total", Type: TYPE_COUNTER,
+		Help: "Packets matched by iptables rule."}
+	bs := &Metric{Name: METRIC_PREFIX + "rule_bytes_total", Type: TYPE_COUNTER,
+		Help: "Bytes matched by iptables rule."}
+	pktsRate := &Metric{Name: METRIC_PREFIX + "rule_packets_per_second", Type: TYPE_GAUGE,
+		Help: "Packet rate of iptables rule between the last two samples."}
+	bsRate := &Metric{Name: METRIC_PREFIX + "rule_bytes_per_second", Type: TYPE_GAUGE,
+		Help: "Byte rate of iptables rule between the last two samples."}
+	for _, rs := range c.Rules() {
+		labels := map[string]string{
+			"protocol": rs.Protocol,
+			"table":    rs.Table,
+			"chain":    rs.Chain,
+			"rule":     strconv.Itoa(rs.Num),
+			"target":   rs.Target,
+		}
+		pkts.Add(float64(rs.Packets), labels)
+		bs.Add(float64(rs.Bytes), labels)
+		pktsRate.Add(rs.PacketRate, labels)
+		bsRate.Add(rs.ByteRate, labels)
+	}
+	families := []*Metric{info, rx, tx, rxRate, txRate, handshake}
+	if c.Stale != nil {
+		families = append(families, stale)
+	}
+	return append(families, pkts, bs, pktsRate, bsRate)
+}
+
+// ServeHTTP serve metrics in prometheus text exposition format
+func (c *Collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := WriteText(w, c.Metrics()); err != nil {
+		logrus.WithField("prefix", "metrics").
+			Warnf("write metrics failed: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// TYPE_COUNTER prometheus counter metric
+	TYPE_COUNTER = "counter"
+	// TYPE_GAUGE prometheus gauge metric
+	TYPE_GAUGE = "gauge"
+)
+
+// Metric metric family in prometheus text format
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []*Sample
+}
+
+// Sample metric sample with labels
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Add add sample to metric
+func (m *Metric) Add(value float64, labels map[string]string) {
+	m.Samples = append(m.Samples, &Sample{Labels: labels, Value: value})
+}
+
+// WriteText write metrics in prometheus text exposition format
+func WriteText(w io.Writer, metrics []*Metric) error {
+	var sb strings.Builder
+	for _, m := range metrics {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n", m.Name, escapeHelp(m.Help)))
+		sb.WriteString(fmt.Sprintf("# TYPE %s %s\n", m.Name, m.Type))
+		for _, s := range m.Samples {
+			sb.WriteString(m.Name)
+			if len(s.Labels) > 0 {
+				keys := make([]string, 0, len(s.Labels))
+				for k := range s.Labels {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				pairs := make([]string, 0, len(keys))
+				for _, k := range keys {
+					pairs = append(pairs, k+"=\""+escapeLabel(s.Labels[k])+"\"")
+				}
+				sb.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			sb.WriteString(" " + strconv.FormatFloat(s.Value, 'g', -1, 64) + "\n")
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -1,13 +1,16 @@
 package rexec
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Executer executer
@@ -15,7 +18,35 @@ type Executer struct {
 	Name string
 	Path string
 	Args []string
-	cmd  *exec.Cmd
+	// Stdin standard input of Run, nil for none
+	Stdin io.Reader
+	// Stdout extra writer of standard output like os.Stdout, nil for none
+	Stdout io.Writer
+	// Stderr extra writer of standard error like os.Stderr, nil for none
+	Stderr io.Writer
+	// OnLine called with every output line while running, calls are
+	// serialized and finished before result is delivered
+	OnLine func(line Line)
+	// NoCapture do not keep output in ExecResult, for long running
+	// processes consumed with OnLine
+	NoCapture bool
+	// Env extra environment variables like KEY=VALUE, appended to the
+	// environment of router
+	Env []string
+	// Dir working directory, current directory when empty
+	Dir string
+	// Timeout max run time, the process group is killed after it, no
+	// limit when zero
+	Timeout time.Duration
+	lock    sync.Mutex
+	cmd     *exec.Cmd
+	run     *execRun
+}
+
+// execRun one run of executer, result is set before done is closed
+type execRun struct {
+	done   chan struct{}
+	result *ExecResult
 }
 
 // NewExecuter create executer
@@ -31,76 +62,297 @@ func NewExecuter(name, path string, args []string) (*Executer, error) {
 	}, nil
 }
 
+// ExecResult result of executer
 type ExecResult struct {
-	Error  error
+	Error error
+	// Output standard output
 	Output string
+	Stdout string
+	Stderr string
+	// Combined standard output and error interleaved
+	Combined string
+	// ExitCode exit code, -1 when killed by signal or not started
+	ExitCode int
+}
+
+// Stream output stream of a line
+type Stream int
+
+const (
+	STREAM_STDOUT Stream = iota
+	STREAM_STDERR
+)
+
+func (s Stream) String() string {
+	if s == STREAM_STDERR {
+		return "stderr"
+	}
+	return "stdout"
+}
+
+// Line output line of running executer without line ending
+type Line struct {
+	Stream Stream
+	Text   string
 }
 
-// Start start executer
+// Start start executer in background
 func (e *Executer) Start() chan ExecResult {
+	return e.StartContext(context.Background())
+}
+
+// StartContext start executer in background, the process group is killed
+// when ctx done, result is delivered on returned channel after exit and
+// its error includes standard error
+func (e *Executer) StartContext(ctx context.Context) chan ExecResult {
 	result := make(chan ExecResult, 1)
-	e.cmd = exec.Command(e.Path, e.Args...)
-	var stdout, stderr []byte
-	var errStdout, errStderr error
-	stdoutIn, _ := e.cmd.StdoutPipe()
-	stderrIn, _ := e.cmd.StderrPipe()
-	go func() {
-		stdout, errStdout = e.copyAndCapture(os.Stdout, stdoutIn)
-	}()
+	run, err := e.launch(ctx)
+	if err != nil {
+		result <- ExecResult{
+			Error:    fmt.Errorf("exec [%s] failed: %v", e.Name, err),
+			ExitCode: -1,
+		}
+		return result
+	}
 	go func() {
-		stderr, errStderr = e.copyAndCapture(os.Stderr, stderrIn)
+		<-run.done
+		res := *run.result
+		if res.Error != nil {
+			res.Error = fmt.Errorf("exec [%s] failed: %w", e.Name, res.Error)
+			if stderr := strings.TrimSpace(res.Stderr); stderr != "" {
+				res.Error = fmt.Errorf("%w: %s", res.Error, stderr)
+			}
+		}
+		result <- res
 	}()
+	return result
+}
+
+// Wait wait started executer exit and return its result, may be called
+// many times
+func (e *Executer) Wait() ExecResult {
+	e.lock.Lock()
+	run := e.run
+	e.lock.Unlock()
+	if run == nil {
+		return ExecResult{
+			Error:    fmt.Errorf("executer [%s] not started", e.Name),
+			ExitCode: -1,
+		}
+	}
+	<-run.done
+	return *run.result
+}
 
-	e.cmd.Start()
-	err := e.cmd.Wait()
+// Stop kill process group of running executer
+func (e *Executer) Stop() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.run == nil {
+		return fmt.Errorf("executer [%s] not started", e.Name)
+	}
+	select {
+	case <-e.run.done:
+		return fmt.Errorf("executer [%s] already exited", e.Name)
+	default:
+	}
+	return killGroup(e.cmd)
+}
+
+// Run run executer
+func (e *Executer) Run() (string, error) {
+	return e.RunContext(context.Background())
+}
+
+// RunContext run executer until exit or ctx done and return trimmed
+// combined output
+func (e *Executer) RunContext(ctx context.Context) (string, error) {
+	run, err := e.launch(ctx)
 	if err != nil {
-		result <- ExecResult{
-			Error: fmt.Errorf("cmd.Run() failed with %s", string(stderr)),
+		return "", err
+	}
+	<-run.done
+	return strings.TrimSpace(run.result.Combined), run.result.Error
+}
+
+// launch start command and collect its result in background, the process
+// group is killed when ctx is done or Timeout elapsed
+func (e *Executer) launch(ctx context.Context) (*execRun, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.run != nil {
+		select {
+		case <-e.run.done:
+		default:
+			return nil, fmt.Errorf("executer [%s] already running", e.Name)
 		}
-		return result
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cancel := context.CancelFunc(func() {})
+	if e.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+	}
+	out := &output{}
+	lines := &sync.Mutex{}
+	stdout := e.writers(out, &out.stdout, e.Stdout, &lineWriter{
+		stream: STREAM_STDOUT, lock: lines, onLine: e.OnLine,
+	})
+	stderr := e.writers(out, &out.stderr, e.Stderr, &lineWriter{
+		stream: STREAM_STDERR, lock: lines, onLine: e.OnLine,
+	})
+	cmd := exec.Command(e.Path, e.Args...)
+	cmd.Stdin = e.Stdin
+	cmd.Stdout, cmd.Stderr = stdout.writer, stderr.writer
+	cmd.Dir = e.Dir
+	if len(e.Env) > 0 {
+		cmd.Env = append(os.Environ(), e.Env...)
+	}
+	setGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	run := &execRun{done: make(chan struct{})}
+	e.cmd, e.run = cmd, run
+	go func() {
+		defer cancel()
+		res := wait(ctx, cmd)
+		stdout.flush()
+		stderr.flush()
+		res.Stdout, res.Stderr = out.stdout.String(), out.stderr.String()
+		res.Output, res.Combined = res.Stdout, out.combined.String()
+		run.result = res
+		close(run.done)
+	}()
+	return run, nil
+}
 
-	if errStdout != nil || errStderr != nil {
-		outStr, errStr := string(stdout), string(stderr)
-		result <- ExecResult{
-			Error: fmt.Errorf("out:\n%s\nerr:\n%s", outStr, errStr),
+// wait wait command exit, killing its process group when ctx is done
+func wait(ctx context.Context, cmd *exec.Cmd) *ExecResult {
+	exited := make(chan struct{})
+	stopped := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killGroup(cmd)
+			stopped <- true
+		case <-exited:
+			stopped <- false
 		}
-		return result
+	}()
+	err := cmd.Wait()
+	close(exited)
+	killed := <-stopped
+	res := &ExecResult{ExitCode: -1}
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
 	}
-	result <- ExecResult{
-		Output: string(stdout),
-		Error:  nil,
+	switch {
+	case !killed || err == nil:
+		res.Error = err
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.Error = fmt.Errorf("killed after timeout: %v", ctx.Err())
+	default:
+		res.Error = fmt.Errorf("killed: %v", ctx.Err())
 	}
-	return result
+	return res
 }
 
-// Stop stop executer
-func (e *Executer) Stop() error {
-	return e.cmd.Process.Kill()
+// output captured output of one run
+type output struct {
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+	combined lockedBuffer
 }
 
-func (e *Executer) copyAndCapture(w io.Writer, r io.Reader) ([]byte, error) {
-	scanner := bufio.NewScanner(r)
-	var builder strings.Builder
-	for scanner.Scan() {
-		builder.WriteString(scanner.Text())
-		builder.WriteString("\n")
+// streamWriter writer of one output stream
+type streamWriter struct {
+	writer io.Writer
+	lines  *lineWriter
+}
+
+// writers build writer of one stream from capture buffers, extra writer
+// and line splitter
+func (e *Executer) writers(out *output, capture *bytes.Buffer,
+	extra io.Writer, lines *lineWriter) *streamWriter {
+	ws := make([]io.Writer, 0, 4)
+	if !e.NoCapture {
+		ws = append(ws, capture, &out.combined)
+	}
+	if extra != nil {
+		ws = append(ws, extra)
+	}
+	if lines.onLine != nil {
+		ws = append(ws, lines)
 	}
+	w := &streamWriter{lines: lines}
+	if len(ws) > 0 {
+		w.writer = io.MultiWriter(ws...)
+	}
+	return w
+}
+
+// flush emit last line without line ending, called after command exit
+func (w *streamWriter) flush() {
+	w.lines.flush()
+}
+
+// lineWriter split written output into lines, lock is shared by the
+// writers of one run so OnLine calls are serialized
+type lineWriter struct {
+	stream Stream
+	lock   *sync.Mutex
+	onLine func(line Line)
+	buf    []byte
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("read output failed: %s", err.Error())
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i])
+		w.buf = w.buf[i+1:]
 	}
-	return []byte(builder.String()), nil
+	return len(p), nil
 }
 
-// Run run executer
-func (e *Executer) Run() (string, error) {
-	cmd := exec.Command(e.Path, e.Args...)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	if err := cmd.Run(); err != nil {
-		return strings.TrimSpace(out.String()), err
+func (w *lineWriter) flush() {
+	if w.onLine == nil {
+		return
 	}
-	return strings.TrimSpace(out.String()), nil
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emit(text []byte) {
+	w.onLine(Line{Stream: w.stream, Text: string(bytes.TrimSuffix(text, []byte("\r")))})
+}
+
+// lockedBuffer buffer shared by stdout and stderr copy
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
 }
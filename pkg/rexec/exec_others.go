@@ -0,0 +1,15 @@
+//go:build windows
+
+package rexec
+
+import "os/exec"
+
+func setGroup(cmd *exec.Cmd) {}
+
+// killGroup kill started command, children are not tracked
+func killGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
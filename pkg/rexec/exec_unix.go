@@ -0,0 +1,25 @@
+//go:build !windows
+
+package rexec
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setGroup run command in its own process group so children are killed
+// together with it
+func setGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killGroup kill process group of started command
+func killGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
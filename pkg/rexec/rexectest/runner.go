@@ -0,0 +1,110 @@
+package rexectest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+)
+
+// Call command run by fake runner
+type Call struct {
+	Line  string
+	Stdin string
+	Env   []string
+}
+
+// exitError error of command exited with non zero code
+type exitError int
+
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// ExitCode exit code like exec.ExitError
+func (e exitError) ExitCode() int {
+	return int(e)
+}
+
+// ExitError error of command exited with code, rexec.ExitCode reports it
+func ExitError(code int) error {
+	return exitError(code)
+}
+
+type expectation struct {
+	line   string
+	output string
+	err    error
+}
+
+// FakeRunner recording runner, commands must match the expected command
+// lines in order and get the canned output
+type FakeRunner struct {
+	lock       sync.Mutex
+	expects    []*expectation
+	calls      []*Call
+	unexpected []string
+}
+
+// NewFakeRunner create fake runner without expectation
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		expects: make([]*expectation, 0),
+		calls:   make([]*Call, 0),
+	}
+}
+
+// Expect expect next command line like rexec.Command.String, output and
+// err are returned when it runs
+func (f *FakeRunner) Expect(line, output string, err error) *FakeRunner {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.expects = append(f.expects, &expectation{line: line, output: output, err: err})
+	return f
+}
+
+// LookPath return file unchanged, every executable exists
+func (f *FakeRunner) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+// Run implement rexec.Runner, a command not matching the next expectation
+// fails and is reported by Verify
+func (f *FakeRunner) Run(cmd *rexec.Command) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	line := cmd.String()
+	f.calls = append(f.calls, &Call{Line: line, Stdin: cmd.Stdin, Env: cmd.Env})
+	if len(f.expects) == 0 || f.expects[0].line != line {
+		f.unexpected = append(f.unexpected, line)
+		return "", fmt.Errorf("unexpected command [%s]", line)
+	}
+	exp := f.expects[0]
+	f.expects = f.expects[1:]
+	return exp.output, exp.err
+}
+
+// Calls commands run so far
+func (f *FakeRunner) Calls() []*Call {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*Call{}, f.calls...)
+}
+
+// Verify assert every expected command ran and no other command did
+func (f *FakeRunner) Verify() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	errs := make([]string, 0)
+	for _, line := range f.unexpected {
+		errs = append(errs, "unexpected ["+line+"]")
+	}
+	for _, exp := range f.expects {
+		errs = append(errs, "missing ["+exp.line+"]")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("verify commands failed: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
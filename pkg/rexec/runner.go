@@ -0,0 +1,134 @@
+package rexec
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Command command run by Runner
+type Command struct {
+	// Name label of command in logs and errors
+	Name string
+	Path string
+	Args []string
+	// Stdin standard input, empty for none
+	Stdin string
+	// Env extra environment variables like KEY=VALUE
+	Env []string
+	// Dir working directory, current directory when empty
+	Dir string
+	// Timeout max run time, runner default when zero
+	Timeout time.Duration
+}
+
+// String command line with the base name of path, arguments with spaces
+// are double quoted
+func (c *Command) String() string {
+	parts := []string{filepath.Base(c.Path)}
+	for _, arg := range c.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = "\"" + strings.ReplaceAll(arg, "\"", "\\\"") + "\""
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Runner run external commands, implemented by ExecRunner, AuditRunner
+// and the recording fake of rexectest
+type Runner interface {
+	// LookPath resolve executable like exec.LookPath
+	LookPath(file string) (string, error)
+	// Run run command and return trimmed combined output, output is
+	// returned with the error of a failed command
+	Run(cmd *Command) (string, error)
+}
+
+// ExitCode exit code carried by error of a failed command, 0 when err is
+// nil and -1 when err carries none like a killed or not started command
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var coded interface{ ExitCode() int }
+	if errors.As(err, &coded) {
+		return coded.ExitCode()
+	}
+	return -1
+}
+
+// DEFAULT_EXEC_TIMEOUT timeout of commands run by DefaultRunner, so a
+// hung command never blocks router forever
+const DEFAULT_EXEC_TIMEOUT = time.Minute
+
+// ExecRunner runner running real processes
+type ExecRunner struct {
+	// Timeout timeout of commands without their own, no limit when zero
+	Timeout time.Duration
+}
+
+// DefaultRunner runner used when none is injected
+var DefaultRunner Runner = &ExecRunner{Timeout: DEFAULT_EXEC_TIMEOUT}
+
+// LookPath resolve executable with exec.LookPath
+func (r *ExecRunner) LookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
+
+// Run run command with Executer
+func (r *ExecRunner) Run(cmd *Command) (string, error) {
+	exe, err := NewExecuter(cmd.Name, cmd.Path, cmd.Args)
+	if err != nil {
+		return "", err
+	}
+	if cmd.Stdin != "" {
+		exe.Stdin = strings.NewReader(cmd.Stdin)
+	}
+	exe.Env, exe.Dir, exe.Timeout = cmd.Env, cmd.Dir, cmd.Timeout
+	if exe.Timeout == 0 {
+		exe.Timeout = r.Timeout
+	}
+	return exe.Run()
+}
+
+// AuditRunner runner decorator logging every command line with its
+// duration and result, standard input is never logged since it may
+// carry secrets
+type AuditRunner struct {
+	next Runner
+}
+
+// NewAuditRunner create audit runner wrapping next
+func NewAuditRunner(next Runner) *AuditRunner {
+	return &AuditRunner{next: next}
+}
+
+// LookPath resolve executable with wrapped runner
+func (r *AuditRunner) LookPath(file string) (string, error) {
+	return r.next.LookPath(file)
+}
+
+// Run run command with wrapped runner and log it
+func (r *AuditRunner) Run(cmd *Command) (string, error) {
+	start := time.Now()
+	result, err := r.next.Run(cmd)
+	log := logrus.WithField("prefix", "rexec.audit").WithFields(logrus.Fields{
+		"name":     cmd.Name,
+		"duration": time.Since(start).Round(time.Millisecond).String(),
+	})
+	if cmd.Stdin != "" {
+		log = log.WithField("stdin", fmt.Sprintf("%d bytes", len(cmd.Stdin)))
+	}
+	if err != nil {
+		log.Warnf("exec [%s] failed: %v", cmd, err)
+		return result, err
+	}
+	log.Infof("exec [%s] success", cmd)
+	return result, nil
+}
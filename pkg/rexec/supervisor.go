@@ -0,0 +1,144 @@
+package rexec
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SUPERVISOR_MIN_BACKOFF first restart delay of supervised process
+	SUPERVISOR_MIN_BACKOFF = time.Second
+	// SUPERVISOR_MAX_BACKOFF max restart delay of supervised process
+	SUPERVISOR_MAX_BACKOFF = time.Minute
+	// SUPERVISOR_STABLE_TIME process running longer than it restarts with
+	// the min backoff again
+	SUPERVISOR_STABLE_TIME = time.Minute
+)
+
+// Supervisor keep long running process like a daemon in foreground
+// running, it is restarted with exponential backoff after every exit
+type Supervisor struct {
+	Name string
+	Path string
+	Args []string
+	// Env extra environment variables like KEY=VALUE
+	Env []string
+	// Dir working directory, current directory when empty
+	Dir string
+	// OnLine called with every output line of the process
+	OnLine func(line Line)
+	// OnExit called after every unexpected exit before restart
+	OnExit func(res ExecResult)
+	// MinBackoff first restart delay, SUPERVISOR_MIN_BACKOFF when zero
+	MinBackoff time.Duration
+	// MaxBackoff max restart delay, SUPERVISOR_MAX_BACKOFF when zero
+	MaxBackoff time.Duration
+	lock       sync.Mutex
+	cancel     context.CancelFunc
+	done       chan struct{}
+	restarts   int
+}
+
+// NewSupervisor create supervisor
+func NewSupervisor(name, path string, args []string) (*Supervisor, error) {
+	var err error
+	if path, err = exec.LookPath(path); err != nil {
+		return nil, fmt.Errorf("look path failed: %s", err.Error())
+	}
+	return &Supervisor{
+		Name: name,
+		Path: path,
+		Args: args,
+	}, nil
+}
+
+// Start run process in background until Stop or ctx done, a supervisor
+// is started once
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done != nil {
+		return fmt.Errorf("supervisor [%s] already started", s.Name)
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.loop(ctx)
+	}()
+	return nil
+}
+
+// Stop kill process and wait supervisor exit
+func (s *Supervisor) Stop() {
+	s.lock.Lock()
+	cancel, done := s.cancel, s.done
+	s.lock.Unlock()
+	if done == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Restarts times process restarted
+func (s *Supervisor) Restarts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.restarts
+}
+
+func (s *Supervisor) loop(ctx context.Context) {
+	log := logrus.WithField("prefix", "rexec.supervisor")
+	minBackoff, maxBackoff := s.MinBackoff, s.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = SUPERVISOR_MIN_BACKOFF
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = SUPERVISOR_MAX_BACKOFF
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	backoff := minBackoff
+	for {
+		exe := &Executer{
+			Name:      s.Name,
+			Path:      s.Path,
+			Args:      s.Args,
+			Env:       s.Env,
+			Dir:       s.Dir,
+			OnLine:    s.OnLine,
+			NoCapture: true,
+		}
+		started := time.Now()
+		res := <-exe.StartContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if s.OnExit != nil {
+			s.OnExit(res)
+		}
+		if time.Since(started) >= SUPERVISOR_STABLE_TIME {
+			backoff = minBackoff
+		}
+		log.Warnf("process [%s] exited with code %d: %v, restart in %s",
+			s.Name, res.ExitCode, res.Error, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		s.lock.Lock()
+		s.restarts++
+		s.lock.Unlock()
+	}
+}
@@ -7,8 +7,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"ntsc.ac.cn/ta-router/pkg/rexec"
 )
 
 type ShowType int
@@ -71,13 +69,8 @@ type EndpointInfo struct {
 
 // ShowInterfaces show wireguard inerfaces name
 func (wt *WireguardTools) ShowInterfaces() ([]string, error) {
-	exe, err := rexec.NewExecuter("wg_show_inerfaces",
+	result, err := wt.run("wg_show_inerfaces",
 		wt.wgPath, []string{"show", "interfaces"})
-	if err != nil {
-		return nil, fmt.Errorf(
-			"show wireguard interfaces info failed: %s", err.Error())
-	}
-	result, err := exe.Run()
 	if err != nil {
 		return nil, fmt.Errorf(
 			"show wireguard inerfaces info failed: %s", result)
@@ -100,13 +93,8 @@ func (wt *WireguardTools) ShowInterfaces() ([]string, error) {
 
 // ShowDump show wireguard inerfaces dump
 func (wt *WireguardTools) ShowDump(dev string) (string, error) {
-	exe, err := rexec.NewExecuter("wg_dump",
+	result, err := wt.run("wg_dump",
 		wt.wgPath, []string{"show", dev, "dump"})
-	if err != nil {
-		return "", fmt.Errorf(
-			"show wireguard endpoint info failed: %s", err.Error())
-	}
-	result, err := exe.Run()
 	if err != nil {
 		return "", fmt.Errorf(
 			"show wireguard endpoint info failed: %s", result)
@@ -0,0 +1,14 @@
+package wireguard
+
+import "golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+// Client wireguard device ctrl client, implemented by wgctrl.Client
+type Client interface {
+	// Devices query all wireguard devices
+	Devices() ([]*wgtypes.Device, error)
+	// Device query wireguard device, os.ErrNotExist when absent
+	Device(name string) (*wgtypes.Device, error)
+	// ConfigureDevice apply config to wireguard device
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
@@ -0,0 +1,81 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// ENDPOINT_RESOLVE_TIMEOUT timeout of resolving peer endpoint
+	ENDPOINT_RESOLVE_TIMEOUT = time.Second * 5
+	// ENDPOINT_RERESOLVE_AGE handshake age after which peer endpoint is
+	// re-resolved, same as reresolve-dns.sh
+	ENDPOINT_RERESOLVE_AGE = time.Second * 135
+)
+
+// SplitEndpoint split host:port endpoint
+func SplitEndpoint(endpoint string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", 0, fmt.Errorf("parse endpoint [%s] failed: %v", endpoint, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("parse endpoint [%s] failed: bad port", endpoint)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("parse endpoint [%s] failed: empty host", endpoint)
+	}
+	return host, port, nil
+}
+
+// ResolveEndpoint resolve host:port endpoint to udp address, ipv4
+// addresses are preferred like wg
+func ResolveEndpoint(ctx context.Context, endpoint string) (*net.UDPAddr, error) {
+	host, port, err := SplitEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, ENDPOINT_RESOLVE_TIMEOUT)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve endpoint [%s] failed: %v", endpoint, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolve endpoint [%s] failed: no address", endpoint)
+	}
+	ip := addrs[0].IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ip = addr.IP
+			break
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// EndpointChanged assert live peer endpoint differs from resolved address
+func EndpointChanged(peer *wgtypes.Peer, addr *net.UDPAddr) bool {
+	if peer.Endpoint == nil {
+		return true
+	}
+	return !peer.Endpoint.IP.Equal(addr.IP) || peer.Endpoint.Port != addr.Port
+}
+
+// NeedReresolve assert peer endpoint should be re-resolved at now, peers
+// with a recent handshake keep their endpoint since it may have roamed
+func NeedReresolve(peer *wgtypes.Peer, now time.Time) bool {
+	if peer.Endpoint == nil || peer.LastHandshakeTime.IsZero() {
+		return true
+	}
+	return now.Sub(peer.LastHandshakeTime) > ENDPOINT_RERESOLVE_AGE
+}
@@ -2,19 +2,15 @@ package wireguard
 
 import (
 	"fmt"
+	"strings"
 
-	"ntsc.ac.cn/ta-router/pkg/rexec"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // Genkey generate wireguard key
 func (wt *WireguardTools) Genkey() (string, error) {
-	exe, err := rexec.NewExecuter("wg-genkey",
+	result, err := wt.run("wg-genkey",
 		wt.wgPath, []string{"genkey"})
-	if err != nil {
-		return "", fmt.Errorf(
-			"gen wireguard private key failed: %s", err.Error())
-	}
-	result, err := exe.Run()
 	if err != nil {
 		return "", fmt.Errorf(
 			"gen wireguard private key failed: %s", err)
@@ -24,33 +20,26 @@ func (wt *WireguardTools) Genkey() (string, error) {
 
 // Pubkey export wireguard public key with private key
 func (wt *WireguardTools) Pubkey(privKey string) (string, error) {
-	cmd := "echo " + privKey + " | " + wt.wgPath + " pubkey"
-	exe, err := rexec.NewExecuter("wg-pubkey",
-		"bash", []string{"-c", cmd})
-	if err != nil {
-		return "", fmt.Errorf(
-			"gen wireguard public key failed: %s", err.Error())
-	}
-	result, err := exe.Run()
+	return PublicKey(privKey)
+}
+
+// PublicKey derive wireguard public key from base64 private key
+func PublicKey(privKey string) (string, error) {
+	key, err := wgtypes.ParseKey(strings.TrimSpace(privKey))
 	if err != nil {
 		return "", fmt.Errorf(
 			"gen wireguard public key failed: %s", err.Error())
 	}
-	return result, nil
+	return key.PublicKey().String(), nil
 }
 
 // GenPSK generate wireguard preshared key
 func (wt *WireguardTools) GenPSK() (string, error) {
-	exe, err := rexec.NewExecuter("wg-genpsk",
+	result, err := wt.run("wg-genpsk",
 		wt.wgPath, []string{"genpsk"})
 	if err != nil {
 		return "", fmt.Errorf(
 			"gen wireguard preshare key failed: %s", err.Error())
 	}
-	result, err := exe.Run()
-	if err != nil {
-		return "", fmt.Errorf(
-			"gen wireguard preshare key failed: %s", err.Error())
-	}
 	return result, nil
 }
@@ -0,0 +1,118 @@
+package wireguard
+
+import (
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// KEEPALIVE_STALE_FACTOR keepalive intervals without handshake before a
+// keepalive peer is stale, when larger than the monitor threshold
+const KEEPALIVE_STALE_FACTOR = 3
+
+// PeerEvent peer liveness transition
+type PeerEvent struct {
+	Device    string
+	PublicKey string
+	Endpoint  string
+	// Stale peer became stale, false when it recovered
+	Stale         bool
+	LastHandshake time.Time
+	// Age time since last handshake, or since first seen when never
+	Age       time.Duration
+	Threshold time.Duration
+}
+
+type peerState struct {
+	firstSeen time.Time
+	txBytes   int64
+	stale     bool
+}
+
+// HandshakeMonitor flag peers whose last handshake is older than
+// threshold, peers without persistent keepalive are only judged while
+// they transmit since an idle peer never handshakes
+type HandshakeMonitor struct {
+	threshold time.Duration
+	lock      sync.Mutex
+	peers     map[string]*peerState
+}
+
+// NewHandshakeMonitor create handshake monitor
+func NewHandshakeMonitor(threshold time.Duration) *HandshakeMonitor {
+	return &HandshakeMonitor{
+		threshold: threshold,
+		peers:     make(map[string]*peerState),
+	}
+}
+
+// Threshold stale threshold of peer, keepalive peers get at least
+// KEEPALIVE_STALE_FACTOR keepalive intervals
+func (m *HandshakeMonitor) Threshold(peer *wgtypes.Peer) time.Duration {
+	if ka := peer.PersistentKeepaliveInterval * KEEPALIVE_STALE_FACTOR; ka > m.threshold {
+		return ka
+	}
+	return m.threshold
+}
+
+// Check check peers of devices at now and return liveness transitions,
+// peers which disappeared are forgotten
+func (m *HandshakeMonitor) Check(devs []*wgtypes.Device, now time.Time) []*PeerEvent {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	events := make([]*PeerEvent, 0)
+	seen := make(map[string]bool)
+	for _, dev := range devs {
+		for i := range dev.Peers {
+			peer := &dev.Peers[i]
+			key := dev.Name + "/" + peer.PublicKey.String()
+			seen[key] = true
+			st, ok := m.peers[key]
+			if !ok {
+				st = &peerState{firstSeen: now, txBytes: peer.TransmitBytes}
+				m.peers[key] = st
+			}
+			transmitting := peer.TransmitBytes > st.txBytes
+			st.txBytes = peer.TransmitBytes
+			since := peer.LastHandshakeTime
+			if since.IsZero() {
+				since = st.firstSeen
+			}
+			threshold := m.Threshold(peer)
+			age := now.Sub(since)
+			stale := age > threshold &&
+				(peer.PersistentKeepaliveInterval > 0 || transmitting || st.stale)
+			if stale == st.stale {
+				continue
+			}
+			st.stale = stale
+			ev := &PeerEvent{
+				Device:        dev.Name,
+				PublicKey:     peer.PublicKey.String(),
+				Stale:         stale,
+				LastHandshake: peer.LastHandshakeTime,
+				Age:           age,
+				Threshold:     threshold,
+			}
+			if peer.Endpoint != nil {
+				ev.Endpoint = peer.Endpoint.String()
+			}
+			events = append(events, ev)
+		}
+	}
+	for key := range m.peers {
+		if !seen[key] {
+			delete(m.peers, key)
+		}
+	}
+	return events
+}
+
+// IsStale assert peer of device is currently stale
+func (m *HandshakeMonitor) IsStale(device, publicKey string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	st, ok := m.peers[device+"/"+publicKey]
+	return ok && st.stale
+}
@@ -0,0 +1,231 @@
+package wireguard
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// WG_QUICK_CONF_DIR directory of wg-quick interface configs
+const WG_QUICK_CONF_DIR = "/etc/wireguard"
+
+// wgQuickKeys interface keys only used by wg-quick, stripped like
+// wg-quick strip does
+var wgQuickKeys = map[string]bool{
+	"address":    true,
+	"dns":        true,
+	"mtu":        true,
+	"table":      true,
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+	"saveconfig": true,
+}
+
+// ParseQuickConfig parse wg-quick config into wgctrl device config, the
+// wg-quick only keys are ignored and endpoint hostnames are resolved
+func ParseQuickConfig(r io.Reader) (*wgtypes.Config, error) {
+	conf := &wgtypes.Config{Peers: make([]wgtypes.PeerConfig, 0)}
+	var peer *wgtypes.PeerConfig
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line[1 : len(line)-1])
+			switch section {
+			case "interface":
+			case "peer":
+				conf.Peers = append(conf.Peers, wgtypes.PeerConfig{ReplaceAllowedIPs: true})
+				peer = &conf.Peers[len(conf.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknow section [%s]", n, line)
+			}
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: invalid line [%s]", n, line)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+		var err error
+		switch section {
+		case "interface":
+			err = parseInterfaceKey(conf, key, value)
+		case "peer":
+			err = parsePeerKey(peer, key, value)
+		default:
+			err = fmt.Errorf("key outside of section")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: parse [%s] failed: %v", n, kv[0], err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read config failed: %v", err)
+	}
+	for i, p := range conf.Peers {
+		if p.PublicKey == (wgtypes.Key{}) {
+			return nil, fmt.Errorf("peer %d has no public key", i)
+		}
+	}
+	return conf, nil
+}
+
+func parseInterfaceKey(conf *wgtypes.Config, key, value string) error {
+	switch key {
+	case "privatekey":
+		k, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return err
+		}
+		conf.PrivateKey = &k
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return err
+		}
+		p := int(port)
+		conf.ListenPort = &p
+	case "fwmark":
+		mark := uint64(0)
+		if value != "off" {
+			var err error
+			if mark, err = strconv.ParseUint(value, 0, 32); err != nil {
+				return err
+			}
+		}
+		m := int(mark)
+		conf.FirewallMark = &m
+	default:
+		if !wgQuickKeys[key] {
+			return fmt.Errorf("unknow key")
+		}
+	}
+	return nil
+}
+
+func parsePeerKey(peer *wgtypes.PeerConfig, key, value string) error {
+	switch key {
+	case "publickey":
+		k, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return err
+		}
+		peer.PublicKey = k
+	case "presharedkey":
+		k, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return err
+		}
+		peer.PresharedKey = &k
+	case "allowedips":
+		for _, cidr := range strings.Split(value, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr == "" {
+				continue
+			}
+			if !strings.Contains(cidr, "/") {
+				if strings.Contains(cidr, ":") {
+					cidr += "/128"
+				} else {
+					cidr += "/32"
+				}
+			}
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return err
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, *ipnet)
+		}
+	case "endpoint":
+		ctx, cancel := context.WithTimeout(context.Background(), ENDPOINT_RESOLVE_TIMEOUT)
+		defer cancel()
+		addr, err := ResolveEndpoint(ctx, value)
+		if err != nil {
+			return err
+		}
+		peer.Endpoint = addr
+	case "persistentkeepalive":
+		seconds := uint64(0)
+		if value != "off" {
+			var err error
+			if seconds, err = strconv.ParseUint(value, 10, 16); err != nil {
+				return err
+			}
+		}
+		interval := time.Second * time.Duration(seconds)
+		peer.PersistentKeepaliveInterval = &interval
+	default:
+		return fmt.Errorf("unknow key")
+	}
+	return nil
+}
+
+// SyncConf apply wg-quick config read from r to live dev like wg syncconf
+func SyncConf(client Client, dev string, r io.Reader) error {
+	conf, err := ParseQuickConfig(r)
+	if err != nil {
+		return fmt.Errorf("reload dev [%s] parse config failed: %v", dev, err)
+	}
+	live, err := client.Device(dev)
+	if err != nil {
+		return fmt.Errorf("query dev [%s] failed: %v", dev, err)
+	}
+	if err = client.ConfigureDevice(dev, *SyncConfig(live, conf)); err != nil {
+		return fmt.Errorf("reload dev [%s] failed: %v", dev, err)
+	}
+	return nil
+}
+
+// SyncConfig change set turning live device into conf like wg syncconf,
+// peers missing from conf are removed while the others keep their
+// sessions, a listen port or preshared key absent from conf is reset
+func SyncConfig(live *wgtypes.Device, conf *wgtypes.Config) *wgtypes.Config {
+	delta := &wgtypes.Config{
+		PrivateKey:   conf.PrivateKey,
+		ListenPort:   conf.ListenPort,
+		FirewallMark: conf.FirewallMark,
+		Peers:        make([]wgtypes.PeerConfig, 0, len(conf.Peers)),
+	}
+	// nil means keep current value for wgctrl, reset it explicitly, the
+	// kernel picks a random port for 0
+	if delta.ListenPort == nil {
+		port := 0
+		delta.ListenPort = &port
+	}
+	desired := make(map[wgtypes.Key]bool)
+	for _, p := range conf.Peers {
+		desired[p.PublicKey] = true
+		p.ReplaceAllowedIPs = true
+		if p.PresharedKey == nil {
+			p.PresharedKey = &wgtypes.Key{}
+		}
+		delta.Peers = append(delta.Peers, p)
+	}
+	if live != nil {
+		for _, p := range live.Peers {
+			if !desired[p.PublicKey] {
+				delta.Peers = append(delta.Peers, wgtypes.PeerConfig{
+					PublicKey: p.PublicKey,
+					Remove:    true,
+				})
+			}
+		}
+	}
+	return delta
+}
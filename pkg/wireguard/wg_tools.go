@@ -2,9 +2,12 @@ package wireguard
 
 import (
 	"fmt"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
+	"golang.zx2c4.com/wireguard/wgctrl"
 	"ntsc.ac.cn/ta-router/pkg/iptools"
 	"ntsc.ac.cn/ta-router/pkg/rexec"
 )
@@ -13,10 +16,22 @@ type WireguardTools struct {
 	wgPath      string
 	wgQuickPath string
 	ipTools     *iptools.IPTools
+	runner      rexec.Runner
 }
 
-// NewWireguardTools new wireguard tootls
-func NewWireguardTools(wgPath, wgQuickPath string, ipToolsPath string) (*WireguardTools, error) {
+// NewWireguardTools new wireguard tootls, links are managed with ipTools
+// owned by caller
+func NewWireguardTools(wgPath, wgQuickPath string, ipTools *iptools.IPTools) (*WireguardTools, error) {
+	return NewWireguardToolsWithRunner(wgPath, wgQuickPath, ipTools, rexec.DefaultRunner)
+}
+
+// NewWireguardToolsWithRunner new wireguard tools running commands with
+// runner
+func NewWireguardToolsWithRunner(wgPath, wgQuickPath string, ipTools *iptools.IPTools,
+	runner rexec.Runner) (*WireguardTools, error) {
+	if ipTools == nil {
+		return nil, fmt.Errorf("ip tools is not define")
+	}
 	if wgPath == "" {
 		wgPath = "wg"
 	}
@@ -24,58 +39,112 @@ func NewWireguardTools(wgPath, wgQuickPath string, ipToolsPath string) (*Wiregua
 		wgQuickPath = "wg-quick"
 	}
 	var err error
-	if wgPath, err = exec.LookPath(wgPath); err != nil {
+	if wgPath, err = runner.LookPath(wgPath); err != nil {
 		return nil, fmt.Errorf("loop path [%s] failed: %v", wgPath, err)
 	}
-	if wgQuickPath, err = exec.LookPath(wgQuickPath); err != nil {
+	if wgQuickPath, err = runner.LookPath(wgQuickPath); err != nil {
 		return nil, fmt.Errorf("loop path [%s] failed: %v", wgQuickPath, err)
 	}
-	iptools, err := iptools.NewIPTools(ipToolsPath)
-	if err != nil {
-		return nil, err
-	}
 	return &WireguardTools{
 		wgPath:      wgPath,
 		wgQuickPath: wgQuickPath,
-		ipTools:     iptools,
+		ipTools:     ipTools,
+		runner:      runner,
 	}, nil
 }
 
+// run run command with runner
+func (wt *WireguardTools) run(name, path string, args []string) (string, error) {
+	return wt.runner.Run(&rexec.Command{Name: name, Path: path, Args: args})
+}
+
+const (
+	// PROC_ROOT mount point of proc filesystem
+	PROC_ROOT         = "/proc"
+	IPV4_FORWARD_PATH = PROC_ROOT + "/sys/net/ipv4/ip_forward"
+	IPV6_FORWARD_PATH = PROC_ROOT + "/sys/net/ipv6/conf/all/forwarding"
+)
+
+// IPForward ip forward sysctl of proc filesystem mounted at ProcRoot,
+// PROC_ROOT when empty or nil
+type IPForward struct {
+	ProcRoot string
+}
+
+func (f *IPForward) path(path string) string {
+	if f == nil || f.ProcRoot == "" {
+		return path
+	}
+	return filepath.Join(f.ProcRoot, strings.TrimPrefix(path, PROC_ROOT))
+}
+
+// IPv4Path ipv4 forward sysctl file
+func (f *IPForward) IPv4Path() string {
+	return f.path(IPV4_FORWARD_PATH)
+}
+
+// IPv6Path ipv6 forward sysctl file
+func (f *IPForward) IPv6Path() string {
+	return f.path(IPV6_FORWARD_PATH)
+}
+
+// IsIPv4Enable assert ipv4 forward enabled
+func (f *IPForward) IsIPv4Enable() (bool, error) {
+	return isForwardEnable(f.IPv4Path())
+}
+
+// EnableIPv4 enable ipv4 forward
+func (f *IPForward) EnableIPv4() error {
+	return enableForward(f.IPv4Path())
+}
+
+// IsIPv6Enable assert ipv6 forward enabled
+func (f *IPForward) IsIPv6Enable() (bool, error) {
+	return isForwardEnable(f.IPv6Path())
+}
+
+// EnableIPv6 enable ipv6 forward
+func (f *IPForward) EnableIPv6() error {
+	return enableForward(f.IPv6Path())
+}
+
 // IsIPv4ForwardEnable assert is system ipv4 forward enabled
 func IsIPv4ForwardEnable() (bool, error) {
-	exe, err := rexec.NewExecuter("cat_ipv4_forward",
-		"cat", []string{"/proc/sys/net/ipv4/ip_forward"})
-	if err != nil {
-		return false, fmt.Errorf(
-			"exec cat ip forward failed: %s", err.Error())
-	}
-	result, err := exe.Run()
-	if err != nil {
-		return false, fmt.Errorf(
-			"exec cat ip forward failed: %s", result)
-	}
-	r, err := strconv.Atoi(result)
-	if err != nil {
-		return false, fmt.Errorf("parse cat ip forward result failed: %s", err.Error())
-	}
-	if r == 1 {
-		return true, nil
-	}
-	return false, nil
+	return (&IPForward{}).IsIPv4Enable()
 }
 
 // EnableIPv4Forward enable system ipv4 forward
 func EnableIPv4Forward() error {
-	exe, err := rexec.NewExecuter("enable_ipv4_forward",
-		"bash", []string{"-c", "echo 1 > /proc/sys/net/ipv4/ip_forward"})
+	return (&IPForward{}).EnableIPv4()
+}
+
+// IsIPv6ForwardEnable assert is system ipv6 forward enabled
+func IsIPv6ForwardEnable() (bool, error) {
+	return (&IPForward{}).IsIPv6Enable()
+}
+
+// EnableIPv6Forward enable system ipv6 forward
+func EnableIPv6Forward() error {
+	return (&IPForward{}).EnableIPv6()
+}
+
+func isForwardEnable(path string) (bool, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf(
-			"enable ip forward failed: %s", err.Error())
+		return false, fmt.Errorf(
+			"read ip forward [%s] failed: %s", path, err.Error())
 	}
-	result, err := exe.Run()
+	r, err := strconv.Atoi(strings.TrimSpace(string(data)))
 	if err != nil {
+		return false, fmt.Errorf("parse ip forward [%s] failed: %s", path, err.Error())
+	}
+	return r == 1, nil
+}
+
+func enableForward(path string) error {
+	if err := os.WriteFile(path, []byte("1\n"), 0644); err != nil {
 		return fmt.Errorf(
-			"enable ip forward failed: %s", result)
+			"enable ip forward [%s] failed: %s", path, err.Error())
 	}
 	return nil
 }
@@ -102,13 +171,8 @@ func (qt QuickType) String() string {
 
 // Quick wireguard wg-quick tools executer
 func (wt *WireguardTools) Quick(confPath string, quickType QuickType) error {
-	exe, err := rexec.NewExecuter("wg-quick-op",
+	result, err := wt.run("wg-quick-op",
 		wt.wgQuickPath, []string{quickType.String(), confPath})
-	if err != nil {
-		return fmt.Errorf(
-			"enable ip forward failed: %s", err.Error())
-	}
-	result, err := exe.Run()
 	if err != nil {
 		return fmt.Errorf(
 			"enable ip forward failed: %s", result)
@@ -122,21 +186,23 @@ func (wt *WireguardTools) RestartDev(confPath string) error {
 	return wt.Quick(confPath, QUICK_TYPE_UP)
 }
 
-// ReloadDev reload wireguard interface with dev name
+// ReloadDev reload wireguard interface from its wg-quick config like
+// wg syncconf <dev> <(wg-quick strip <dev>) without a shell
 func (wt *WireguardTools) ReloadDev(dev string) error {
-	cmd := "WGNET=" + dev + ";wg syncconf ${WGNET} <(wg-quick strip ${WGNET})"
-	exe, err := rexec.NewExecuter("wg-reload",
-		"bash", []string{"-c", cmd})
+	if err := iptools.CheckLinkName(dev); err != nil {
+		return fmt.Errorf("reload dev failed: %v", err)
+	}
+	f, err := os.Open(filepath.Join(WG_QUICK_CONF_DIR, dev+".conf"))
 	if err != nil {
-		return fmt.Errorf(
-			"reload dev failed: %s", err.Error())
+		return fmt.Errorf("reload dev [%s] failed: %v", dev, err)
 	}
-	result, err := exe.Run()
+	defer f.Close()
+	client, err := wgctrl.New()
 	if err != nil {
-		return fmt.Errorf(
-			"reload dev [%s] failed: %s", dev, result)
+		return fmt.Errorf("open wireguard ctrl client failed: %v", err)
 	}
-	return nil
+	defer client.Close()
+	return SyncConf(client, dev, f)
 }
 
 // DelWireguardInterface delete wireguard interface
@@ -148,22 +214,9 @@ func (wt *WireguardTools) AddWireguardInterface(name string) error {
 	return wt.ipTools.AddLink(name, "wireguard")
 }
 
+// UpDevice set wireguard dev mtu to 1420 and up
 func (wt *WireguardTools) UpDevice(name string) error {
-	args := make([]string, 0)
-	args = append(args, "link")
-	args = append(args, "set")
-	args = append(args, "mtu")
-	args = append(args, "1420")
-	args = append(args, "up")
-	args = append(args, "dev")
-	args = append(args, name)
-	exe, err := rexec.NewExecuter("ip",
-		wt.ipTools.IPToolsPath(), args)
-	if err != nil {
-		return fmt.Errorf(
-			"set mtu and up wireguard dev [%s] failed: %v", name, err)
-	}
-	if _, err = exe.Run(); err != nil {
+	if err := wt.ipTools.SetLinkUp(name, 1420); err != nil {
 		return fmt.Errorf(
 			"set mtu and up wireguard dev [%s] failed: %v", name, err)
 	}
@@ -0,0 +1,167 @@
+package wireguardtest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Configure config applied to device by fake client
+type Configure struct {
+	Device string
+	Config wgtypes.Config
+}
+
+// FakeClient in memory wireguard ctrl client for tests, configs are
+// applied to the devices like the kernel does
+type FakeClient struct {
+	lock       sync.Mutex
+	devices    map[string]*wgtypes.Device
+	configures []*Configure
+	closes     int
+}
+
+// NewFakeClient create fake client with existing devices
+func NewFakeClient(devices ...*wgtypes.Device) *FakeClient {
+	f := &FakeClient{devices: make(map[string]*wgtypes.Device)}
+	for _, dev := range devices {
+		f.devices[dev.Name] = copyDevice(dev)
+	}
+	return f
+}
+
+// Devices implement wireguard.Client
+func (f *FakeClient) Devices() ([]*wgtypes.Device, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	devs := make([]*wgtypes.Device, 0, len(f.devices))
+	for _, dev := range f.devices {
+		devs = append(devs, copyDevice(dev))
+	}
+	return devs, nil
+}
+
+// Device implement wireguard.Client
+func (f *FakeClient) Device(name string) (*wgtypes.Device, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dev, ok := f.devices[name]
+	if !ok {
+		return nil, fmt.Errorf("device [%s]: %w", name, os.ErrNotExist)
+	}
+	return copyDevice(dev), nil
+}
+
+// ConfigureDevice implement wireguard.Client
+func (f *FakeClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dev, ok := f.devices[name]
+	if !ok {
+		return fmt.Errorf("device [%s]: %w", name, os.ErrNotExist)
+	}
+	f.configures = append(f.configures, &Configure{Device: name, Config: cfg})
+	if cfg.PrivateKey != nil {
+		dev.PrivateKey = *cfg.PrivateKey
+		dev.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ListenPort != nil {
+		dev.ListenPort = *cfg.ListenPort
+	}
+	if cfg.ReplacePeers {
+		dev.Peers = nil
+	}
+	for _, pc := range cfg.Peers {
+		i := -1
+		for j := range dev.Peers {
+			if dev.Peers[j].PublicKey == pc.PublicKey {
+				i = j
+			}
+		}
+		if pc.Remove {
+			if i >= 0 {
+				dev.Peers = append(dev.Peers[:i], dev.Peers[i+1:]...)
+			}
+			continue
+		}
+		if i < 0 {
+			if pc.UpdateOnly {
+				continue
+			}
+			dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: pc.PublicKey})
+			i = len(dev.Peers) - 1
+		}
+		peer := &dev.Peers[i]
+		if pc.PresharedKey != nil {
+			peer.PresharedKey = *pc.PresharedKey
+		}
+		if pc.Endpoint != nil {
+			peer.Endpoint = pc.Endpoint
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		if pc.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, pc.AllowedIPs...)
+	}
+	return nil
+}
+
+// Close implement wireguard.Client
+func (f *FakeClient) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closes++
+	return nil
+}
+
+// SetPeer replace live peer of device with the same public key, the peer
+// is added when absent
+func (f *FakeClient) SetPeer(name string, peer wgtypes.Peer) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dev, ok := f.devices[name]
+	if !ok {
+		return
+	}
+	for i := range dev.Peers {
+		if dev.Peers[i].PublicKey == peer.PublicKey {
+			dev.Peers[i] = peer
+			return
+		}
+	}
+	dev.Peers = append(dev.Peers, peer)
+}
+
+// Configures configs applied so far
+func (f *FakeClient) Configures() []*Configure {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*Configure{}, f.configures...)
+}
+
+// Closes times client is closed
+func (f *FakeClient) Closes() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.closes
+}
+
+func copyDevice(dev *wgtypes.Device) *wgtypes.Device {
+	c := *dev
+	c.Peers = make([]wgtypes.Peer, 0, len(dev.Peers))
+	for _, p := range dev.Peers {
+		if p.Endpoint != nil {
+			ep := *p.Endpoint
+			p.Endpoint = &ep
+		}
+		p.AllowedIPs = append([]net.IPNet{}, p.AllowedIPs...)
+		c.Peers = append(c.Peers, p)
+	}
+	return &c
+}
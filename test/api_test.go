@@ -0,0 +1,207 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/internal/router"
+)
+
+func apiRequest(h http.Handler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestAPIHandler(t *testing.T) {
+	tr := newTestRouter(t, nil)
+	psk, _ := wgtypes.GenerateKey()
+	tr.desired.Wireguard[0].Peers[0].PsKey = psk.String()
+	tr.start(t)
+	defer tr.Stop(context.Background())
+	h := tr.APIHandler()
+
+	// private and preshared keys are redacted
+	w := apiRequest(h, http.MethodGet, "/v1/config")
+	if w.Code != http.StatusOK {
+		t.Fatalf("get config failed: %d %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, tr.key.String()) || strings.Contains(body, psk.String()) {
+		t.Fatalf("keys not redacted:\n%s", body)
+	}
+	conf := &registry.DesiredConfig{}
+	if err := json.Unmarshal(w.Body.Bytes(), conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Wireguard) != 1 || conf.Wireguard[0].PrivKey != "" ||
+		conf.Wireguard[0].Peers[0].PsKey != "" ||
+		conf.Wireguard[0].Peers[0].PubKey != tr.peer.PublicKey().String() {
+		t.Fatalf("unexpected redacted config:\n%s", body)
+	}
+	if tr.desired.Wireguard[0].PrivKey == "" {
+		t.Fatalf("desired config redacted in place")
+	}
+
+	// actions are post only, queries get only
+	for _, path := range []string{"/v1/resync", "/v1/reload"} {
+		w = apiRequest(h, http.MethodGet, path)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+			t.Fatalf("get %s not rejected: %d", path, w.Code)
+		}
+	}
+	if w = apiRequest(h, http.MethodPost, "/v1/config"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("post config not rejected: %d", w.Code)
+	}
+	w = apiRequest(h, http.MethodPost, "/v1/reload")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), tr.desired.Revision()) {
+		t.Fatalf("reload failed: %d %s", w.Code, w.Body)
+	}
+	w = apiRequest(h, http.MethodPost, "/v1/resync")
+	if w.Code != http.StatusOK || tr.source.Fetchs() < 2 {
+		t.Fatalf("resync failed: %d %s", w.Code, w.Body)
+	}
+}
+
+// writeAPICerts write ca signed router certificate to certPath, the client
+// certificate signed by the same ca is returned
+func writeAPICerts(t *testing.T, certPath string) tls.Certificate {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ta test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	leaf := func(serial int64) ([]byte, []byte) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "ta test"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+	if err = os.MkdirAll(certPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := leaf(2)
+	for name, data := range map[string][]byte{
+		router.CLIENT_CERT_NAME:        certPEM,
+		router.CLIENT_PRIVATE_KEY_NAME: keyPEM,
+		router.TRUSTED_CERT_CHAIN_NAME: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+	} {
+		if err = os.WriteFile(filepath.Join(certPath, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client, err := tls.X509KeyPair(leaf(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestAPIListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	socket := filepath.Join(t.TempDir(), "api", "api.sock")
+	tr := newTestRouter(t, func(conf *router.Config) {
+		conf.APISocket = socket
+		conf.APIAddr = addr
+	})
+	client := writeAPICerts(t, tr.conf.CertPath)
+	tr.start(t)
+	defer tr.Stop(context.Background())
+
+	// unix socket is accessible by owner only
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = unixClient.Get("http://router/v1/history"); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if err != nil {
+		t.Fatalf("query api on unix socket failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected history status: %d", resp.StatusCode)
+	}
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("unexpected socket mode: %o", mode)
+	}
+
+	// tcp listener requires a client certificate of the trusted chain
+	caPEM, _ := os.ReadFile(filepath.Join(tr.conf.CertPath, router.TRUSTED_CERT_CHAIN_NAME))
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	tlsClient := func(certs []tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: certs,
+		}}}
+	}
+	if resp, err = tlsClient(nil).Get("https://" + addr + "/v1/history"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("client without certificate accepted: %d", resp.StatusCode)
+	}
+	resp, err = tlsClient([]tls.Certificate{client}).Get("https://" + addr + "/v1/history")
+	if err != nil {
+		t.Fatalf("query api with client certificate failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected history status: %d", resp.StatusCode)
+	}
+}
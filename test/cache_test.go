@@ -0,0 +1,69 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ntsc.ac.cn/ta-router/internal/registry"
+)
+
+func TestConfigCache(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(keyPath, []byte("client private key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := &registry.CacheStore{
+		Path:      filepath.Join(dir, "state", "config.cache"),
+		KeyPath:   keyPath,
+		MachineID: "machine-a",
+	}
+	conf := &registry.DesiredConfig{
+		DNSServer: []string{"192.0.2.53"},
+		Wireguard: []*registry.WireguardConfig{{Name: "wg0", Address: "10.0.0.1/24"}},
+	}
+	if err := store.Save(conf); err != nil {
+		t.Fatalf("save config cache failed: %v", err)
+	}
+	cache, err := store.Load()
+	if err != nil {
+		t.Fatalf("load config cache failed: %v", err)
+	}
+	if cache.Revision != conf.Revision() || cache.Config.Revision() != conf.Revision() ||
+		cache.SavedAt.IsZero() {
+		t.Fatalf("unexpected config cache: %+v", cache)
+	}
+
+	// another router can not decrypt the cache
+	other := *store
+	other.MachineID = "machine-b"
+	if _, err = other.Load(); err == nil {
+		t.Fatalf("cache loaded with another machine id")
+	}
+
+	sealed, err := os.ReadFile(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 0x01
+	for name, data := range map[string][]byte{
+		"tampered":  tampered,
+		"truncated": sealed[:len(sealed)/2],
+		"short":     sealed[:4],
+		"empty":     {},
+	} {
+		if err = os.WriteFile(store.Path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.Load(); err == nil {
+			t.Fatalf("%s config cache loaded", name)
+		}
+	}
+
+	os.Remove(store.Path)
+	if _, err = store.Load(); err == nil {
+		t.Fatalf("missing config cache loaded")
+	}
+}
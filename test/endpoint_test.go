@@ -0,0 +1,59 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+)
+
+func TestResolveEndpoint(t *testing.T) {
+	for _, bad := range []string{"hub.example.com", "hub.example.com:0", ":51820", "[::1]:x"} {
+		if _, _, err := wireguard.SplitEndpoint(bad); err == nil {
+			t.Fatalf("bad endpoint [%s] accepted", bad)
+		}
+	}
+	addr, err := wireguard.ResolveEndpoint(context.Background(), "[fd00::1]:51820")
+	if err != nil || addr.String() != "[fd00::1]:51820" {
+		t.Fatalf("resolve ip endpoint failed: %v, %v", addr, err)
+	}
+	addr, err = wireguard.ResolveEndpoint(context.Background(), "localhost:51820")
+	if err != nil || !addr.IP.IsLoopback() || addr.Port != 51820 {
+		t.Fatalf("resolve hostname endpoint failed: %v, %v", addr, err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	peer := &wgtypes.Peer{
+		Endpoint:          &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51820},
+		LastHandshakeTime: now.Add(-time.Minute),
+	}
+	if wireguard.EndpointChanged(peer, addr) {
+		t.Fatalf("same endpoint reported as changed")
+	}
+	if wireguard.NeedReresolve(peer, now) {
+		t.Fatalf("peer with recent handshake re-resolved")
+	}
+	peer.LastHandshakeTime = now.Add(-wireguard.ENDPOINT_RERESOLVE_AGE - time.Second)
+	if !wireguard.NeedReresolve(peer, now) {
+		t.Fatalf("peer with stale handshake not re-resolved")
+	}
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	p := &registry.WireguardPeer{
+		PubKey:   key.PublicKey().String(),
+		PeerAddr: "10.0.0.2/32",
+		Endpoint: "192.0.2.1:51820",
+	}
+	pc, err := p.PeerConfig()
+	if err != nil || pc.Endpoint == nil || pc.Endpoint.String() != "192.0.2.1:51820" {
+		t.Fatalf("ip endpoint not configured: %v, %v", pc, err)
+	}
+	p.Endpoint = "hub.example.com:51820"
+	if pc, err = p.PeerConfig(); err != nil || pc.Endpoint != nil {
+		t.Fatalf("hostname endpoint should be left to resolver: %v, %v", pc, err)
+	}
+}
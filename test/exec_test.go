@@ -0,0 +1,144 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+)
+
+func TestExecuterContext(t *testing.T) {
+	exe, err := rexec.NewExecuter("sh", "sh", []string{"-c",
+		"echo out; echo err >&2; echo $TA_TEST $(pwd); exit 3"})
+	if err != nil {
+		t.Fatalf("create executer failed: %v", err)
+	}
+	exe.Env = []string{"TA_TEST=env"}
+	exe.Dir = "/"
+	res := <-exe.StartContext(context.Background())
+	if res.Error == nil || res.ExitCode != 3 {
+		t.Fatalf("exit code not reported: %d, %v", res.ExitCode, res.Error)
+	}
+	if res.Stdout != "out\nenv /\n" || res.Stderr != "err\n" {
+		t.Fatalf("unexpected output: stdout %q stderr %q", res.Stdout, res.Stderr)
+	}
+	if code := rexec.ExitCode(res.Error); code != 3 {
+		t.Fatalf("exit code not carried by error: %d", code)
+	}
+	if rexec.ExitCode(nil) != 0 || rexec.ExitCode(context.Canceled) != -1 {
+		t.Fatalf("unexpected exit code of error without code")
+	}
+
+	// a grandchild holding the output pipe must die with the group
+	exe, _ = rexec.NewExecuter("sh", "sh", []string{"-c", "sleep 30 & sleep 30"})
+	exe.Timeout = time.Millisecond * 200
+	start := time.Now()
+	if _, err = exe.Run(); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("timeout not reported: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("process group not killed, run took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exe, _ = rexec.NewExecuter("sleep", "sleep", []string{"30"})
+	time.AfterFunc(time.Millisecond*100, cancel)
+	if _, err = exe.RunContext(ctx); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("cancel not reported: %v", err)
+	}
+	if err = (&rexec.Executer{Name: "idle"}).Stop(); err == nil {
+		t.Fatalf("stop of idle executer not rejected")
+	}
+}
+
+func TestExecuterStream(t *testing.T) {
+	exe, err := rexec.NewExecuter("sh", "sh", []string{"-c",
+		"echo one; echo two >&2; sleep 0.3; printf three"})
+	if err != nil {
+		t.Fatalf("create executer failed: %v", err)
+	}
+	var lock sync.Mutex
+	lines := make([]rexec.Line, 0)
+	exe.OnLine = func(line rexec.Line) {
+		lock.Lock()
+		defer lock.Unlock()
+		lines = append(lines, line)
+	}
+	var passthrough bytes.Buffer
+	exe.Stdout = &passthrough
+	result := exe.Start()
+	select {
+	case res := <-result:
+		t.Fatalf("start not asynchronous: %+v", res)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if res := <-exe.Start(); res.Error == nil || !strings.Contains(res.Error.Error(), "already running") {
+		t.Fatalf("second start not rejected: %v", res.Error)
+	}
+	res := <-result
+	if res.Error != nil || res.Stdout != "one\nthree" || res.Stderr != "two\n" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if waited := exe.Wait(); waited.Combined != res.Combined || waited.ExitCode != 0 {
+		t.Fatalf("wait result differs: %+v", waited)
+	}
+	if passthrough.String() != res.Stdout {
+		t.Fatalf("stdout writer not written: %q", passthrough.String())
+	}
+	lock.Lock()
+	// order is kept within a stream only
+	if len(lines) != 3 || lines[2] != (rexec.Line{Stream: rexec.STREAM_STDOUT, Text: "three"}) ||
+		(lines[0].Text != "two" && lines[1] != (rexec.Line{Stream: rexec.STREAM_STDERR, Text: "two"})) {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+	lock.Unlock()
+	if err = exe.Stop(); err == nil {
+		t.Fatalf("stop of exited executer not rejected")
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	sv, err := rexec.NewSupervisor("sh", "sh", []string{"-c", "echo up; exit 1"})
+	if err != nil {
+		t.Fatalf("create supervisor failed: %v", err)
+	}
+	sv.MinBackoff, sv.MaxBackoff = time.Millisecond*10, time.Millisecond*40
+	ups := make(chan struct{}, 64)
+	sv.OnLine = func(line rexec.Line) {
+		if line.Text == "up" {
+			select {
+			case ups <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if err = sv.Start(context.Background()); err != nil {
+		t.Fatalf("start supervisor failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ups:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("process not restarted, restarts %d", sv.Restarts())
+		}
+	}
+	sv.Stop()
+	if sv.Restarts() < 2 {
+		t.Fatalf("unexpected restarts: %d", sv.Restarts())
+	}
+
+	sv, _ = rexec.NewSupervisor("sleep", "sleep", []string{"30"})
+	exits := 0
+	sv.OnExit = func(res rexec.ExecResult) { exits++ }
+	sv.Start(context.Background())
+	time.Sleep(time.Millisecond * 100)
+	start := time.Now()
+	sv.Stop()
+	if time.Since(start) > time.Second*5 || exits != 0 {
+		t.Fatalf("stop not killing process: %s, exits %d", time.Since(start), exits)
+	}
+}
@@ -0,0 +1,68 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+)
+
+func newProcRoot(t *testing.T, v4, v6 string) *wireguard.IPForward {
+	forward := &wireguard.IPForward{ProcRoot: t.TempDir()}
+	for path, value := range map[string]string{forward.IPv4Path(): v4, forward.IPv6Path(): v6} {
+		if value == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return forward
+}
+
+func TestIPForward(t *testing.T) {
+	if p := (&wireguard.IPForward{}).IPv6Path(); p != wireguard.IPV6_FORWARD_PATH {
+		t.Fatalf("unexpected default ipv6 forward path: %s", p)
+	}
+	forward := newProcRoot(t, "0\n", "0\n")
+	if !strings.HasSuffix(forward.IPv4Path(), "/sys/net/ipv4/ip_forward") ||
+		!strings.HasSuffix(forward.IPv6Path(), "/sys/net/ipv6/conf/all/forwarding") ||
+		!strings.HasPrefix(forward.IPv4Path(), forward.ProcRoot) {
+		t.Fatalf("unexpected forward paths: %s, %s", forward.IPv4Path(), forward.IPv6Path())
+	}
+	for _, family := range []struct {
+		name   string
+		check  func() (bool, error)
+		enable func() error
+	}{
+		{"ipv4", forward.IsIPv4Enable, forward.EnableIPv4},
+		{"ipv6", forward.IsIPv6Enable, forward.EnableIPv6},
+	} {
+		if enabled, err := family.check(); err != nil || enabled {
+			t.Fatalf("%s forward: %v, %v", family.name, enabled, err)
+		}
+		if err := family.enable(); err != nil {
+			t.Fatalf("enable %s forward failed: %v", family.name, err)
+		}
+		if enabled, err := family.check(); err != nil || !enabled {
+			t.Fatalf("%s forward not enabled: %v", family.name, err)
+		}
+	}
+
+	// missing sysctl and garbage values are errors
+	broken := newProcRoot(t, "", "yes\n")
+	if _, err := broken.IsIPv4Enable(); err == nil {
+		t.Fatalf("missing ipv4 forward accepted")
+	}
+	if _, err := broken.IsIPv6Enable(); err == nil {
+		t.Fatalf("bad ipv6 forward accepted")
+	}
+	if err := broken.EnableIPv4(); err == nil {
+		t.Fatalf("enable missing ipv4 forward accepted")
+	}
+}
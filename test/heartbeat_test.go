@@ -0,0 +1,77 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/internal/registry/registrytest"
+)
+
+func TestHeartbeat(t *testing.T) {
+	fake := registrytest.NewFakeRegistry(testDesiredConfig(51820))
+	revision := testDesiredConfig(51820).Revision()
+	hb := registry.NewHeartbeat(fake, time.Millisecond*20, func() (*registry.StatusReport, error) {
+		return &registry.StatusReport{
+			Revision: revision,
+			Interfaces: []*registry.InterfaceStatus{{
+				Name: "wg0",
+				Up:   true,
+			}},
+		}, nil
+	})
+	ctx := context.Background()
+
+	hb.RecordError(fmt.Errorf("apply config failed"))
+	fake.SetReportError(fmt.Errorf("registry unavailable"))
+	if err := hb.Beat(ctx); err == nil {
+		t.Fatalf("beat should fail while registry unavailable")
+	}
+	fake.SetReportError(nil)
+	if err := hb.Beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := hb.Beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	reports := fake.Reports()
+	if len(reports) != 2 {
+		t.Fatalf("expect 2 reports, got %d", len(reports))
+	}
+	if reports[0].Revision != revision || len(reports[0].Interfaces) != 1 ||
+		reports[0].ReportedAt.IsZero() {
+		t.Fatalf("unexpected report: %+v", reports[0])
+	}
+	if len(reports[0].Errors) != 1 || reports[0].Errors[0] != "apply config failed" {
+		t.Fatalf("pending error not reported after failure: %v", reports[0].Errors)
+	}
+	if len(reports[1].Errors) != 0 {
+		t.Fatalf("reported error sent again: %v", reports[1].Errors)
+	}
+
+	hb.MaxErrors = 2
+	for i := 0; i < 5; i++ {
+		hb.RecordError(fmt.Errorf("error %d", i))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		hb.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(fake.Reports()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	cancel()
+	<-done
+	reports = fake.Reports()
+	if len(reports) < 4 {
+		t.Fatalf("heartbeat run reported %d times", len(reports))
+	}
+	if errs := reports[2].Errors; len(errs) != 2 || errs[0] != "error 3" {
+		t.Fatalf("pending errors not bounded: %v", errs)
+	}
+}
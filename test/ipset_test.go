@@ -0,0 +1,128 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+)
+
+func TestRestoreSet(t *testing.T) {
+	fake := rexectest.NewFakeRunner()
+	ipt, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV4, "", "", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Expect("ipset restore -exist", "", nil)
+	if err = ipt.RestoreSet("ta-peers", iptables.SET_HASH_IP_PORT,
+		[]string{"10.0.0.2,tcp:22", "10.0.0.3,53"}); err != nil {
+		t.Fatalf("restore set failed: %v", err)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	want := "create ta-peers hash:ip,port family inet\n" +
+		"create ta-peers-swap hash:ip,port family inet\n" +
+		"flush ta-peers-swap\n" +
+		"add ta-peers-swap 10.0.0.2,tcp:22\n" +
+		"add ta-peers-swap 10.0.0.3,53\n" +
+		"swap ta-peers-swap ta-peers\n" +
+		"destroy ta-peers-swap\n"
+	if stdin := fake.Calls()[0].Stdin; stdin != want {
+		t.Fatalf("unexpected restore script:\n%s", stdin)
+	}
+
+	bad := []struct {
+		setType iptables.SetType
+		entry   string
+	}{
+		{iptables.SET_HASH_IP, "10.0.0.2\ndestroy other"},
+		{iptables.SET_HASH_IP, "10.0.0.2 -exist"},
+		{iptables.SET_HASH_IP, "10.0.0.0/24"},
+		{iptables.SET_HASH_IP, "fd00::1"},
+		{iptables.SET_HASH_NET, "10.0.0.0/33"},
+		{iptables.SET_HASH_IP_PORT, "10.0.0.2"},
+		{iptables.SET_HASH_IP_PORT, "10.0.0.2,icmp:8"},
+		{iptables.SET_HASH_IP_PORT, "10.0.0.2,tcp:70000"},
+		{iptables.SetType("hash:mac"), "00:11:22:33:44:55"},
+	}
+	for _, b := range bad {
+		if err = ipt.RestoreSet("ta-peers", b.setType, []string{b.entry}); err == nil {
+			t.Fatalf("bad %s entry %q not rejected", b.setType, b.entry)
+		}
+	}
+	if err = ipt.RestoreSet("ta peers", iptables.SET_HASH_NET, nil); err == nil {
+		t.Fatalf("bad set name not rejected")
+	}
+	if len(fake.Calls()) != 1 {
+		t.Fatalf("rejected entries reached ipset: %+v", fake.Calls()[1:])
+	}
+}
+
+func TestIPSetEntries(t *testing.T) {
+	fake := rexectest.NewFakeRunner()
+	ipt, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV6, "", "", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Expect("ipset add ta-peers fd00::2 -exist", "", nil).
+		Expect("ipset del ta-nets fd00:1::/64 -exist", "", nil)
+	if err = ipt.AddEntry("ta-peers", iptables.SET_HASH_IP, "fd00::2"); err != nil {
+		t.Fatalf("add entry failed: %v", err)
+	}
+	if err = ipt.DelEntry("ta-nets", iptables.SET_HASH_NET, "fd00:1::/64"); err != nil {
+		t.Fatalf("delete entry failed: %v", err)
+	}
+
+	// bad names and entries of other family or type never reach ipset
+	for _, name := range []string{"", "-exist", "ta peers", "ta-peers-of-a-very-long-name"} {
+		if ipt.DestroySet(name) == nil || ipt.AddEntry(name, iptables.SET_HASH_IP, "fd00::2") == nil ||
+			ipt.DelEntry(name, iptables.SET_HASH_IP, "fd00::2") == nil {
+			t.Fatalf("bad set name %q not rejected", name)
+		}
+	}
+	for _, entry := range []string{"10.0.0.2", "fd00::/64", "fd00::2 -exist", "fd00::2\nflush"} {
+		if ipt.AddEntry("ta-peers", iptables.SET_HASH_IP, entry) == nil ||
+			ipt.DelEntry("ta-peers", iptables.SET_HASH_IP, entry) == nil {
+			t.Fatalf("bad entry %q not rejected", entry)
+		}
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDestroySet(t *testing.T) {
+	fake := rexectest.NewFakeRunner()
+	ipt, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV4, "", "", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// absent set is ignored
+	fake.Expect("ipset destroy ta-peers",
+		"ipset v7.15: The set with the given name does not exist", rexectest.ExitError(1)).
+		Expect("ipset list -name", "ta-other\n", nil)
+	if err = ipt.DestroySet("ta-peers"); err != nil {
+		t.Fatalf("destroy absent set failed: %v", err)
+	}
+
+	// set in use and bad parameters are reported
+	fake.Expect("ipset destroy ta-peers",
+		"ipset v7.15: Set cannot be destroyed: it is in use by a kernel component", rexectest.ExitError(1)).
+		Expect("ipset list -name", "ta-other\nta-peers\n", nil).
+		Expect("ipset destroy ta-peers", "ipset v7.15: Syntax error", rexectest.ExitError(2))
+	if err = ipt.DestroySet("ta-peers"); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("destroy set in use not reported: %v", err)
+	}
+	if err = ipt.DestroySet("ta-peers"); err == nil {
+		t.Fatalf("destroy failure not reported")
+	}
+	fake.Expect("ipset destroy ta-peers", "", nil)
+	if err = ipt.DestroySet("ta-peers"); err != nil {
+		t.Fatalf("destroy set failed: %v", err)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
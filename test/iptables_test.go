@@ -0,0 +1,266 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+)
+
+func TestRulesetRestore(t *testing.T) {
+	rs := iptables.NewRuleset()
+	rs.AddChain("nat", "TA-POSTROUTING")
+	rs.AppendRule("nat", "TA-POSTROUTING", []string{
+		"-s", "10.0.0.0/24", "-o", "eth0", "-j", "MASQUERADE"})
+	rs.InsertRule("nat", "POSTROUTING", []string{"-j", "TA-POSTROUTING"})
+	rs.AddChain("filter", "TA-FORWARD")
+	expect := "*nat\n" +
+		":TA-POSTROUTING - [0:0]\n" +
+		"-A TA-POSTROUTING -s 10.0.0.0/24 -o eth0 -j MASQUERADE\n" +
+		"-I POSTROUTING -j TA-POSTROUTING\n" +
+		"COMMIT\n" +
+		"*filter\n" +
+		":TA-FORWARD - [0:0]\n" +
+		"COMMIT\n"
+	if rs.String() != expect {
+		t.Fatalf("unexpected ruleset:\n%s", rs.String())
+	}
+
+	save := "# Generated by iptables-save\n" +
+		"*nat\n" +
+		":PREROUTING ACCEPT [0:0]\n" +
+		":POSTROUTING ACCEPT [3:180]\n" +
+		":TA-POSTROUTING - [0:0]\n" +
+		"-A POSTROUTING -j TA-POSTROUTING\n" +
+		"-A TA-POSTROUTING -s 10.0.0.0/24 -o eth0 -j MASQUERADE\n" +
+		"COMMIT\n"
+	dumps, err := iptables.ParseSave(strings.NewReader(save))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumps) != 1 || dumps[0].Name != "nat" {
+		t.Fatalf("unexpected dumps: %v", dumps)
+	}
+	nat := dumps[0]
+	if c := nat.Chain("TA-POSTROUTING"); c == nil || !c.IsCustomChain() {
+		t.Fatalf("custom chain not parsed")
+	}
+	if c := nat.Chain("POSTROUTING"); c == nil || c.Policy != "ACCEPT" {
+		t.Fatalf("built-in chain policy not parsed")
+	}
+	got := strings.Join(nat.Rules["TA-POSTROUTING"], "\n")
+	want := strings.Join(rs.ChainRules("nat", "TA-POSTROUTING"), "\n")
+	if got != want {
+		t.Fatalf("saved rules [%s] differ from ruleset [%s]", got, want)
+	}
+	if iptables.FormatRuleSpec([]string{"-m", "comment", "--comment", "ta router"}) !=
+		`-m comment --comment "ta router"` {
+		t.Fatalf("argument with space not quoted")
+	}
+}
+
+func TestRuleSpec(t *testing.T) {
+	line := `-A TA-FORWARD ! -s 10.0.0.0/8 -i wg0 -p tcp -m tcp --dport 443 ` +
+		`-m set ! --match-set allow src,dst -m comment --comment "ta router" ` +
+		`-j DNAT --to-destination 10.0.0.2:443`
+	spec, err := iptables.ParseRuleSpec(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Chain != "TA-FORWARD" || spec.InIface() != "wg0" ||
+		spec.Protocol() != "tcp" || spec.Source() != "10.0.0.0/8" {
+		t.Fatalf("unexpected basic matches: %s", spec)
+	}
+	if !spec.Basic[0].Negate {
+		t.Fatalf("source negation not parsed")
+	}
+	if o := spec.Match("tcp").Option("--dport"); o == nil || o.Values[0] != "443" {
+		t.Fatalf("dport not parsed")
+	}
+	if o := spec.Match("set").Option("--match-set"); o == nil || !o.Negate ||
+		strings.Join(o.Values, " ") != "allow src,dst" {
+		t.Fatalf("set match not parsed")
+	}
+	if spec.Comment() != "ta router" {
+		t.Fatalf("comment not parsed: %s", spec.Comment())
+	}
+	if spec.Target != "DNAT" || spec.TargetOption("--to-destination").Values[0] != "10.0.0.2:443" {
+		t.Fatalf("target not parsed")
+	}
+	if spec.String() != line {
+		t.Fatalf("render mismatch:\n%s\n%s", spec.String(), line)
+	}
+	long, err := iptables.ParseRuleArgs([]string{"--append", "TA-FORWARD",
+		"!", "--source", "10.0.0.0/8", "--in-interface", "wg0", "--protocol", "tcp",
+		"-m", "tcp", "--dport", "443", "-m", "set", "!", "--match-set", "allow", "src,dst",
+		"-m", "comment", "--comment", "ta router",
+		"--jump", "DNAT", "--to-destination", "10.0.0.2:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !long.Equal(spec) {
+		t.Fatalf("long options not normalized: %s", long)
+	}
+}
+
+func TestFirewallIPv6(t *testing.T) {
+	conf := &registry.DesiredConfig{Firewall: []*registry.FirewallRule{
+		{Type: registry.FIREWALL_ACCEPT, Source: "10.0.0.0/24", InIface: "ta-wg0"},
+		{Type: registry.FIREWALL_ACCEPT, Source: "fd00::/64", InIface: "ta-wg0"},
+		{Type: registry.FIREWALL_MASQUERADE, OutIface: "eth0"},
+	}}
+	rules, err := reconcile.FirewallRules(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := func(protocol iptables.Protocol) []string {
+		srcs := make([]string, 0)
+		for _, chain := range rules[protocol] {
+			for _, rule := range chain.Rules {
+				srcs = append(srcs, chain.Name+" "+rule.Source)
+			}
+		}
+		return srcs
+	}
+	if s := strings.Join(sources(iptables.PROTOCOL_IPV6), ","); s !=
+		"TA-FORWARD ,TA-FORWARD fd00::/64,TA-POSTROUTING " {
+		t.Fatalf("unexpected ipv6 rules: %s", s)
+	}
+	if s := strings.Join(sources(iptables.PROTOCOL_IPV4), ","); s !=
+		"TA-FORWARD ,TA-FORWARD 10.0.0.0/24,TA-POSTROUTING " {
+		t.Fatalf("unexpected ipv4 rules: %s", s)
+	}
+
+	// ipv6 chains are written with ip6tables only
+	fake := rexectest.NewFakeRunner()
+	ip6t, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV6, "", "", fake)
+	if err != nil {
+		t.Fatalf("create ip6tables failed: %v", err)
+	}
+	fake.Expect("ip6tables-save -t filter", "*filter\n:FORWARD ACCEPT [0:0]\nCOMMIT\n", nil).
+		Expect("ip6tables-save -t nat", "*nat\n:PREROUTING ACCEPT [0:0]\n:POSTROUTING ACCEPT [0:0]\nCOMMIT\n", nil).
+		Expect("ip6tables-restore --noflush", "", nil)
+	if err = ip6t.ApplyChains(rules[iptables.PROTOCOL_IPV6]); err != nil {
+		t.Fatalf("apply ipv6 chains failed: %v", err)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.Calls()
+	stdin := calls[len(calls)-1].Stdin
+	if !strings.Contains(stdin, "-A TA-FORWARD -s fd00::/64 -i ta-wg0") ||
+		strings.Contains(stdin, "10.0.0.0/24") ||
+		!strings.Contains(stdin, "-A TA-POSTROUTING -o eth0") {
+		t.Fatalf("unexpected ip6tables restore input:\n%s", stdin)
+	}
+}
+
+// firewallSpecs router chain rules of protocol as chain and iptables spec
+func firewallSpecs(t *testing.T, chains []*iptables.FirewallChain) []string {
+	specs := make([]string, 0)
+	for _, chain := range chains {
+		for _, rule := range chain.Rules {
+			spec, err := rule.Spec()
+			if err != nil {
+				t.Fatalf("render rule of chain [%s] failed: %v", chain.Name, err)
+			}
+			specs = append(specs, chain.Name+" "+strings.Join(spec, " "))
+		}
+	}
+	return specs
+}
+
+func TestFirewallRules(t *testing.T) {
+	established := "TA-FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"
+	for _, c := range []struct {
+		name  string
+		rules []*registry.FirewallRule
+		v4    []string
+		v6    []string
+		err   bool
+	}{
+		{
+			name:  "masquerade of both protocols",
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_MASQUERADE, OutIface: "eth0"}},
+			v4:    []string{"TA-POSTROUTING -o eth0 -j MASQUERADE"},
+			v6:    []string{"TA-POSTROUTING -o eth0 -j MASQUERADE"},
+		},
+		{
+			name: "snat of ipv4 source",
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_SNAT, Source: "10.0.0.0/24",
+				OutIface: "eth0", ToAddr: "192.0.2.10"}},
+			v4: []string{"TA-POSTROUTING -s 10.0.0.0/24 -o eth0 -j SNAT --to-source 192.0.2.10"},
+		},
+		{
+			name: "dnat of ipv4 port",
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_DNAT, InIface: "eth0",
+				Protocol: "TCP", Dport: 8080, ToAddr: "10.0.0.2:80"}},
+			v4: []string{"TA-PREROUTING -i eth0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.0.0.2:80"},
+		},
+		{
+			name: "dnat of ipv6 port",
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_DNAT, InIface: "eth0",
+				Protocol: "udp", Dport: 53, ToAddr: "[fd00::2]:53"}},
+			v6: []string{"TA-PREROUTING -i eth0 -p udp -m udp --dport 53 -j DNAT --to-destination [fd00::2]:53"},
+		},
+		{
+			name: "accept adds established accept once per protocol",
+			rules: []*registry.FirewallRule{
+				{Type: registry.FIREWALL_ACCEPT, Source: "10.0.0.2", InIface: "ta-wg0"},
+				{Type: registry.FIREWALL_ACCEPT, Source: "fd00::2", InIface: "ta-wg0"},
+				{Type: registry.FIREWALL_DROP, InIface: "ta-wg0"},
+			},
+			v4: []string{established, "TA-FORWARD -s 10.0.0.2/32 -i ta-wg0 -j ACCEPT",
+				"TA-FORWARD -i ta-wg0 -j DROP"},
+			v6: []string{established, "TA-FORWARD -s fd00::2/128 -i ta-wg0 -j ACCEPT",
+				"TA-FORWARD -i ta-wg0 -j DROP"},
+		},
+		{
+			name:  "drop alone has no established accept",
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_DROP, Destination: "fd00::/64"}},
+			v6:    []string{"TA-FORWARD -d fd00::/64 -j DROP"},
+		},
+		{name: "snat without to address", err: true,
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_SNAT, OutIface: "eth0"}}},
+		{name: "masquerade of in interface", err: true,
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_MASQUERADE, InIface: "eth0"}}},
+		{name: "dnat of out interface", err: true,
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_DNAT, OutIface: "eth0", ToAddr: "10.0.0.2"}}},
+		{name: "dport without protocol", err: true,
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_DNAT, Dport: 80, ToAddr: "10.0.0.2"}}},
+		{name: "mixed protocols", err: true,
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_DNAT, Destination: "192.0.2.1",
+				ToAddr: "[fd00::2]:80"}}},
+		{name: "bad address", err: true,
+			rules: []*registry.FirewallRule{{Type: registry.FIREWALL_DROP, Source: "10.0.0.300"}}},
+		{name: "unknown type", err: true,
+			rules: []*registry.FirewallRule{{Type: "reject"}}},
+	} {
+		rules, err := reconcile.FirewallRules(&registry.DesiredConfig{Firewall: c.rules})
+		if c.err {
+			if err == nil {
+				t.Fatalf("%s: accepted", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		for _, p := range []struct {
+			protocol iptables.Protocol
+			expect   []string
+		}{{iptables.PROTOCOL_IPV4, c.v4}, {iptables.PROTOCOL_IPV6, c.v6}} {
+			chains := rules[p.protocol]
+			if len(chains) != 3 || chains[0].Hook != "FORWARD" || chains[1].Hook != "PREROUTING" ||
+				chains[2].Hook != "POSTROUTING" {
+				t.Fatalf("%s: unexpected %s chains: %+v", c.name, p.protocol, chains)
+			}
+			if specs := strings.Join(firewallSpecs(t, chains), "\n"); specs != strings.Join(p.expect, "\n") {
+				t.Fatalf("%s: unexpected %s rules:\n%s", c.name, p.protocol, specs)
+			}
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"ntsc.ac.cn/ta-router/pkg/iptools"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+)
+
+func newExecIPTools(t *testing.T) (*iptools.IPTools, *rexectest.FakeRunner) {
+	fake := rexectest.NewFakeRunner()
+	eb, err := iptools.NewExecBackendWithRunner("", fake)
+	if err != nil {
+		t.Fatalf("create ip backend failed: %v", err)
+	}
+	return iptools.NewIPToolsWithBackend(eb), fake
+}
+
+func TestIPToolsExecList(t *testing.T) {
+	ipt, fake := newExecIPTools(t)
+	fake.Expect("ip -4 route show table 100",
+		"default via 192.0.2.1 dev eth0 proto static\n"+
+			"10.0.0.0/24 dev wg0 proto kernel scope link src 10.0.0.1\n"+
+			"blackhole 10.9.0.0/16\n"+
+			"local 10.0.0.1 dev wg0 table local proto kernel scope host src 10.0.0.1\n", nil).
+		Expect("ip -6 route show table 100", "fd00::/64 dev wg0 metric 1024 pref medium\n", nil)
+	routes, err := ipt.ListRoutes("100")
+	if err != nil {
+		t.Fatalf("list routes failed: %v", err)
+	}
+	expect := []iptools.Route{
+		{Family: iptools.FAMILY_INET, Type: "unicast", Dst: "default", Via: "192.0.2.1", Dev: "eth0", Table: "100", Proto: "static"},
+		{Family: iptools.FAMILY_INET, Type: "unicast", Dst: "10.0.0.0/24", Dev: "wg0", Table: "100", Proto: "kernel"},
+		{Family: iptools.FAMILY_INET, Type: "blackhole", Dst: "10.9.0.0/16", Table: "100"},
+		{Family: iptools.FAMILY_INET, Type: "local", Dst: "10.0.0.1", Dev: "wg0", Table: "local", Proto: "kernel"},
+		{Family: iptools.FAMILY_INET6, Type: "unicast", Dst: "fd00::/64", Dev: "wg0", Table: "100"},
+	}
+	if len(routes) != len(expect) {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+	for i := range expect {
+		if *routes[i] != expect[i] {
+			t.Fatalf("unexpected route [%d]: %+v", i, routes[i])
+		}
+	}
+	if routes[0].Network() != "0.0.0.0/0" || routes[3].Network() != "10.0.0.1/32" {
+		t.Fatalf("unexpected route networks: %s, %s", routes[0].Network(), routes[3].Network())
+	}
+
+	fake.Expect("ip -4 rule show",
+		"0:\tfrom all lookup local\n"+
+			"100:\tfrom 10.0.0.0/24 lookup 100\n"+
+			"101:\tfrom all fwmark 0x10/0xff iif wg0 lookup ta\n"+
+			"32766:\tfrom all lookup main\n", nil).
+		Expect("ip -6 rule show", "102:\tfrom all to fd00::/64 lookup 100\n", nil)
+	rules, err := ipt.ListRules()
+	if err != nil {
+		t.Fatalf("list rules failed: %v", err)
+	}
+	expectRules := []iptools.Rule{
+		{Family: iptools.FAMILY_INET, Priority: 0, Table: "local"},
+		{Family: iptools.FAMILY_INET, Priority: 100, From: "10.0.0.0/24", Table: "100"},
+		{Family: iptools.FAMILY_INET, Priority: 101, Fwmark: 0x10, FwMask: 0xff, Iif: "wg0", Table: "ta"},
+		{Family: iptools.FAMILY_INET, Priority: 32766, Table: "main"},
+		{Family: iptools.FAMILY_INET6, Priority: 102, To: "fd00::/64", Table: "100"},
+	}
+	if len(rules) != len(expectRules) {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	for i := range expectRules {
+		if *rules[i] != expectRules[i] {
+			t.Fatalf("unexpected rule [%d]: %+v", i, rules[i])
+		}
+	}
+
+	fake.Expect("ip -4 rule show", "x:\tfrom all lookup main\n", nil)
+	if _, err = ipt.ListRules(); err == nil {
+		t.Fatalf("bad rule priority accepted")
+	}
+
+	fake.Expect("ip -o address show dev eth0",
+		"2: eth0    inet 192.0.2.10/24 brd 192.0.2.255 scope global eth0\\       valid_lft forever\n"+
+			"2: eth0    inet6 fe80::1/64 scope link \\       valid_lft forever\n", nil)
+	addrs, err := ipt.ListAddresses("eth0")
+	if err != nil || strings.Join(addrs, ",") != "192.0.2.10/24,fe80::1/64" {
+		t.Fatalf("unexpected addresses: %v, %v", addrs, err)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ipt.Close(); err != nil {
+		t.Fatalf("close exec backend failed: %v", err)
+	}
+}
+
+func TestIPToolsExecIdempotent(t *testing.T) {
+	ipt, fake := newExecIPTools(t)
+	exitErr := fmt.Errorf("exit status 2")
+
+	// present address and route of the same dev are not errors
+	fake.Expect("ip -4 address add 10.0.0.1/24 dev wg0",
+		"Error: ipv4: Address already assigned.", exitErr).
+		Expect("ip -6 address add fd00::1/64 dev wg0", "", nil)
+	if err := ipt.EnsureAddress("10.0.0.1/24", "wg0"); err != nil {
+		t.Fatalf("ensure present address failed: %v", err)
+	}
+	if err := ipt.EnsureAddress("fd00::1/64", "wg0"); err != nil {
+		t.Fatalf("ensure address failed: %v", err)
+	}
+	fake.Expect("ip route add 192.168.1.0/24 dev wg0 table 100", "RTNETLINK answers: File exists", exitErr).
+		Expect("ip -4 route show table 100", "192.168.1.0/24 dev wg0 scope link\n", nil).
+		Expect("ip -6 route show table 100", "", nil)
+	if err := ipt.EnsureRoute("192.168.1.0/24", "wg0", "100"); err != nil {
+		t.Fatalf("ensure present route failed: %v", err)
+	}
+
+	// same destination through another dev is reported
+	fake.Expect("ip route add 192.168.1.0/24 dev wg1", "RTNETLINK answers: File exists", exitErr).
+		Expect("ip -4 route show", "192.168.1.0/24 dev wg0 scope link\n", nil).
+		Expect("ip -6 route show", "", nil)
+	if err := ipt.EnsureRoute("192.168.1.0/24", "wg1", ""); !iptools.IsExist(err) {
+		t.Fatalf("route of other dev not reported: %v", err)
+	}
+
+	// absent objects are not errors on delete, other failures are kept
+	fake.Expect("ip address del 10.0.0.9/24 dev wg0", "RTNETLINK answers: Cannot assign requested address", exitErr).
+		Expect("ip route del 192.168.9.0/24 dev wg0", "RTNETLINK answers: No such process", exitErr).
+		Expect("ip address del 10.0.0.1/24 dev wg9", "Cannot find device \"wg9\"", exitErr).
+		Expect("ip route del 192.168.1.0/24 dev wg0", "", fmt.Errorf("permission denied"))
+	if err := ipt.DeleteAddress("10.0.0.9/24", "wg0"); err != nil {
+		t.Fatalf("delete absent address failed: %v", err)
+	}
+	if err := ipt.DeleteRoute("192.168.9.0/24", "wg0", ""); err != nil {
+		t.Fatalf("delete absent route failed: %v", err)
+	}
+	if err := ipt.DeleteAddress("10.0.0.1/24", "wg9"); err != nil {
+		t.Fatalf("delete address of absent dev failed: %v", err)
+	}
+	err := ipt.DeleteRoute("192.168.1.0/24", "wg0", "")
+	if err == nil || iptools.IsExist(err) || iptools.IsNotExist(err) ||
+		!strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("unexpected delete route error: %v", err)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPToolsEnsureRule(t *testing.T) {
+	ipt, fake := newExecIPTools(t)
+	exitErr := fmt.Errorf("exit status 2")
+	rule := &iptools.Rule{Priority: 100, From: "10.0.0.0/24", Table: "100"}
+
+	// equal rule present, nothing is added
+	fake.Expect("ip -4 rule show", "0:\tfrom all lookup local\n"+
+		"100:\tfrom 10.0.0.0/24 lookup 100\n", nil).
+		Expect("ip -6 rule show", "", nil)
+	if err := ipt.EnsureRule(rule); err != nil {
+		t.Fatalf("ensure present rule failed: %v", err)
+	}
+
+	// same selector with another priority or table is not equal
+	fake.Expect("ip -4 rule show", "101:\tfrom 10.0.0.0/24 lookup 100\n"+
+		"100:\tfrom 10.0.0.0/24 lookup main\n", nil).
+		Expect("ip -6 rule show", "", nil).
+		Expect("ip -4 rule add priority 100 from 10.0.0.0/24 lookup 100", "", nil)
+	if err := ipt.EnsureRule(rule); err != nil {
+		t.Fatalf("ensure rule failed: %v", err)
+	}
+
+	// rule added concurrently is not an error, other failures are kept
+	mark := &iptools.Rule{Priority: 101, Fwmark: 0x10, Iif: "wg0", Table: "ta"}
+	fake.Expect("ip -4 rule show", "", nil).
+		Expect("ip -6 rule show", "", nil).
+		Expect("ip -4 rule add priority 101 from all fwmark 0x10/0xffffffff iif wg0 lookup ta",
+			"RTNETLINK answers: File exists", exitErr).
+		Expect("ip -4 rule show", "", nil).
+		Expect("ip -6 rule show", "", nil).
+		Expect("ip -6 rule add priority 102 from all to fd00::/64 lookup 100",
+			"RTNETLINK answers: Operation not permitted", exitErr)
+	if err := ipt.EnsureRule(mark); err != nil {
+		t.Fatalf("ensure existing rule failed: %v", err)
+	}
+	v6 := &iptools.Rule{Priority: 102, To: "fd00::/64", Table: "100"}
+	if err := ipt.EnsureRule(v6); err == nil || iptools.IsExist(err) {
+		t.Fatalf("unexpected add rule error: %v", err)
+	}
+
+	// ipv6 rule listed by the ipv6 family, fwmark without mask is a full mask
+	fake.Expect("ip -4 rule show", "101:\tfrom all fwmark 0x10 iif wg0 lookup ta\n", nil).
+		Expect("ip -6 rule show", "102:\tfrom all to fd00::/64 lookup 100\n", nil).
+		Expect("ip -4 rule show", "101:\tfrom all fwmark 0x10 iif wg0 lookup ta\n", nil).
+		Expect("ip -6 rule show", "102:\tfrom all to fd00::/64 lookup 100\n", nil)
+	if err := ipt.EnsureRule(v6); err != nil {
+		t.Fatalf("ensure present ipv6 rule failed: %v", err)
+	}
+	if err := ipt.EnsureRule(mark); err != nil {
+		t.Fatalf("ensure present fwmark rule failed: %v", err)
+	}
+
+	// absent rule is not an error on delete
+	fake.Expect("ip -4 rule del priority 100 from 10.0.0.0/24 lookup 100",
+		"RTNETLINK answers: No such file or directory", exitErr)
+	if err := ipt.DeleteRule(rule); err != nil {
+		t.Fatalf("delete absent rule failed: %v", err)
+	}
+
+	// unparsable fwmark is an error
+	fake.Expect("ip -4 rule show", "101:\tfrom all fwmark 0xzz lookup ta\n", nil)
+	if err := ipt.EnsureRule(mark); err == nil {
+		t.Fatalf("bad fwmark accepted")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPToolsExecReplace(t *testing.T) {
+	ipt, fake := newExecIPTools(t)
+	exitErr := fmt.Errorf("exit status 2")
+
+	// absent route is added without listing routes
+	fake.Expect("ip route add 192.168.1.0/24 dev wg0 table 100", "", nil).
+		Expect("ip route add fd00:1::/64 dev wg0", "", nil)
+	if err := ipt.EnsureRoute("192.168.1.0/24", "wg0", "100"); err != nil {
+		t.Fatalf("ensure route failed: %v", err)
+	}
+	if err := ipt.EnsureRoute("fd00:1::/64", "wg0", ""); err != nil {
+		t.Fatalf("ensure ipv6 route failed: %v", err)
+	}
+
+	// route of other dev is moved by replace
+	fake.Expect("ip route replace 192.168.1.0/24 dev wg1 table 100", "", nil).
+		Expect("ip route replace 192.168.2.0/24 dev wg1", "", nil).
+		Expect("ip route replace 192.168.3.0/24 dev wg9", "Cannot find device \"wg9\"", exitErr)
+	if err := ipt.ReplaceRoute("192.168.1.0/24", "wg1", "100"); err != nil {
+		t.Fatalf("replace route failed: %v", err)
+	}
+	if err := ipt.ReplaceRoute("192.168.2.0/24", "wg1", ""); err != nil {
+		t.Fatalf("replace main table route failed: %v", err)
+	}
+	if err := ipt.ReplaceRoute("192.168.3.0/24", "wg9", ""); !iptools.IsNotExist(err) {
+		t.Fatalf("replace route to absent dev not reported: %v", err)
+	}
+
+	// addresses are flushed and listed per dev
+	fake.Expect("ip address flush dev eth0", "", nil).
+		Expect("ip -o address show dev eth0", "", nil).
+		Expect("ip route add default via 192.0.2.1 dev eth0", "", nil)
+	if err := ipt.FlushAddresses("eth0"); err != nil {
+		t.Fatalf("flush addresses failed: %v", err)
+	}
+	if addrs, err := ipt.ListAddresses("eth0"); err != nil || len(addrs) != 0 {
+		t.Fatalf("unexpected addresses after flush: %v, %v", addrs, err)
+	}
+	if err := ipt.AddDefaultRoute("192.0.2.1", "eth0"); err != nil {
+		t.Fatalf("add default route failed: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPToolsExecErrors(t *testing.T) {
+	exitErr := fmt.Errorf("exit status 2")
+	for _, c := range []struct {
+		output   string
+		err      error
+		exist    bool
+		notExist bool
+	}{
+		{"RTNETLINK answers: File exists", exitErr, true, false},
+		{"Error: ipv4: Address already assigned.", exitErr, true, false},
+		{"Cannot find device \"wg9\"", exitErr, false, true},
+		{"RTNETLINK answers: No such device", exitErr, false, true},
+		{"RTNETLINK answers: No such process", exitErr, false, true},
+		{"RTNETLINK answers: Cannot assign requested address", exitErr, false, true},
+		{"Error: ipv4: Address not found.", exitErr, false, true},
+		{"RTNETLINK answers: No such file or directory", exitErr, false, true},
+		{"RTNETLINK answers: Operation not permitted", exitErr, false, false},
+		// without output the run error is matched
+		{"", fmt.Errorf("No such file or directory"), false, true},
+		{"", fmt.Errorf("signal: killed"), false, false},
+	} {
+		ipt, fake := newExecIPTools(t)
+		fake.Expect("ip link add dev wg9 type wireguard", c.output, c.err)
+		err := ipt.AddLink("wg9", "wireguard")
+		if err == nil || iptools.IsExist(err) != c.exist || iptools.IsNotExist(err) != c.notExist {
+			t.Fatalf("unexpected error of output [%s]: %v", c.output, err)
+		}
+		var opErr *iptools.OpError
+		if !errors.As(err, &opErr) || !strings.HasPrefix(err.Error(), "add link [wg9]") {
+			t.Fatalf("error of output [%s] not an op error: %v", c.output, err)
+		}
+		if expect := c.output; expect != "" && !strings.Contains(err.Error(), expect) {
+			t.Fatalf("output [%s] not kept: %v", expect, err)
+		}
+		// errors are matched in english whatever the host locale is
+		calls := fake.Calls()
+		if len(calls) != 1 || strings.Join(calls[0].Env, " ") != "LC_ALL=C" {
+			t.Fatalf("ip not run with LC_ALL=C: %+v", calls)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/metrics"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := wgtypes.Peer{
+		PublicKey:         key.PublicKey(),
+		Endpoint:          &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820},
+		ReceiveBytes:      1000,
+		TransmitBytes:     2000,
+		LastHandshakeTime: time.Unix(1700000000, 0),
+	}
+	collector := metrics.NewCollector(func() ([]*wgtypes.Device, error) {
+		return []*wgtypes.Device{{Name: "wg0", Peers: []wgtypes.Peer{peer}}}, nil
+	})
+	if err = collector.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	peer.ReceiveBytes += 1000
+	if err = collector.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	peers := collector.Peers()
+	if len(peers) != 1 || peers[0].RxRate <= 0 || peers[0].TxRate != 0 {
+		t.Fatalf("unexpected peer stats: %+v", peers)
+	}
+
+	rec := httptest.NewRecorder()
+	collector.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE ta_router_peer_receive_bytes_total counter",
+		`ta_router_peer_receive_bytes_total{device="wg0",public_key="` +
+			key.PublicKey().String() + `"} 2000`,
+		"ta_router_peer_last_handshake_seconds{",
+		`ta_router_peer_info{device="wg0",endpoint="192.0.2.1:51820",public_key="` +
+			key.PublicKey().String() + `"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics missing [%s]:\n%s", want, body)
+		}
+	}
+	// a roaming endpoint does not start new counter series
+	for _, l := range strings.Split(body, "\n") {
+		if strings.Contains(l, "endpoint=") && !strings.HasPrefix(l, "ta_router_peer_info{") {
+			t.Fatalf("endpoint label on counter series: %s", l)
+		}
+	}
+}
+
+func TestMetricsRuleCounters(t *testing.T) {
+	fake4, fake6 := rexectest.NewFakeRunner(), rexectest.NewFakeRunner()
+	ipt4, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV4, "", "", fake4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipt6, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV6, "", "", fake6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake6.Expect("ip6tables -L TA-FORWARD -v -n -x --line-numbers -t filter",
+		"Chain TA-FORWARD (1 references)\n"+
+			"num      pkts      bytes target     prot opt in     out     source               destination\n"+
+			"1          12     1008 ACCEPT     all      wg0    *       ::/0                 ::/0                 ctstate RELATED,ESTABLISHED\n"+
+			"2           3      240            tcp      *      *       fd00::/64            ::/0                 tcp dpt:22\n", nil)
+	list, err := ipt6.List("filter", "TA-FORWARD")
+	if err != nil {
+		t.Fatalf("list ipv6 chain failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Target != "ACCEPT" || list[0].Opt != "" || list[0].In != "wg0" ||
+		list[1].Target != "" || list[1].Prot != "tcp" || list[1].Source != "fd00::/64" || list[1].Bytes != 240 {
+		t.Fatalf("unexpected ipv6 rules: %+v %+v", list[0], list[1])
+	}
+
+	fake4.Expect("iptables -L TA-FORWARD -v -n -x --line-numbers -t filter",
+		"Chain TA-FORWARD (1 references)\n"+
+			"num      pkts      bytes target     prot opt in     out     source               destination\n"+
+			"1           7      420 ACCEPT     all  --  *      *       10.0.0.0/24          0.0.0.0/0\n"+
+			"2           2       80            tcp  --  *      *       0.0.0.0/0            0.0.0.0/0            tcp dpt:22\n", nil)
+	fake6.Expect("ip6tables -L TA-FORWARD -v -n -x --line-numbers -t filter", "",
+		fmt.Errorf("ip6tables unavailable"))
+	key, _ := wgtypes.GeneratePrivateKey()
+	collector := metrics.NewCollector(func() ([]*wgtypes.Device, error) {
+		return []*wgtypes.Device{{Name: "wg0", Peers: []wgtypes.Peer{{PublicKey: key.PublicKey()}}}}, nil
+	})
+	collector.AddChain(ipt4, "filter", "TA-FORWARD")
+	collector.AddChain(ipt6, "filter", "TA-FORWARD")
+	if err = collector.Sample(); err != nil {
+		t.Fatalf("failing chain not skipped: %v", err)
+	}
+	if err = fake4.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err = fake6.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	rules := collector.Rules()
+	if len(collector.Peers()) != 1 || len(rules) != 2 {
+		t.Fatalf("unexpected stats: peers %d rules %+v", len(collector.Peers()), rules)
+	}
+	for _, rs := range rules {
+		if rs.Protocol != iptables.PROTOCOL_IPV4.String() ||
+			(rs.Num == 1 && (rs.Target != "ACCEPT" || rs.Packets != 7 || rs.Bytes != 420)) ||
+			(rs.Num == 2 && (rs.Target != "" || rs.Packets != 2)) {
+			t.Fatalf("unexpected rule stats: %+v", rs)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/router"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+)
+
+func TestHandshakeMonitor(t *testing.T) {
+	keepKey, _ := wgtypes.GeneratePrivateKey()
+	idleKey, _ := wgtypes.GeneratePrivateKey()
+	now := time.Unix(1700000000, 0)
+	keep := wgtypes.Peer{
+		PublicKey:                   keepKey.PublicKey(),
+		PersistentKeepaliveInterval: time.Minute * 2,
+		LastHandshakeTime:           now.Add(-time.Minute * 4),
+	}
+	idle := wgtypes.Peer{
+		PublicKey:         idleKey.PublicKey(),
+		LastHandshakeTime: now.Add(-time.Hour),
+	}
+	dev := func() []*wgtypes.Device {
+		return []*wgtypes.Device{{Name: "wg0", Peers: []wgtypes.Peer{keep, idle}}}
+	}
+	m := wireguard.NewHandshakeMonitor(time.Minute * 3)
+	if th := m.Threshold(&keep); th != time.Minute*6 {
+		t.Fatalf("keepalive threshold not respected: %s", th)
+	}
+	if evs := m.Check(dev(), now); len(evs) != 0 {
+		t.Fatalf("unexpected events: %+v", evs[0])
+	}
+
+	keep.LastHandshakeTime = now.Add(-time.Minute * 7)
+	evs := m.Check(dev(), now)
+	if len(evs) != 1 || !evs[0].Stale || evs[0].PublicKey != keep.PublicKey.String() {
+		t.Fatalf("keepalive peer not flagged stale: %+v", evs)
+	}
+	if !m.IsStale("wg0", keep.PublicKey.String()) || m.IsStale("wg0", idle.PublicKey.String()) {
+		t.Fatalf("unexpected stale state")
+	}
+	if evs = m.Check(dev(), now); len(evs) != 0 {
+		t.Fatalf("stale event repeated")
+	}
+
+	idle.TransmitBytes = 1024
+	keep.LastHandshakeTime = now
+	evs = m.Check(dev(), now)
+	if len(evs) != 2 {
+		t.Fatalf("expect recovered and transmitting stale events, got %d", len(evs))
+	}
+	for _, ev := range evs {
+		if ev.PublicKey == keep.PublicKey.String() && ev.Stale {
+			t.Fatalf("keepalive peer not recovered")
+		}
+		if ev.PublicKey == idle.PublicKey.String() && !ev.Stale {
+			t.Fatalf("transmitting idle peer not flagged stale")
+		}
+	}
+}
+
+func TestRouterStaleReresolve(t *testing.T) {
+	tr := newTestRouter(t, func(conf *router.Config) {
+		conf.HandshakeTimeout = time.Minute
+		conf.HandshakeCheckInterval = time.Millisecond * 10
+		conf.StaleAction = router.STALE_ACTION_RERESOLVE
+	})
+	tr.desired.Wireguard[0].Peers[0].Endpoint = "localhost:51821"
+	tr.start(t)
+	defer tr.Stop(context.Background())
+
+	// peer roamed to another address and stopped answering keepalives
+	roamed := &net.UDPAddr{IP: net.ParseIP("192.0.2.9"), Port: 51821}
+	dev, _ := tr.client.Device("lo")
+	peer := dev.Peers[0]
+	peer.Endpoint = roamed
+	peer.PersistentKeepaliveInterval = time.Second * 25
+	peer.LastHandshakeTime = time.Now().Add(-time.Hour)
+	tr.client.SetPeer("lo", peer)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		dev, _ = tr.client.Device("lo")
+		if ep := dev.Peers[0].Endpoint; ep != nil && ep.IP.IsLoopback() && ep.Port == 51821 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("stale peer endpoint not re-resolved: %v", dev.Peers[0].Endpoint)
+}
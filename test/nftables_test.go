@@ -0,0 +1,144 @@
+package test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+)
+
+func nftChains() []*iptables.FirewallChain {
+	return []*iptables.FirewallChain{
+		{Table: "filter", Name: "TA-FORWARD", Hook: "FORWARD", Rules: []*iptables.FirewallRule{
+			{Established: true, Target: iptables.TARGET_ACCEPT},
+			{Source: "10.0.0.0/24", InIface: "wg0", Protocol: "tcp", Dport: 443, Target: iptables.TARGET_ACCEPT},
+			{Destination: "192.0.2.0/24", Protocol: "icmp", Target: iptables.TARGET_DROP},
+		}},
+		{Table: "nat", Name: "TA-PREROUTING", Hook: "PREROUTING", Rules: []*iptables.FirewallRule{
+			{InIface: "eth0", Protocol: "udp", Dport: 53, ToAddr: "10.0.0.53", Target: iptables.TARGET_DNAT},
+		}},
+		{Table: "nat", Name: "TA-POSTROUTING", Hook: "POSTROUTING", Rules: []*iptables.FirewallRule{
+			{OutIface: "eth0", Target: iptables.TARGET_MASQUERADE},
+			{Source: "10.0.1.0/24", ToAddr: "192.0.2.10", Target: iptables.TARGET_SNAT},
+		}},
+	}
+}
+
+var nftComment = regexp.MustCompile(`comment "(ta:[0-9a-f]+)"`)
+
+func TestNFTablesChains(t *testing.T) {
+	fake := rexectest.NewFakeRunner()
+	fake.Expect("nft list tables", "", nil)
+	nft, err := iptables.NewNFTablesWithRunner(iptables.PROTOCOL_IPV4, "", fake)
+	if err != nil {
+		t.Fatalf("create nftables failed: %v", err)
+	}
+	fake.Expect("nft -j list table ip ta-router",
+		"Error: No such file or directory", fmt.Errorf("exit status 1"))
+	lines, err := nft.PlanChains(nftChains())
+	if err != nil {
+		t.Fatalf("plan chains failed: %v", err)
+	}
+	script := strings.Join(lines, "\n") + "\n"
+	expect := []string{
+		"add table ip ta-router",
+		"delete table ip ta-router",
+		"table ip ta-router {",
+		"\tchain TA-FORWARD {",
+		"\t\ttype filter hook forward priority 0; policy accept;",
+		"\t\tct state established,related accept comment",
+		"\t\tip saddr 10.0.0.0/24 iifname \"wg0\" tcp dport 443 accept comment",
+		"\t\tip daddr 192.0.2.0/24 meta l4proto icmp drop comment",
+		"\tchain TA-PREROUTING {",
+		"\t\ttype nat hook prerouting priority -100; policy accept;",
+		"\t\tiifname \"eth0\" udp dport 53 dnat to 10.0.0.53 comment",
+		"\tchain TA-POSTROUTING {",
+		"\t\ttype nat hook postrouting priority 100; policy accept;",
+		"\t\toifname \"eth0\" masquerade comment",
+		"\t\tip saddr 10.0.1.0/24 snat to 192.0.2.10 comment",
+	}
+	for _, l := range expect {
+		if !strings.Contains(script, l) {
+			t.Fatalf("script misses [%s]:\n%s", l, script)
+		}
+	}
+
+	// rules listed with the same comments need no write
+	objs := []string{`{"metainfo": {"json_schema_version": 1}}`}
+	chain := ""
+	for _, l := range lines {
+		if strings.HasPrefix(l, "\tchain ") {
+			chain = strings.Fields(l)[1]
+			objs = append(objs, fmt.Sprintf(
+				`{"chain": {"family": "ip", "table": "ta-router", "name": "%s"}}`, chain))
+		}
+		if m := nftComment.FindStringSubmatch(l); m != nil {
+			objs = append(objs, fmt.Sprintf(
+				`{"rule": {"family": "ip", "table": "ta-router", "chain": "%s", "comment": "%s"}}`,
+				chain, m[1]))
+		}
+	}
+	listed := `{"nftables": [` + strings.Join(objs, ", ") + `]}`
+	fake.Expect("nft -j list table ip ta-router", listed, nil)
+	if err = nft.ApplyChains(nftChains()); err != nil {
+		t.Fatalf("apply matching chains failed: %v", err)
+	}
+
+	// a changed rule replaces the table in one transaction
+	chains := nftChains()
+	chains[2].Rules = chains[2].Rules[:1]
+	fake.Expect("nft -j list table ip ta-router", listed, nil).
+		Expect("nft -f -", "", nil)
+	if err = nft.ApplyChains(chains); err != nil {
+		t.Fatalf("apply chains failed: %v", err)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.Calls()
+	if stdin := calls[len(calls)-1].Stdin; !strings.HasPrefix(stdin, "add table ip ta-router\n") ||
+		strings.Contains(stdin, "snat to") {
+		t.Fatalf("unexpected apply script:\n%s", stdin)
+	}
+
+	chains[0].Rules = []*iptables.FirewallRule{{Dport: 22, Target: iptables.TARGET_ACCEPT}}
+	if _, err = nft.PlanChains(chains); err == nil {
+		t.Fatalf("dport without protocol accepted")
+	}
+	chains[0].Rules = nil
+	chains[0].Hook = "INPUT"
+	if _, err = nft.PlanChains(chains); err == nil {
+		t.Fatalf("unsupported hook accepted")
+	}
+}
+
+func TestNFTablesForwardDrop(t *testing.T) {
+	fake := rexectest.NewFakeRunner()
+	fake.Expect("nft list tables", "", nil)
+	nft, err := iptables.NewNFTablesWithRunner(iptables.PROTOCOL_IPV4, "", fake)
+	if err != nil {
+		t.Fatalf("create nftables failed: %v", err)
+	}
+	fake.Expect("nft -j list chains", `{"nftables": [
+		{"metainfo": {"json_schema_version": 1}},
+		{"chain": {"family": "inet", "table": "filter", "name": "forward", "type": "filter", "hook": "forward", "prio": 0, "policy": "drop"}},
+		{"chain": {"family": "inet", "table": "filter", "name": "input", "type": "filter", "hook": "input", "prio": 0, "policy": "drop"}},
+		{"chain": {"family": "ip", "table": "firewalld", "name": "fwd", "type": "filter", "hook": "forward", "prio": 10, "policy": "accept"}},
+		{"chain": {"family": "ip6", "table": "filter", "name": "FORWARD", "type": "filter", "hook": "forward", "prio": 0, "policy": "drop"}},
+		{"chain": {"family": "ip", "table": "ta-router", "name": "TA-FORWARD", "type": "filter", "hook": "forward", "prio": 0, "policy": "drop"}},
+		{"chain": {"family": "ip", "table": "filter", "name": "FORWARD", "type": "filter", "hook": "forward", "prio": 0, "policy": "drop"}}
+	]}`, nil)
+	drops, err := nft.ForwardDropChains()
+	if err != nil {
+		t.Fatalf("list forward drop chains failed: %v", err)
+	}
+	if strings.Join(drops, ",") != "inet filter forward,ip filter FORWARD" {
+		t.Fatalf("unexpected forward drop chains: %v", drops)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+)
+
+func newOwnedIPTables(t *testing.T) (*iptables.IPTables, *rexectest.FakeRunner) {
+	fake := rexectest.NewFakeRunner()
+	ipt, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV4, "", "", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipt.SetOwner("01234567")
+	return ipt, fake
+}
+
+// ownedLine command line of owned rule op, learned from a runner without
+// expectation
+func ownedLine(t *testing.T, op func(ipt *iptables.IPTables) error) string {
+	ipt, fake := newOwnedIPTables(t)
+	op(ipt)
+	calls := fake.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("unexpected calls: %+v", calls)
+	}
+	return calls[0].Line
+}
+
+func TestOwnedRuleTag(t *testing.T) {
+	src := []string{"-s", "10.0.0.0/24"}
+	line := ownedLine(t, func(ipt *iptables.IPTables) error {
+		return ipt.AppendRule("filter", "TA-FORWARD", "ACCEPT", src)
+	})
+	tag := regexp.MustCompile(`^iptables -t filter -A TA-FORWARD -s 10\.0\.0\.0/24 ` +
+		`-m comment --comment (ta-router:01234567:[0-9a-f]{8}) -j ACCEPT$`).FindStringSubmatch(line)
+	if tag == nil {
+		t.Fatalf("unexpected tagged rule: %s", line)
+	}
+
+	// same rule gets the same tag, another chain another one
+	if again := ownedLine(t, func(ipt *iptables.IPTables) error {
+		return ipt.InsertRule("filter", "TA-FORWARD", "ACCEPT", src)
+	}); !strings.Contains(again, tag[1]) {
+		t.Fatalf("tag of same rule changed: %s", again)
+	}
+	if other := ownedLine(t, func(ipt *iptables.IPTables) error {
+		return ipt.AppendRule("filter", "FORWARD", "ACCEPT", src)
+	}); strings.Contains(other, tag[1]) {
+		t.Fatalf("rule of other chain got same tag: %s", other)
+	}
+
+	// owned ops match the tagged rule, plain ops any rule
+	ipt, fake := newOwnedIPTables(t)
+	tagged := strings.Replace(line, " -A ", " -D ", 1)
+	fake.Expect(tagged, "", nil).
+		Expect("iptables -t filter -D TA-FORWARD -s 10.0.0.0/24 -j ACCEPT", "", nil).
+		Expect(strings.Replace(line, " -A ", " -C ", 1), "", nil).
+		Expect("iptables -t filter -C TA-FORWARD -s 10.0.0.0/24 -j ACCEPT",
+			"iptables: Bad rule (does a matching rule exist in that chain?).", rexectest.ExitError(1)).
+		Expect("iptables -t filter -C TA-FORWARD -s 10.0.0.0/24 -j TA-NONE",
+			"iptables v1.8.9 (legacy): Couldn't load target `TA-NONE':No such file or directory",
+			rexectest.ExitError(2))
+	if err := ipt.DeleteOwnedRule("filter", "TA-FORWARD", append(src, "-j", "ACCEPT")); err != nil {
+		t.Fatalf("delete owned rule failed: %v", err)
+	}
+	if err := ipt.DeleteRule("filter", "TA-FORWARD", append(src, "-j", "ACCEPT")); err != nil {
+		t.Fatalf("delete rule failed: %v", err)
+	}
+	if exist, err := ipt.OwnedRuleExists("filter", "TA-FORWARD", "ACCEPT", src); err != nil || !exist {
+		t.Fatalf("owned rule not found: %v", err)
+	}
+	if exist, err := ipt.RuleExists("filter", "TA-FORWARD", "ACCEPT", src); err != nil || exist {
+		t.Fatalf("absent rule found: %v", err)
+	}
+	if _, err := ipt.RuleExists("filter", "TA-FORWARD", "TA-NONE", src); err == nil {
+		t.Fatalf("check failure not reported")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOwnedRulesPrune(t *testing.T) {
+	ipt, fake := newOwnedIPTables(t)
+	owned := "-m comment --comment ta-router:01234567:"
+	// the kept rule carries the tag it was added with
+	kept := regexp.MustCompile(`ta-router:01234567:[0-9a-f]{8}`).FindString(
+		ownedLine(t, func(ipt *iptables.IPTables) error {
+			return ipt.AppendRule("filter", "TA-FORWARD", "ACCEPT", []string{"-s", "10.0.1.0/24"})
+		}))
+	dump := "*filter\n" +
+		":FORWARD ACCEPT [0:0]\n" +
+		":TA-FORWARD - [0:0]\n" +
+		"-A FORWARD -s 192.0.2.0/24 -j ACCEPT\n" +
+		"-A FORWARD -s 192.0.2.1/32 -m comment --comment admin -j DROP\n" +
+		"-A FORWARD -j TA-FORWARD " + owned + "0a0b0c0d\n" +
+		"-A FORWARD -j TA-FORWARD -m comment --comment ta-router:76543210:0a0b0c0d\n" +
+		"-A TA-FORWARD -s 10.0.0.0/24 -j ACCEPT " + owned + "01020304\n" +
+		"-A TA-FORWARD -s 10.0.1.0/24 -j ACCEPT -m comment --comment " + kept + "\n" +
+		"COMMIT\n"
+	fake.Expect("iptables-save -t filter", dump, nil)
+	specs, err := ipt.ListOwnedRules("filter")
+	if err != nil {
+		t.Fatalf("list owned rules failed: %v", err)
+	}
+	chains := make([]string, 0)
+	for _, spec := range specs {
+		if !ipt.IsOwned(spec) {
+			t.Fatalf("rule of other owner listed: %s", spec)
+		}
+		chains = append(chains, spec.Chain)
+	}
+	if strings.Join(chains, ",") != "FORWARD,TA-FORWARD,TA-FORWARD" {
+		t.Fatalf("unexpected owned rules: %v", specs)
+	}
+
+	// untagged, admin and other owner rules are left alone
+	keep, err := iptables.ParseRuleArgs([]string{"-A", "TA-FORWARD", "-s", "10.0.1.0/24", "-j", "ACCEPT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Expect("iptables-save -t filter", dump, nil).
+		Expect("iptables -t filter -D FORWARD "+owned+"0a0b0c0d -j TA-FORWARD", "", nil).
+		Expect("iptables -t filter -D TA-FORWARD -s 10.0.0.0/24 "+owned+"01020304 -j ACCEPT", "", nil)
+	if n, err := ipt.PruneOwnedRules("filter", []*iptables.RuleSpec{keep}); err != nil || n != 2 {
+		t.Fatalf("prune owned rules failed: %d, %v", n, err)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
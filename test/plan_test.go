@@ -0,0 +1,146 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/iptools"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+)
+
+var readOnlyCommand = regexp.MustCompile(
+	`^(ip (-o address|-[46] route|-[46] rule) show( |$)|iptables-save -t )`)
+
+func newPlanner(t *testing.T, fake *rexectest.FakeRunner, nameservers string) *reconcile.Planner {
+	eb, err := iptools.NewExecBackendWithRunner("ip", fake)
+	if err != nil {
+		t.Fatalf("create ip backend failed: %v", err)
+	}
+	ipt, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV4, "", "", fake)
+	if err != nil {
+		t.Fatalf("create iptables failed: %v", err)
+	}
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err = os.WriteFile(resolvConf, []byte(nameservers), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &reconcile.Planner{
+		IPTools: iptools.NewIPToolsWithBackend(eb),
+		Device: func(name string) (*wgtypes.Device, error) {
+			return nil, fmt.Errorf("device [%s]: %w", name, os.ErrNotExist)
+		},
+		Firewalls:  map[iptables.Protocol]iptables.Firewall{iptables.PROTOCOL_IPV4: ipt},
+		ResolvConf: resolvConf,
+		Forward:    newProcRoot(t, "1\n", "1\n"),
+	}
+}
+
+func expectWan(fake *rexectest.FakeRunner) {
+	fake.Expect("ip -o address show dev eth0",
+		"2: eth0    inet 192.0.2.10/24 brd 192.0.2.255 scope global eth0\\       valid_lft forever preferred_lft forever\n"+
+			"2: eth0    inet6 fe80::1/64 scope link \\       valid_lft forever preferred_lft forever\n", nil).
+		Expect("ip -4 route show",
+			"default via 192.0.2.1 dev eth0 proto static\n"+
+				"192.0.2.0/24 dev eth0 proto kernel scope link src 192.0.2.10\n", nil).
+		Expect("ip -6 route show", "", nil)
+}
+
+func expectFirewall(fake *rexectest.FakeRunner) {
+	fake.Expect("iptables-save -t filter", "*filter\n:FORWARD ACCEPT [0:0]\nCOMMIT\n", nil).
+		Expect("iptables-save -t nat", "*nat\n:PREROUTING ACCEPT [0:0]\n:POSTROUTING ACCEPT [0:0]\nCOMMIT\n", nil)
+}
+
+func planKinds(p *reconcile.Plan) map[string]int {
+	kinds := make(map[string]int)
+	for _, c := range p.Changes {
+		kinds[c.Kind]++
+	}
+	return kinds
+}
+
+func assertReadOnly(t *testing.T, fake *rexectest.FakeRunner) {
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range fake.Calls() {
+		if !readOnlyCommand.MatchString(call.Line) || call.Stdin != "" {
+			t.Fatalf("plan ran mutating command [%s]", call.Line)
+		}
+	}
+}
+
+func TestPlanLiveHost(t *testing.T) {
+	wan := &registry.EthernetConfig{
+		Name:      "eth0",
+		Addresses: []string{"192.0.2.10/24"},
+		Gateway:   "192.0.2.1",
+	}
+
+	// wan and dns already match the host without a previous config
+	fake := rexectest.NewFakeRunner()
+	expectWan(fake)
+	expectFirewall(fake)
+	planner := newPlanner(t, fake, "# generated\nnameserver 192.0.2.53\n")
+	p, err := planner.Plan(&registry.DesiredConfig{Wan: wan, DNSServer: []string{"192.0.2.53"}})
+	if err != nil {
+		t.Fatalf("plan failed: %v", err)
+	}
+	if kinds := planKinds(p); kinds["wan"] != 0 || kinds["dns"] != 0 {
+		t.Fatalf("matching wan or dns planned:\n%s", p)
+	}
+	assertReadOnly(t, fake)
+
+	// drifted wan and dns, missing wireguard interface
+	key, _ := wgtypes.GeneratePrivateKey()
+	peer, _ := wgtypes.GeneratePrivateKey()
+	conf := &registry.DesiredConfig{
+		Wan: &registry.EthernetConfig{
+			Name:      "eth0",
+			Addresses: []string{"192.0.2.20/24"},
+			Gateway:   "192.0.2.1",
+		},
+		DNSServer: []string{"192.0.2.54"},
+		Wireguard: []*registry.WireguardConfig{{
+			Name:    "ta-wg0",
+			PrivKey: key.String(),
+			Port:    51820,
+			Address: "10.0.0.1/24",
+			Table:   "100",
+			Peers: []*registry.WireguardPeer{{
+				PubKey:   peer.PublicKey().String(),
+				PeerAddr: "10.0.0.2/32",
+				AllowIPs: []string{"192.168.1.0/24"},
+			}},
+			Rules: []*registry.RoutingRule{{Priority: 100, From: "10.0.0.0/24"}},
+		}},
+		Firewall: []*registry.FirewallRule{{Type: registry.FIREWALL_MASQUERADE, OutIface: "eth0"}},
+	}
+	fake = rexectest.NewFakeRunner()
+	expectWan(fake)
+	fake.Expect("ip -o address show dev ta-wg0", "Device \"ta-wg0\" does not exist.",
+		fmt.Errorf("exit status 1")).
+		Expect("ip -4 route show table 100", "", nil).
+		Expect("ip -6 route show table 100", "", nil).
+		Expect("ip -4 rule show", "0:\tfrom all lookup local\n32766:\tfrom all lookup main\n", nil).
+		Expect("ip -6 rule show", "", nil)
+	expectFirewall(fake)
+	planner = newPlanner(t, fake, "nameserver 192.0.2.53\n")
+	planner.Forward = newProcRoot(t, "0\n", "0\n")
+	if p, err = planner.Plan(conf); err != nil {
+		t.Fatalf("plan failed: %v", err)
+	}
+	kinds := planKinds(p)
+	if kinds["wan"] != 1 || kinds["dns"] != 1 || kinds["peer"] != 1 ||
+		kinds["address"] != 1 || kinds["route"] != 1 || kinds["rule"] != 1 ||
+		kinds["firewall"] != 1 || kinds["sysctl"] != 1 {
+		t.Fatalf("unexpected plan:\n%s", p)
+	}
+	assertReadOnly(t, fake)
+}
@@ -0,0 +1,297 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/reconcile"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/internal/router"
+	"ntsc.ac.cn/ta-router/pkg/iptools"
+)
+
+func mustCIDR(t *testing.T, cidr string) net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("parse cidr [%s] failed: %v", cidr, err)
+	}
+	return *ipnet
+}
+
+func TestDeviceDelta(t *testing.T) {
+	priv, _ := wgtypes.GeneratePrivateKey()
+	k1, _ := wgtypes.GeneratePrivateKey()
+	k2, _ := wgtypes.GeneratePrivateKey()
+	psk, _ := wgtypes.GenerateKey()
+	port := 51820
+	kad := time.Second * 25
+	live := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51820}
+	moved := &net.UDPAddr{IP: net.ParseIP("192.0.2.9"), Port: 51820}
+	allowed := []net.IPNet{mustCIDR(t, "10.0.0.2/32")}
+
+	livePeer := func() wgtypes.Peer {
+		return wgtypes.Peer{
+			PublicKey:                   k1.PublicKey(),
+			PresharedKey:                psk,
+			PersistentKeepaliveInterval: kad,
+			Endpoint:                    live,
+			AllowedIPs:                  allowed,
+		}
+	}
+	desiredPeer := func() wgtypes.PeerConfig {
+		_psk, _kad := psk, kad
+		return wgtypes.PeerConfig{
+			PublicKey:                   k1.PublicKey(),
+			PresharedKey:                &_psk,
+			PersistentKeepaliveInterval: &_kad,
+			Endpoint:                    live,
+			AllowedIPs:                  allowed,
+		}
+	}
+
+	cases := []struct {
+		name    string
+		live    []wgtypes.Peer
+		desired []wgtypes.PeerConfig
+		kept    map[wgtypes.Key]bool
+		check   func(delta *wgtypes.Config) bool
+	}{
+		{
+			name:    "converged",
+			live:    []wgtypes.Peer{livePeer()},
+			desired: []wgtypes.PeerConfig{desiredPeer()},
+			check:   func(delta *wgtypes.Config) bool { return delta == nil },
+		},
+		{
+			name: "psk and keepalive cleared",
+			live: []wgtypes.Peer{livePeer()},
+			desired: func() []wgtypes.PeerConfig {
+				pc := desiredPeer()
+				pc.PresharedKey, pc.PersistentKeepaliveInterval = nil, nil
+				return []wgtypes.PeerConfig{pc}
+			}(),
+			check: func(delta *wgtypes.Config) bool {
+				pc := delta.Peers[0]
+				return len(delta.Peers) == 1 && pc.UpdateOnly &&
+					pc.PresharedKey != nil && *pc.PresharedKey == (wgtypes.Key{}) &&
+					pc.PersistentKeepaliveInterval != nil && *pc.PersistentKeepaliveInterval == 0
+			},
+		},
+		{
+			name:    "peer removed",
+			live:    []wgtypes.Peer{livePeer(), {PublicKey: k2.PublicKey()}},
+			desired: []wgtypes.PeerConfig{desiredPeer()},
+			check: func(delta *wgtypes.Config) bool {
+				return len(delta.Peers) == 1 && delta.Peers[0].Remove &&
+					delta.Peers[0].PublicKey == k2.PublicKey()
+			},
+		},
+		{
+			name:    "peer added",
+			desired: []wgtypes.PeerConfig{desiredPeer()},
+			check: func(delta *wgtypes.Config) bool {
+				return len(delta.Peers) == 1 && !delta.Peers[0].UpdateOnly &&
+					delta.Peers[0].ReplaceAllowedIPs
+			},
+		},
+		{
+			name: "endpoint changed",
+			live: []wgtypes.Peer{livePeer()},
+			desired: func() []wgtypes.PeerConfig {
+				pc := desiredPeer()
+				pc.Endpoint = moved
+				return []wgtypes.PeerConfig{pc}
+			}(),
+			check: func(delta *wgtypes.Config) bool {
+				return len(delta.Peers) == 1 && delta.Peers[0].Endpoint == moved
+			},
+		},
+		{
+			name: "roamed endpoint kept",
+			live: []wgtypes.Peer{livePeer()},
+			desired: func() []wgtypes.PeerConfig {
+				pc := desiredPeer()
+				pc.Endpoint = moved
+				return []wgtypes.PeerConfig{pc}
+			}(),
+			kept:  map[wgtypes.Key]bool{k1.PublicKey(): true},
+			check: func(delta *wgtypes.Config) bool { return delta == nil },
+		},
+		{
+			name: "allowed ips changed with kept endpoint",
+			live: []wgtypes.Peer{livePeer()},
+			desired: func() []wgtypes.PeerConfig {
+				pc := desiredPeer()
+				pc.Endpoint = moved
+				pc.AllowedIPs = append(pc.AllowedIPs, mustCIDR(t, "192.168.1.0/24"))
+				return []wgtypes.PeerConfig{pc}
+			}(),
+			kept: map[wgtypes.Key]bool{k1.PublicKey(): true},
+			check: func(delta *wgtypes.Config) bool {
+				return len(delta.Peers) == 1 && delta.Peers[0].Endpoint == nil &&
+					len(delta.Peers[0].AllowedIPs) == 2
+			},
+		},
+	}
+	for _, c := range cases {
+		dev := &wgtypes.Device{PrivateKey: priv, ListenPort: port, Peers: c.live}
+		conf := &wgtypes.Config{PrivateKey: &priv, ListenPort: &port, Peers: c.desired}
+		if delta := reconcile.DeviceDelta(dev, conf, c.kept); !c.check(delta) {
+			t.Fatalf("%s: unexpected delta: %+v", c.name, delta)
+		}
+	}
+
+	other := 51821
+	dev := &wgtypes.Device{PrivateKey: priv, ListenPort: port}
+	delta := reconcile.DeviceDelta(dev, &wgtypes.Config{PrivateKey: &priv, ListenPort: &other}, nil)
+	if delta == nil || delta.ListenPort == nil || *delta.ListenPort != other || delta.PrivateKey != nil {
+		t.Fatalf("listen port change not detected: %+v", delta)
+	}
+}
+
+func TestKeptEndpoints(t *testing.T) {
+	key, _ := wgtypes.GeneratePrivateKey()
+	pub := key.PublicKey()
+	dev := &wgtypes.Device{Peers: []wgtypes.Peer{{
+		PublicKey: pub,
+		Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 51820},
+	}}}
+	conf := func(endpoint string) *registry.WireguardConfig {
+		return &registry.WireguardConfig{Peers: []*registry.WireguardPeer{
+			{PubKey: pub.String(), Endpoint: endpoint},
+		}}
+	}
+	cases := []struct {
+		name     string
+		endpoint string
+		prev     *registry.WireguardConfig
+		kept     bool
+	}{
+		{"passive peer", "", nil, true},
+		{"hostname without prev", "hub.example.com:51820", nil, true},
+		{"ip without prev", "192.0.2.1:51820", nil, false},
+		{"unchanged since prev", "192.0.2.1:51820", conf("192.0.2.1:51820"), true},
+		{"changed since prev", "192.0.2.2:51820", conf("192.0.2.1:51820"), false},
+		{"hostname changed since prev", "hub2.example.com:51820", conf("hub.example.com:51820"), false},
+	}
+	for _, c := range cases {
+		if kept := reconcile.KeptEndpoints(dev, conf(c.endpoint), c.prev)[pub]; kept != c.kept {
+			t.Fatalf("%s: kept %v, want %v", c.name, kept, c.kept)
+		}
+	}
+}
+
+func TestRouteDelta(t *testing.T) {
+	wgconf := &registry.WireguardConfig{
+		Name: "wg0",
+		Peers: []*registry.WireguardPeer{
+			{AllowIPs: []string{"192.168.1.0/24", "10.1.0.1"}},
+			{AllowIPs: []string{"fd00:1::/64"}},
+		},
+	}
+	routes := []*iptools.Route{
+		{Family: iptools.FAMILY_INET, Type: "unicast", Dst: "192.168.1.0/24", Dev: "wg0"},
+		{Family: iptools.FAMILY_INET, Type: "unicast", Dst: "172.16.0.0/16", Dev: "wg0"},
+		{Family: iptools.FAMILY_INET, Type: "unicast", Dst: "10.0.0.0/24", Dev: "wg0", Proto: "kernel"},
+		{Family: iptools.FAMILY_INET, Type: "unicast", Dst: "10.9.0.0/16", Dev: "eth0"},
+		{Family: iptools.FAMILY_INET, Type: "local", Dst: "10.0.0.1", Dev: "wg0"},
+	}
+	stale, missing := reconcile.RouteDelta(routes, wgconf)
+	if len(stale) != 1 || stale[0].Dst != "172.16.0.0/16" {
+		t.Fatalf("unexpected stale routes: %+v", stale)
+	}
+	if len(missing) != 2 || missing[0] != "10.1.0.1" || missing[1] != "fd00:1::/64" {
+		t.Fatalf("unexpected missing routes: %v", missing)
+	}
+}
+
+func TestRuleDelta(t *testing.T) {
+	wgconf := &registry.WireguardConfig{
+		Name:  "wg0",
+		Table: "100",
+		Rules: []*registry.RoutingRule{
+			{Priority: 100, From: "10.0.0.0/24"},
+			{Priority: 101, Fwmark: 0x10},
+		},
+	}
+	rules := []*iptools.Rule{
+		{Priority: 100, From: "10.0.0.0/24", Table: "100"},
+		{Priority: 102, From: "10.9.0.0/24", Table: "100"},
+		{Priority: 0, Table: "local"},
+		{Priority: 32766, Table: "main"},
+	}
+	stale, missing := reconcile.RuleDelta(rules, wgconf)
+	if len(stale) != 1 || stale[0].Priority != 102 {
+		t.Fatalf("unexpected stale rules: %+v", stale)
+	}
+	if len(missing) != 1 || missing[0].Priority != 101 || missing[0].Fwmark != 0x10 {
+		t.Fatalf("unexpected missing rules: %+v", missing)
+	}
+
+	// rules are not managed for the main table
+	wgconf.Table = "main"
+	if stale, missing = reconcile.RuleDelta(rules, wgconf); len(stale) != 0 || len(missing) != 0 {
+		t.Fatalf("rules of shared table managed: %+v %+v", stale, missing)
+	}
+}
+
+func TestAddressDelta(t *testing.T) {
+	stale, missing := reconcile.AddressDelta(
+		[]string{"10.0.0.1/24", "10.0.9.1/24", "fe80::1/64"},
+		[]string{"10.0.0.1/24", "fd00::1/64"})
+	if len(stale) != 1 || stale[0] != "10.0.9.1/24" {
+		t.Fatalf("unexpected stale addresses: %v", stale)
+	}
+	if len(missing) != 1 || missing[0] != "fd00::1/64" {
+		t.Fatalf("unexpected missing addresses: %v", missing)
+	}
+}
+
+func TestRouterReconcile(t *testing.T) {
+	tr := newTestRouter(t, func(conf *router.Config) {
+		conf.ReconcileInterval = time.Millisecond * 20
+	})
+	tr.start(t)
+	defer tr.Stop(context.Background())
+	waitFor := func(what string, cond func(dev *wgtypes.Device) bool) {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			if dev, err := tr.client.Device("lo"); err == nil && cond(dev) {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("%s not reconciled", what)
+	}
+	// init and the first watcher poll, the watcher polls again in an hour
+	for i := 0; tr.source.Fetchs() < 2; i++ {
+		if i == 500 {
+			t.Fatalf("watcher did not poll registry")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// new revision is fetched and applied by reconcile
+	changed := *tr.desired
+	wgconf := *changed.Wireguard[0]
+	wgconf.Port = 51830
+	changed.Wireguard = []*registry.WireguardConfig{&wgconf}
+	tr.source.SetConfig(&changed)
+	waitFor("registry revision", func(dev *wgtypes.Device) bool {
+		return dev.ListenPort == 51830
+	})
+
+	// drift is repaired with the applied config while registry is down
+	tr.source.SetError(fmt.Errorf("registry unavailable"))
+	if err := tr.client.ConfigureDevice("lo", wgtypes.Config{Peers: []wgtypes.PeerConfig{
+		{PublicKey: tr.peer.PublicKey(), Remove: true}}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("removed peer", func(dev *wgtypes.Device) bool {
+		return len(dev.Peers) == 1 && dev.ListenPort == 51830
+	})
+}
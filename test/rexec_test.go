@@ -0,0 +1,58 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"ntsc.ac.cn/ta-router/pkg/iptables"
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+)
+
+func TestFakeRunner(t *testing.T) {
+	fake := rexectest.NewFakeRunner()
+	ipt, err := iptables.NewIPTablesWithRunner(iptables.PROTOCOL_IPV4, "", "",
+		rexec.NewAuditRunner(fake))
+	if err != nil {
+		t.Fatalf("create iptables with fake runner failed: %v", err)
+	}
+	chains := []*iptables.FirewallChain{{
+		Name:  "TA-FORWARD",
+		Table: "filter",
+		Hook:  "FORWARD",
+		Rules: []*iptables.FirewallRule{{
+			Source: "10.0.0.0/24",
+			Target: iptables.TARGET_ACCEPT,
+		}},
+	}}
+	fake.Expect("iptables-save -t filter", "*filter\n"+
+		":INPUT ACCEPT [0:0]\n"+
+		":FORWARD ACCEPT [0:0]\n"+
+		":OUTPUT ACCEPT [0:0]\n"+
+		"COMMIT\n", nil).
+		Expect("iptables-restore --noflush", "", nil)
+	if err = ipt.ApplyChains(chains); err != nil {
+		t.Fatalf("apply chains failed: %v", err)
+	}
+	if err = fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.Calls()
+	stdin := calls[len(calls)-1].Stdin
+	if !strings.Contains(stdin, ":TA-FORWARD - [0:0]") ||
+		!strings.Contains(stdin, "-A TA-FORWARD -s 10.0.0.0/24") ||
+		!strings.Contains(stdin, "-I FORWARD ") {
+		t.Fatalf("unexpected restore input:\n%s", stdin)
+	}
+
+	if _, err = ipt.Save("nat"); err == nil {
+		t.Fatalf("unexpected command not rejected")
+	}
+	if err = fake.Verify(); err == nil || !strings.Contains(err.Error(), "iptables-save -t nat") {
+		t.Fatalf("unexpected command not reported: %v", err)
+	}
+	cmd := &rexec.Command{Path: "/usr/sbin/iptables", Args: []string{"-m", "comment", "--comment", "a b"}}
+	if cmd.String() != `iptables -m comment --comment "a b"` {
+		t.Fatalf("unexpected command line: %s", cmd)
+	}
+}
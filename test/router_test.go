@@ -0,0 +1,337 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/internal/registry/registrytest"
+	"ntsc.ac.cn/ta-router/internal/router"
+	"ntsc.ac.cn/ta-router/pkg/iptools"
+	"ntsc.ac.cn/ta-router/pkg/rexec"
+	"ntsc.ac.cn/ta-router/pkg/rexec/rexectest"
+	"ntsc.ac.cn/ta-router/pkg/wireguard/wireguardtest"
+)
+
+// TEST_ROUTER_ID machine id of test routers, rules are tagged with its
+// first 8 chars
+const TEST_ROUTER_ID = "0123456789abcdef"
+
+// hostRunner answers every command like an empty host unless an answer
+// is set for it, once Strict is called commands go to the strict fake runner
+type hostRunner struct {
+	lock    sync.Mutex
+	strict  *rexectest.FakeRunner
+	lines   []string
+	answers map[string]string
+}
+
+func (h *hostRunner) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+func (h *hostRunner) Run(cmd *rexec.Command) (string, error) {
+	h.lock.Lock()
+	strict := h.strict
+	if strict == nil {
+		h.lines = append(h.lines, cmd.String())
+	}
+	answer, answered := h.answers[cmd.String()]
+	h.lock.Unlock()
+	if strict != nil {
+		return strict.Run(cmd)
+	}
+	if answered {
+		return answer, nil
+	}
+	if base := filepath.Base(cmd.Path); strings.HasSuffix(base, "tables-save") {
+		table := cmd.Args[len(cmd.Args)-1]
+		return "*" + table + "\nCOMMIT\n", nil
+	}
+	return "", nil
+}
+
+// Answer answer command line with output from now on
+func (h *hostRunner) Answer(line, output string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.answers == nil {
+		h.answers = make(map[string]string)
+	}
+	h.answers[line] = output
+}
+
+// Strict check commands from now on with fake
+func (h *hostRunner) Strict(fake *rexectest.FakeRunner) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.strict = fake
+}
+
+// Lines commands answered before Strict
+func (h *hostRunner) Lines() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]string{}, h.lines...)
+}
+
+// testRouter router wired to fake registry, runner and wireguard client
+type testRouter struct {
+	*router.WireguardRouter
+	conf    *router.Config
+	source  *registrytest.FakeRegistry
+	runner  *hostRunner
+	client  *wireguardtest.FakeClient
+	key     wgtypes.Key
+	peer    wgtypes.Key
+	desired *registry.DesiredConfig
+}
+
+// newTestRouter create router serving one wireguard interface named lo,
+// the loopback link stands in for it since links are queried from host
+func newTestRouter(t *testing.T, edit func(conf *router.Config)) *testRouter {
+	key, _ := wgtypes.GeneratePrivateKey()
+	peer, _ := wgtypes.GeneratePrivateKey()
+	desired := &registry.DesiredConfig{
+		Wireguard: []*registry.WireguardConfig{{
+			Name:    "lo",
+			PrivKey: key.String(),
+			Port:    51820,
+			Address: "10.0.0.1/24",
+			Table:   "100",
+			Peers: []*registry.WireguardPeer{{
+				PubKey:   peer.PublicKey().String(),
+				PeerAddr: "10.0.0.2/32",
+				AllowIPs: []string{"192.168.1.0/24"},
+			}},
+			Rules: []*registry.RoutingRule{{Priority: 100, From: "10.0.0.0/24"}},
+		}},
+		Firewall: []*registry.FirewallRule{{Type: registry.FIREWALL_MASQUERADE, OutIface: "eth0"}},
+	}
+	dir := t.TempDir()
+	procRoot := newProcRoot(t, "1\n", "1\n").ProcRoot
+	tr := &testRouter{
+		source:  registrytest.NewFakeRegistry(desired),
+		runner:  &hostRunner{},
+		key:     key,
+		peer:    peer,
+		desired: desired,
+		// an unmanaged wireguard device next to the managed one
+		client: wireguardtest.NewFakeClient(&wgtypes.Device{Name: "lo"},
+			&wgtypes.Device{Name: "wg-admin"}),
+	}
+	eb, err := iptools.NewExecBackendWithRunner("", tr.runner)
+	if err != nil {
+		t.Fatalf("create ip backend failed: %v", err)
+	}
+	tr.conf = &router.Config{
+		CertPath:          filepath.Join(dir, "certs"),
+		ServerName:        "registry.test",
+		ManagerEndpoint:   "tcp://registry.test:1358",
+		ReconcileInterval: time.Hour,
+		WatchInterval:     time.Hour,
+		HeartbeatInterval: time.Hour,
+		StateDir:          filepath.Join(dir, "state"),
+		Runner:            tr.runner,
+		IPTools:           iptools.NewIPToolsWithBackend(eb),
+		WireguardClient:   tr.client,
+		ProcRoot:          procRoot,
+	}
+	if edit != nil {
+		edit(tr.conf)
+	}
+	if tr.WireguardRouter, err = router.NewWireguardRouterWithRegistry(tr.conf,
+		TEST_ROUTER_ID, tr.source, tr.source); err != nil {
+		t.Fatalf("create router failed: %v", err)
+	}
+	return tr
+}
+
+// start start router and fail on init error
+func (tr *testRouter) start(t *testing.T) chan error {
+	errs := tr.Start(context.Background())
+	select {
+	case err := <-errs:
+		t.Fatalf("start router failed: %v", err)
+	default:
+	}
+	return errs
+}
+
+func TestRouterStop(t *testing.T) {
+	tr := newTestRouter(t, nil)
+	errs := tr.start(t)
+	if dev, _ := tr.client.Device("lo"); dev.ListenPort != 51820 || len(dev.Peers) != 1 {
+		t.Fatalf("config not applied: %+v", dev)
+	}
+	if lines := strings.Join(tr.runner.Lines(), "\n"); !strings.Contains(lines, "iptables-restore --noflush") ||
+		!strings.Contains(lines, "ip -4 rule add priority 100 from 10.0.0.0/24 lookup 100") {
+		t.Fatalf("config not applied to host:\n%s", lines)
+	}
+
+	// nothing is removed from the host without teardown
+	fake := rexectest.NewFakeRunner()
+	tr.runner.Strict(fake)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := tr.Stop(ctx); err != nil {
+		t.Fatalf("stop router failed: %v", err)
+	}
+	select {
+	case _, ok := <-errs:
+		if ok {
+			t.Fatalf("error channel not closed")
+		}
+	default:
+		t.Fatalf("error channel not closed when stop returns")
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Calls()) != 0 || tr.client.Closes() != 1 {
+		t.Fatalf("stop without teardown ran %d commands, closed client %d times",
+			len(fake.Calls()), tr.client.Closes())
+	}
+
+	// second stop releases nothing again
+	if err := tr.Stop(ctx); err != nil {
+		t.Fatalf("second stop failed: %v", err)
+	}
+	if len(fake.Calls()) != 0 || tr.client.Closes() != 1 {
+		t.Fatalf("second stop released again")
+	}
+}
+
+func TestRouterTeardown(t *testing.T) {
+	tr := newTestRouter(t, func(conf *router.Config) { conf.Teardown = true })
+	tr.start(t)
+
+	// admin rules and rules of other routers are kept, owned rules are
+	// deleted before the router chains are removed
+	owned := "-m comment --comment ta-router:01234567:0a0b0c0d"
+	noChain := fmt.Errorf("exit status 1")
+	fake := rexectest.NewFakeRunner()
+	fake.Expect("iptables-save -t filter", "*filter\n"+
+		":FORWARD DROP [0:0]\n"+
+		":TA-FORWARD - [0:0]\n"+
+		"-A FORWARD -s 192.0.2.0/24 -j ACCEPT\n"+
+		"-A FORWARD -j TA-FORWARD "+owned+"\n"+
+		"-A FORWARD -j TA-FORWARD -m comment --comment ta-router:76543210:0a0b0c0d\n"+
+		"-A TA-FORWARD -s 10.0.0.0/24 -j ACCEPT "+owned+"\n"+
+		"COMMIT\n", nil).
+		Expect("iptables -t filter -D FORWARD "+owned+" -j TA-FORWARD", "", nil).
+		Expect("iptables -t filter -D TA-FORWARD -s 10.0.0.0/24 "+owned+" -j ACCEPT", "", nil).
+		Expect("iptables-save -t nat", "*nat\n"+
+			":POSTROUTING ACCEPT [0:0]\n"+
+			":TA-POSTROUTING - [0:0]\n"+
+			"-A POSTROUTING -o eth0 -j MASQUERADE\n"+
+			"-A POSTROUTING -j TA-POSTROUTING "+owned+"\n"+
+			"COMMIT\n", nil).
+		Expect("iptables -t nat -D POSTROUTING "+owned+" -j TA-POSTROUTING", "", nil).
+		Expect("iptables -t filter -S TA-FORWARD", "-N TA-FORWARD", nil).
+		Expect("iptables -t filter --flush TA-FORWARD", "", nil).
+		Expect("iptables -t filter -X TA-FORWARD", "", nil).
+		Expect("iptables -t nat -S TA-PREROUTING",
+			"iptables: No chain/target/match by that name.", noChain).
+		Expect("iptables -t nat -S TA-POSTROUTING", "-N TA-POSTROUTING", nil).
+		Expect("iptables -t nat --flush TA-POSTROUTING", "", nil).
+		Expect("iptables -t nat -X TA-POSTROUTING", "", nil).
+		Expect("ip6tables-save -t filter", "*filter\n:FORWARD ACCEPT [0:0]\nCOMMIT\n", nil).
+		Expect("ip6tables-save -t nat", "*nat\n:POSTROUTING ACCEPT [0:0]\nCOMMIT\n", nil)
+	for _, chain := range []string{"filter -S TA-FORWARD", "nat -S TA-PREROUTING", "nat -S TA-POSTROUTING"} {
+		fake.Expect("ip6tables -t "+chain,
+			"ip6tables: No chain/target/match by that name.", noChain)
+	}
+	// policy rules and the managed link go, the admin link wg-admin stays
+	fake.Expect("ip -4 rule del priority 100 from 10.0.0.0/24 lookup 100", "", nil).
+		Expect("ip link del lo", "", nil)
+	tr.runner.Strict(fake)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := tr.Stop(ctx); err != nil {
+		t.Fatalf("stop router failed: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// teardown runs once
+	if err := tr.Stop(ctx); err != nil {
+		t.Fatalf("second stop failed: %v", err)
+	}
+	if err := fake.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouterIncrementalApply(t *testing.T) {
+	tr := newTestRouter(t, nil)
+	devConf, err := tr.desired.Wireguard[0].DeviceConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.client.ConfigureDevice("lo", *devConf); err != nil {
+		t.Fatal(err)
+	}
+	// desired peer lost an allowed ip, a stale peer is still live
+	_, drifted, _ := net.ParseCIDR("10.0.0.2/32")
+	tr.client.SetPeer("lo", wgtypes.Peer{PublicKey: tr.peer.PublicKey(), AllowedIPs: []net.IPNet{*drifted}})
+	stale, _ := wgtypes.GeneratePrivateKey()
+	tr.client.SetPeer("lo", wgtypes.Peer{PublicKey: stale.PublicKey()})
+	tr.runner.Answer("ip -o address show dev lo",
+		"1: lo    inet 10.0.0.1/24 scope global lo\\       valid_lft forever\n"+
+			"1: lo    inet 10.0.0.9/24 scope global lo\\       valid_lft forever\n")
+	tr.runner.Answer("ip -4 route show table 100",
+		"192.168.1.0/24 dev lo scope link\n192.168.9.0/24 dev lo scope link\n")
+	tr.runner.Answer("ip -4 rule show", "100:\tfrom 10.0.0.0/24 lookup 100\n")
+	tr.start(t)
+	defer tr.Stop(context.Background())
+
+	// only changed peers are configured, the device is not recreated
+	configures := tr.client.Configures()[1:]
+	if len(configures) != 1 {
+		t.Fatalf("unexpected configures: %d", len(configures))
+	}
+	delta := configures[0].Config
+	if delta.ReplacePeers || delta.PrivateKey != nil || delta.ListenPort != nil || len(delta.Peers) != 2 {
+		t.Fatalf("unexpected device delta: %+v", delta)
+	}
+	for _, pc := range delta.Peers {
+		switch pc.PublicKey {
+		case tr.peer.PublicKey():
+			if !pc.UpdateOnly || !pc.ReplaceAllowedIPs || pc.Remove {
+				t.Fatalf("drifted peer not updated in place: %+v", pc)
+			}
+		case stale.PublicKey():
+			if !pc.Remove {
+				t.Fatalf("stale peer not removed: %+v", pc)
+			}
+		default:
+			t.Fatalf("unexpected peer change: %+v", pc)
+		}
+	}
+	if dev, _ := tr.client.Device("lo"); len(dev.Peers) != 1 || len(dev.Peers[0].AllowedIPs) != 2 {
+		t.Fatalf("unexpected live peers: %+v", dev.Peers)
+	}
+
+	// only stale addresses and routes are touched
+	lines := strings.Join(tr.runner.Lines(), "\n")
+	for _, line := range []string{"ip address del 10.0.0.9/24 dev lo",
+		"ip route del 192.168.9.0/24 dev lo table 100"} {
+		if !strings.Contains(lines, line) {
+			t.Fatalf("[%s] not run:\n%s", line, lines)
+		}
+	}
+	for _, op := range []string{"link add", "link del", "address add", "route add", "rule add", "rule del"} {
+		if strings.Contains(lines, op) {
+			t.Fatalf("unexpected [%s]:\n%s", op, lines)
+		}
+	}
+}
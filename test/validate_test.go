@@ -0,0 +1,141 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/pkg/wireguard"
+	"ntsc.ac.cn/ta-router/pkg/wireguard/wireguardtest"
+)
+
+func TestSyncConf(t *testing.T) {
+	priv, _ := wgtypes.GeneratePrivateKey()
+	kept, _ := wgtypes.GeneratePrivateKey()
+	removed, _ := wgtypes.GeneratePrivateKey()
+	pub, err := wireguard.PublicKey(priv.String() + "\n")
+	if err != nil || pub != priv.PublicKey().String() {
+		t.Fatalf("unexpected public key [%s]: %v", pub, err)
+	}
+	if _, err = wireguard.PublicKey("x; rm -rf /"); err == nil {
+		t.Fatalf("invalid private key not rejected")
+	}
+
+	conf, err := wireguard.ParseQuickConfig(strings.NewReader(`
+[Interface]
+Address = 10.0.0.1/24
+PrivateKey = ` + priv.String() + `
+ListenPort = 51820
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer] # kept
+PublicKey = ` + kept.PublicKey().String() + `
+AllowedIPs = 10.0.0.2, 192.168.0.0/24
+Endpoint = 127.0.0.1:51821
+PersistentKeepalive = 25
+`))
+	if err != nil {
+		t.Fatalf("parse wg-quick config failed: %v", err)
+	}
+	if *conf.ListenPort != 51820 || len(conf.Peers) != 1 ||
+		len(conf.Peers[0].AllowedIPs) != 2 || conf.Peers[0].AllowedIPs[0].String() != "10.0.0.2/32" ||
+		conf.Peers[0].Endpoint.Port != 51821 {
+		t.Fatalf("unexpected config: %+v", conf)
+	}
+	if _, err = wireguard.ParseQuickConfig(strings.NewReader("[Interface]\nFoo = bar\n")); err == nil {
+		t.Fatalf("unknow key not rejected")
+	}
+
+	live := &wgtypes.Device{Peers: []wgtypes.Peer{
+		{PublicKey: kept.PublicKey()},
+		{PublicKey: removed.PublicKey()},
+	}}
+	delta := wireguard.SyncConfig(live, conf)
+	if len(delta.Peers) != 2 || !delta.Peers[0].ReplaceAllowedIPs || delta.Peers[0].Remove ||
+		delta.Peers[1].PublicKey != removed.PublicKey() || !delta.Peers[1].Remove || delta.ReplacePeers {
+		t.Fatalf("unexpected sync delta: %+v", delta.Peers)
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	valid := func() *registry.DesiredConfig {
+		return &registry.DesiredConfig{
+			Wan:       &registry.EthernetConfig{Name: "eth0", Addresses: []string{"192.168.1.2/24"}, Gateway: "192.168.1.1"},
+			DNSServer: []string{"114.114.114.114", "2400:3200::1"},
+			Wireguard: []*registry.WireguardConfig{{
+				Name: "wg0", Port: 51820, Address: "10.0.0.1/24, fd00::1/64", Table: "100",
+			}},
+			Firewall: []*registry.FirewallRule{{
+				Type: registry.FIREWALL_DNAT, Protocol: "tcp", InIface: "eth0", Dport: 80, ToAddr: "10.0.0.2:8080",
+			}},
+		}
+	}
+	if err := valid().Check(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+	bare := valid()
+	bare.Wan.Addresses = []string{"192.168.1.2", "2001:db8::2"}
+	if err := bare.Check(); err != nil {
+		t.Fatalf("bare wan addresses rejected: %v", err)
+	}
+	invalid := map[string]func(c *registry.DesiredConfig){
+		"option wan":    func(c *registry.DesiredConfig) { c.Wan.Name = "-eth0" },
+		"long wg":       func(c *registry.DesiredConfig) { c.Wireguard[0].Name = "wg0123456789abcd" },
+		"slash wg":      func(c *registry.DesiredConfig) { c.Wireguard[0].Name = "../wg0" },
+		"dns":           func(c *registry.DesiredConfig) { c.DNSServer[0] = "1.1.1.1' > /etc/passwd '" },
+		"wg address":    func(c *registry.DesiredConfig) { c.Wireguard[0].Address = "10.0.0.1" },
+		"table":         func(c *registry.DesiredConfig) { c.Wireguard[0].Table = "main\nflush" },
+		"to addr":       func(c *registry.DesiredConfig) { c.Firewall[0].ToAddr = "10.0.0.2\n-F" },
+		"protocol":      func(c *registry.DesiredConfig) { c.Firewall[0].Protocol = "tcp -j ACCEPT" },
+		"in iface":      func(c *registry.DesiredConfig) { c.Firewall[0].InIface = "eth0 " },
+		"wan gateway":   func(c *registry.DesiredConfig) { c.Wan.Gateway = "gw" },
+		"wan addresses": func(c *registry.DesiredConfig) { c.Wan.Addresses = []string{"192.168.1.2/33"} },
+		"wan host":      func(c *registry.DesiredConfig) { c.Wan.Addresses = []string{"eth0"} },
+	}
+	for name, mutate := range invalid {
+		c := valid()
+		mutate(c)
+		if err := c.Check(); err == nil {
+			t.Fatalf("invalid %s not rejected", name)
+		}
+	}
+}
+
+func TestSyncConfReload(t *testing.T) {
+	priv, _ := wgtypes.GeneratePrivateKey()
+	peer, _ := wgtypes.GeneratePrivateKey()
+	psk, _ := wgtypes.GenerateKey()
+	quick := func(iface, extra string) string {
+		return "[Interface]\nPrivateKey = " + priv.String() + "\n" + iface +
+			"\n[Peer]\nPublicKey = " + peer.PublicKey().String() + "\nAllowedIPs = 10.0.0.2/32\n" + extra
+	}
+	client := wireguardtest.NewFakeClient(&wgtypes.Device{Name: "wg0"})
+	if err := wireguard.SyncConf(client, "wg0", strings.NewReader(
+		quick("ListenPort = 51820\n", "PresharedKey = "+psk.String()+"\n"))); err != nil {
+		t.Fatalf("sync config failed: %v", err)
+	}
+	dev, _ := client.Device("wg0")
+	if dev.ListenPort != 51820 || len(dev.Peers) != 1 || dev.Peers[0].PresharedKey != psk {
+		t.Fatalf("config not applied: %+v", dev)
+	}
+
+	// preshared key and listen port removed from the file are reset
+	if err := wireguard.SyncConf(client, "wg0", strings.NewReader(quick("", ""))); err != nil {
+		t.Fatalf("sync config without psk failed: %v", err)
+	}
+	dev, _ = client.Device("wg0")
+	if dev.ListenPort != 0 || len(dev.Peers) != 1 || dev.Peers[0].PresharedKey != (wgtypes.Key{}) ||
+		dev.PrivateKey != priv {
+		t.Fatalf("removed fields not reset: %+v", dev)
+	}
+	configures := client.Configures()
+	if delta := configures[len(configures)-1].Config; delta.ReplacePeers || delta.Peers[0].Remove ||
+		delta.Peers[0].PresharedKey == nil {
+		t.Fatalf("unexpected reload delta: %+v", delta)
+	}
+
+	if err := wireguard.SyncConf(client, "wg1", strings.NewReader(quick("", ""))); err == nil {
+		t.Fatalf("sync config of absent dev accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta-router/internal/registry"
+	"ntsc.ac.cn/ta-router/internal/registry/registrytest"
+)
+
+func testDesiredConfig(port int) *registry.DesiredConfig {
+	return &registry.DesiredConfig{
+		DNSServer: []string{"114.114.114.114"},
+		Wireguard: []*registry.WireguardConfig{{
+			Name:    "wg0",
+			PrivKey: "",
+			Port:    port,
+			Address: "10.10.0.1/24",
+		}},
+	}
+}
+
+func nextRevision(t *testing.T, revs <-chan *registry.ConfigRevision) *registry.ConfigRevision {
+	select {
+	case rev, ok := <-revs:
+		if !ok {
+			t.Fatalf("watch channel closed")
+		}
+		return rev
+	case <-time.After(time.Second * 2):
+		t.Fatalf("wait config revision timeout")
+	}
+	return nil
+}
+
+func TestWatcher(t *testing.T) {
+	fake := registrytest.NewFakeRegistry(testDesiredConfig(51820))
+	w := registry.NewWatcher(fake, time.Millisecond*10, "")
+	w.SetBackoff(time.Millisecond*5, time.Millisecond*20)
+	errs := make(chan error, 16)
+	w.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	revs := w.Watch(ctx)
+
+	rev := nextRevision(t, revs)
+	if rev.Config.Wireguard[0].Port != 51820 {
+		t.Fatalf("unexpected config port [%d]", rev.Config.Wireguard[0].Port)
+	}
+	// unacked revision is delivered again
+	if again := nextRevision(t, revs); again.Revision != rev.Revision {
+		t.Fatalf("expect revision [%s] redelivered, got [%s]", rev.Revision, again.Revision)
+	}
+	w.Ack(rev.Revision)
+
+	fake.SetError(fmt.Errorf("registry unavailable"))
+	select {
+	case err := <-errs:
+		fmt.Println("watch error:", err)
+	case <-time.After(time.Second * 2):
+		t.Fatalf("registry error not reported")
+	}
+	fake.SetConfig(testDesiredConfig(51821))
+	fake.SetError(nil)
+	next := nextRevision(t, revs)
+	if next.Revision == rev.Revision || next.Config.Wireguard[0].Port != 51821 {
+		t.Fatalf("expect new revision after reconnect, got [%s]", next.Revision)
+	}
+	w.Ack(next.Revision)
+
+	// resume from last applied revision, nothing delivered
+	resumed := registry.NewWatcher(fake, time.Millisecond*10, next.Revision)
+	rctx, rcancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer rcancel()
+	for rev := range resumed.Watch(rctx) {
+		t.Fatalf("unexpected revision [%s] after resume", rev.Revision)
+	}
+	if fake.Fetchs() == 0 {
+		t.Fatalf("registry never fetched")
+	}
+}